@@ -0,0 +1,471 @@
+package bongoz
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Stages the aggregation routes may run if AggregationConfig.AllowedStages
+// is empty
+var DefaultAggregationStages = []string{"$match", "$group", "$sort", "$limit", "$facet"}
+
+// Formats of the date buckets offered for time fields, e.g. groupBy=dateValue:day
+var dateBucketFormats = map[string]string{
+	"hour":  "%Y-%m-%dT%H",
+	"day":   "%Y-%m-%d",
+	"month": "%Y-%m",
+	"year":  "%Y",
+}
+
+var aggregateMetrics = []string{"sum", "avg", "min", "max"}
+
+// Settings of the aggregation routes, which are only registered if
+// Endpoint.Aggregation is set:
+//
+//	GET {uri}/_count                                  number of matching documents
+//	GET {uri}/_aggregate?groupBy=a,b:day&metrics=sum:c grouped counts and metrics
+//	GET {uri}/_facets?fields=a,b:month                counts per value of each field
+//
+// All of them take the same filters as list requests. Clients only choose
+// fields and metrics; the pipelines are built here and checked against
+// AllowedStages.
+type AggregationConfig struct {
+	// Fields (Go or bson name) clients may group by and get facets of
+	GroupFields []string
+	// Fields clients may compute sum, avg, min and max of
+	MetricFields []string
+	// Defaults to DefaultAggregationStages
+	AllowedStages []string
+	// Number of groups or facet values returned, 1000 by default. Clients
+	// may ask for fewer with _limit.
+	MaxGroups int
+}
+
+func (c *AggregationConfig) maxGroups() int {
+	if c.MaxGroups > 0 {
+		return c.MaxGroups
+	}
+	return 1000
+}
+
+// Stores that can run aggregation pipelines, needed for _aggregate and
+// _facets
+type Aggregator interface {
+	Aggregate(pipeline []bson.M) ([]bson.M, error)
+}
+
+// A row of an _aggregate response. Group holds the value of each groupBy
+// field by bson key, Metrics the results keyed like the metrics parameter,
+// e.g. "avg:intValue".
+type AggregateGroup struct {
+	Group   map[string]interface{}
+	Count   int
+	Metrics map[string]interface{}
+}
+
+// A value of a field and the number of documents having it
+type FacetValue struct {
+	Value interface{}
+	Count int
+}
+
+func (e *Endpoint) registerAggregationRoutes(r *mux.Router) {
+	if e.Aggregation == nil {
+		return
+	}
+
+	r.Handle(e.Uri+"/_count", e.Middleware.ReadList.ThenFunc(e.HandleCount)).Methods("GET")
+	r.Handle(e.Uri+"/_aggregate", e.Middleware.ReadList.ThenFunc(e.HandleAggregate)).Methods("GET")
+	r.Handle(e.Uri+"/_facets", e.Middleware.ReadList.ThenFunc(e.HandleFacets)).Methods("GET")
+}
+
+// Get the filter of an aggregation request, writing an error if it is
+// invalid
+func (e *Endpoint) getAggregationQuery(w http.ResponseWriter, req *http.Request) (bson.M, bool) {
+	query, err := e.getQuery(req)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
+		return nil, false
+	}
+
+	if near, _ := splitGeoNear(query); near != nil {
+		e.writeErrors(w, req, []*Error{NewError(http.StatusBadRequest, ErrorCodeInvalidQuery, "Near queries can not be aggregated")})
+		return nil, false
+	}
+
+	return query, true
+}
+
+// Handle a "_count" request
+func (e *Endpoint) HandleCount(w http.ResponseWriter, req *http.Request) {
+	defer e.handleError(w, req)
+
+	query, ok := e.getAggregationQuery(w, req)
+	if !ok {
+		return
+	}
+
+	count, err := e.getStore().Count(query)
+	if err != nil {
+		panic(err)
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: map[string]interface{}{"count": count}}
+
+	e.writeAggregate(w, req, httpResponse)
+}
+
+// Handle an "_aggregate" request. Groups are sorted by their values unless
+// _sort is count or -count.
+func (e *Endpoint) HandleAggregate(w http.ResponseWriter, req *http.Request) {
+	defer e.handleError(w, req)
+
+	query, ok := e.getAggregationQuery(w, req)
+	if !ok {
+		return
+	}
+
+	params := req.URL.Query()
+	instance := e.Factory()
+	errs := []*Error{}
+
+	id := bson.M{}
+	groupKeys := []string{}
+	for _, name := range splitParam(params.Get("groupBy")) {
+		key, expression, err := e.groupExpression(instance, name)
+		if err != nil {
+			errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "groupBy", err.Error()))
+			continue
+		}
+		id[key] = expression
+		groupKeys = append(groupKeys, key)
+	}
+
+	group := bson.M{"_id": id, "count": bson.M{"$sum": 1}}
+	metrics := splitParam(params.Get("metrics"))
+	for i, metric := range metrics {
+		accumulator, err := e.metricAccumulator(instance, metric)
+		if err != nil {
+			errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "metrics", err.Error()))
+			continue
+		}
+		group["m"+strconv.Itoa(i)] = accumulator
+	}
+
+	sort := bson.D{}
+	switch params.Get("_sort") {
+	case "":
+		for _, key := range groupKeys {
+			sort = append(sort, bson.DocElem{Name: "_id." + key, Value: 1})
+		}
+	case "count":
+		sort = append(sort, bson.DocElem{Name: "count", Value: 1})
+	case "-count":
+		sort = append(sort, bson.DocElem{Name: "count", Value: -1})
+	default:
+		errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "_sort", "Groups can only be sorted by count or -count"))
+	}
+
+	limit, limitErr := e.getAggregationLimit(req)
+	if limitErr != nil {
+		errs = append(errs, limitErr)
+	}
+
+	if len(errs) > 0 {
+		e.writeErrors(w, req, errs)
+		return
+	}
+
+	pipeline := []bson.M{{"$match": query}, {"$group": group}}
+	if len(sort) > 0 {
+		pipeline = append(pipeline, bson.M{"$sort": sort})
+	}
+	pipeline = append(pipeline, bson.M{"$limit": limit})
+
+	results, err := e.aggregate(pipeline)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	data := make([]*AggregateGroup, len(results))
+	for i, result := range results {
+		row := &AggregateGroup{
+			Group:   map[string]interface{}{},
+			Metrics: map[string]interface{}{},
+		}
+
+		groupValues, _ := toDocument(result["_id"])
+		for _, key := range groupKeys {
+			row.Group[key] = groupValues[key]
+		}
+
+		count, _ := toFloat(result["count"])
+		row.Count = int(count)
+
+		for j, metric := range metrics {
+			row.Metrics[metric] = result["m"+strconv.Itoa(j)]
+		}
+
+		data[i] = row
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: data}
+
+	e.writeAggregate(w, req, httpResponse)
+}
+
+// Handle a "_facets" request. Values of each field are sorted by count,
+// most common first.
+func (e *Endpoint) HandleFacets(w http.ResponseWriter, req *http.Request) {
+	defer e.handleError(w, req)
+
+	query, ok := e.getAggregationQuery(w, req)
+	if !ok {
+		return
+	}
+
+	instance := e.Factory()
+	errs := []*Error{}
+
+	limit, limitErr := e.getAggregationLimit(req)
+	if limitErr != nil {
+		errs = append(errs, limitErr)
+	}
+
+	facet := bson.M{}
+	names := splitParam(req.URL.Query().Get("fields"))
+	for _, name := range names {
+		_, expression, err := e.groupExpression(instance, name)
+		if err != nil {
+			errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "fields", err.Error()))
+			continue
+		}
+
+		facet[name] = []bson.M{
+			{"$group": bson.M{"_id": expression, "count": bson.M{"$sum": 1}}},
+			{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+			{"$limit": limit},
+		}
+	}
+
+	if len(names) == 0 {
+		errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "fields", "At least one field is required"))
+	}
+
+	if len(errs) > 0 {
+		e.writeErrors(w, req, errs)
+		return
+	}
+
+	results, err := e.aggregate([]bson.M{{"$match": query}, {"$facet": facet}})
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	data := map[string][]*FacetValue{}
+	for _, name := range names {
+		data[name] = []*FacetValue{}
+
+		if len(results) == 0 {
+			continue
+		}
+
+		values, _ := toSlice(results[0][name])
+		for _, value := range values {
+			valueDoc, _ := toDocument(value)
+			count, _ := toFloat(valueDoc["count"])
+			data[name] = append(data[name], &FacetValue{valueDoc["_id"], int(count)})
+		}
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: data}
+
+	e.writeAggregate(w, req, httpResponse)
+}
+
+// Write the result of an aggregation like a document, through the envelope
+// and the negotiated encoder. Only EnvelopeEncoders can write it, as the
+// others encode documents of the endpoint's model.
+func (e *Endpoint) writeAggregate(w http.ResponseWriter, req *http.Request, response *HTTPSingleResponse) {
+	encoder, ok := e.negotiateEncoder(w, req)
+	if !ok {
+		return
+	}
+
+	envelopeEncoder, ok := encoder.(EnvelopeEncoder)
+	if !ok {
+		e.writeErrors(w, req, []*Error{NewError(http.StatusNotAcceptable, ErrorCodeNotAcceptable, "Aggregations can not be returned as "+encoder.ContentType())})
+		return
+	}
+
+	aggregateEnvelope, ok := e.envelope().(AggregateEnvelope)
+	if !ok {
+		err := e.writeOne(w, req, encoder, http.StatusOK, response)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	value, err := aggregateEnvelope.RenderAggregate(e, req, response)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", e.contentType(encoder))
+	w.WriteHeader(http.StatusOK)
+
+	err = envelopeEncoder.EncodeValue(w, value)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Split a comma separated parameter, skipping empty items
+func splitParam(param string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(param, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func (e *Endpoint) getAggregationLimit(req *http.Request) (int, *Error) {
+	limit := e.Aggregation.maxGroups()
+
+	limitParam := req.URL.Query().Get("_limit")
+	if len(limitParam) > 0 {
+		converted, err := strconv.Atoi(limitParam)
+		if err != nil || converted < 1 {
+			return limit, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "_limit", "Invalid limit "+limitParam)
+		}
+
+		if converted < limit {
+			limit = converted
+		}
+	}
+
+	return limit, nil
+}
+
+// Resolve a field that is allowed by the given list
+func resolveAllowedField(instance interface{}, name string, allowed []string) (*resolvedField, error) {
+	field, ok := resolveField(name, instance)
+	if !ok {
+		return nil, fmt.Errorf("Unknown field %s", name)
+	}
+
+	if !stringInSlice(field.Name, allowed) && !stringInSlice(field.BsonKey, allowed) {
+		return nil, fmt.Errorf("Field %s can not be aggregated", name)
+	}
+
+	return field, nil
+}
+
+// The bson key and group expression of a groupBy item, field or field:unit
+// for date buckets
+func (e *Endpoint) groupExpression(instance interface{}, name string) (string, interface{}, error) {
+	pieces := strings.SplitN(name, ":", 2)
+
+	field, err := resolveAllowedField(instance, pieces[0], e.Aggregation.GroupFields)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(pieces) == 1 {
+		return field.BsonKey, "$" + field.BsonKey, nil
+	}
+
+	format, ok := dateBucketFormats[pieces[1]]
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown date bucket %s, expected hour, day, month or year", pieces[1])
+	}
+
+	typ := indirectType(reflectValue(instance).Type().FieldByIndex(field.Index).Type)
+	if typ != timeType {
+		return "", nil, fmt.Errorf("Field %s is not a date", pieces[0])
+	}
+
+	return field.BsonKey, bson.M{"$dateToString": bson.M{"format": format, "date": "$" + field.BsonKey}}, nil
+}
+
+// The $group accumulator of a metric, op:field
+func (e *Endpoint) metricAccumulator(instance interface{}, metric string) (bson.M, error) {
+	pieces := strings.SplitN(metric, ":", 2)
+	if len(pieces) != 2 || !stringInSlice(pieces[0], aggregateMetrics) {
+		return nil, fmt.Errorf("Invalid metric %s, expected sum, avg, min or max and a field, e.g. sum:total", metric)
+	}
+
+	field, err := resolveAllowedField(instance, pieces[1], e.Aggregation.MetricFields)
+	if err != nil {
+		return nil, err
+	}
+
+	if pieces[0] == "sum" || pieces[0] == "avg" {
+		switch indirectType(reflectValue(instance).Type().FieldByIndex(field.Index).Type).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			return nil, fmt.Errorf("Field %s is not a number", pieces[1])
+		}
+	}
+
+	return bson.M{"$" + pieces[0]: "$" + field.BsonKey}, nil
+}
+
+// Check the stages of a pipeline and run it with the endpoint's store
+func (e *Endpoint) aggregate(pipeline []bson.M) ([]bson.M, error) {
+	allowed := e.Aggregation.AllowedStages
+	if len(allowed) == 0 {
+		allowed = DefaultAggregationStages
+	}
+
+	if err := checkPipelineStages(pipeline, allowed); err != nil {
+		return nil, err
+	}
+
+	aggregator, ok := e.getStore().(Aggregator)
+	if !ok {
+		return nil, errors.New("The store can not run aggregations")
+	}
+
+	return aggregator.Aggregate(pipeline)
+}
+
+func checkPipelineStages(pipeline []bson.M, allowed []string) error {
+	for _, stage := range pipeline {
+		for name, spec := range stage {
+			if !stringInSlice(name, allowed) {
+				return NewError(http.StatusBadRequest, ErrorCodeInvalidQuery, fmt.Sprintf("Stage %s is not allowed", name))
+			}
+
+			if name != "$facet" {
+				continue
+			}
+
+			facets, _ := toDocument(spec)
+			for _, sub := range facets {
+				subPipeline, _ := sub.([]bson.M)
+				if err := checkPipelineStages(subPipeline, allowed); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
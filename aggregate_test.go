@@ -0,0 +1,125 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAggregation(t *testing.T) {
+	Convey("Aggregation", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+		endpoint.Filters = map[string]FilterOp{"intValue": FilterComparison}
+		endpoint.Aggregation = &AggregationConfig{
+			GroupFields:  []string{"Content", "dateValue"},
+			MetricFields: []string{"intValue", "dateValue"},
+		}
+
+		day := func(d int) time.Time {
+			return time.Date(2015, 4, d, 12, 0, 0, 0, time.UTC)
+		}
+
+		So(store.Save(&Page{Content: "a", IntValue: 1, DateValue: day(1)}), ShouldEqual, nil)
+		So(store.Save(&Page{Content: "a", IntValue: 3, DateValue: day(2)}), ShouldEqual, nil)
+		So(store.Save(&Page{Content: "b", IntValue: 5, DateValue: day(2)}), ShouldEqual, nil)
+
+		router := endpoint.GetRouter()
+
+		get := func(url string, response interface{}) int {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", url, nil)
+			router.ServeHTTP(w, req)
+
+			json.Unmarshal(w.Body.Bytes(), response)
+			return w.Code
+		}
+
+		Convey("counts with filters", func() {
+			response := &singleResponse{}
+			code := get("/api/pages/_count?intValue[gt]=1", response)
+
+			So(code, ShouldEqual, 200)
+			So(response.Data["count"], ShouldEqual, 2)
+		})
+		Convey("groups with metrics", func() {
+			response := &struct{ Data []*AggregateGroup }{}
+			code := get("/api/pages/_aggregate?groupBy=content&metrics=sum:intValue,avg:intValue,max:dateValue", response)
+
+			So(code, ShouldEqual, 200)
+			So(len(response.Data), ShouldEqual, 2)
+			So(response.Data[0].Group, ShouldResemble, map[string]interface{}{"content": "a"})
+			So(response.Data[0].Count, ShouldEqual, 2)
+			So(response.Data[0].Metrics["sum:intValue"], ShouldEqual, 4)
+			So(response.Data[0].Metrics["avg:intValue"], ShouldEqual, 2)
+			So(response.Data[0].Metrics["max:dateValue"], ShouldEqual, "2015-04-02T12:00:00Z")
+			So(response.Data[1].Group, ShouldResemble, map[string]interface{}{"content": "b"})
+		})
+		Convey("buckets dates", func() {
+			response := &struct{ Data []*AggregateGroup }{}
+			code := get("/api/pages/_aggregate?groupBy=dateValue:day&_sort=-count", response)
+
+			So(code, ShouldEqual, 200)
+			So(len(response.Data), ShouldEqual, 2)
+			So(response.Data[0].Group["dateValue"], ShouldEqual, "2015-04-02")
+			So(response.Data[0].Count, ShouldEqual, 2)
+		})
+		Convey("facets", func() {
+			response := &struct{ Data map[string][]*FacetValue }{}
+			code := get("/api/pages/_facets?fields=content,dateValue:month&_limit=1", response)
+
+			So(code, ShouldEqual, 200)
+			So(response.Data["content"], ShouldResemble, []*FacetValue{{"a", 2}})
+			So(response.Data["dateValue:month"], ShouldResemble, []*FacetValue{{"2015-04", 3}})
+		})
+		Convey("through the envelope and encoders", func() {
+			endpoint.Envelope = &BareEnvelope{}
+			response := map[string]interface{}{}
+			code := get("/api/pages/_count", &response)
+
+			So(code, ShouldEqual, 200)
+			So(response["count"], ShouldEqual, 3)
+
+			endpoint.Envelope = &JSONAPIEnvelope{}
+			response = map[string]interface{}{}
+			code = get("/api/pages/_count", &response)
+
+			So(code, ShouldEqual, 200)
+			So(response["meta"], ShouldResemble, map[string]interface{}{"count": 3.0})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages/_count", nil)
+			req.Header.Set("Accept", "application/msgpack")
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/msgpack")
+			So(w.Body.Bytes(), ShouldResemble, []byte{0x81, 0xa4, 'm', 'e', 't', 'a', 0x81, 0xa5, 'c', 'o', 'u', 'n', 't', 0x03})
+
+			code = get("/api/pages/_count?_format=csv", &response)
+
+			So(code, ShouldEqual, 406)
+		})
+		Convey("rejects fields, metrics and stages that are not allowed", func() {
+			response := &errorResponse{}
+			code := get("/api/pages/_aggregate?groupBy=intValue,content:day&metrics=sum:content,count:intValue", response)
+
+			So(code, ShouldEqual, 400)
+			So(len(response.Errors), ShouldEqual, 4)
+			So(response.Errors[0].Message, ShouldEqual, "Field intValue can not be aggregated")
+			So(response.Errors[1].Message, ShouldEqual, "Field content is not a date")
+
+			endpoint.Aggregation.AllowedStages = []string{"$match", "$group"}
+			code = get("/api/pages/_facets?fields=content", response)
+
+			So(code, ShouldEqual, 400)
+			So(response.Errors[0].Message, ShouldEqual, "Stage $facet is not allowed")
+		})
+	})
+}
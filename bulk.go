@@ -0,0 +1,305 @@
+package bongoz
+
+import (
+	"bufio"
+	"github.com/maxwellhealth/bongo"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Outcome of a single item in a bulk request
+type BulkResult struct {
+	Status int
+	Id     string
+	Errors []*Error
+}
+
+type HTTPBulkResponse struct {
+	Data []*BulkResult
+}
+
+func newBulkResult(status int, id string, errs ...*Error) *BulkResult {
+	return &BulkResult{
+		Status: status,
+		Id:     id,
+		Errors: errs,
+	}
+}
+
+// Turn an error into a per-item result, see toErrors
+func bulkErrorResult(id string, err error, status int, code string) *BulkResult {
+	errs := toErrors(err, status, code)
+	return newBulkResult(errs[0].Status, id, errs...)
+}
+
+// Check whether the (remaining) body is a JSON array, without consuming it
+func isJSONArray(r *bufio.Reader) bool {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+
+		if b == ' ' || b == '\t' || b == '\n' || b == '\r' {
+			continue
+		}
+
+		r.UnreadByte()
+		return b == '['
+	}
+}
+
+// Bulk requests are ordered unless _ordered=false is passed. An ordered
+// request stops at the first failing item, an unordered one processes all.
+func bulkIsOrdered(req *http.Request) bool {
+	return req.URL.Query().Get("_ordered") != "false"
+}
+
+// Run fn for every item and write the results. Items skipped because an
+// earlier one failed in an ordered request get a 424 Failed Dependency.
+func (e *Endpoint) runBulk(w http.ResponseWriter, req *http.Request, count int, successStatus int, fn func(i int) *BulkResult) {
+	if e.MaxBulkItems > 0 && count > e.MaxBulkItems {
+		e.writeErrors(w, req, []*Error{NewError(http.StatusRequestEntityTooLarge, ErrorCodeTooManyItems, "Too many items in bulk request")})
+		return
+	}
+
+	ordered := bulkIsOrdered(req)
+
+	results := make([]*BulkResult, count)
+	status := successStatus
+	failed := false
+
+	for i := 0; i < count; i++ {
+		if failed && ordered {
+			results[i] = newBulkResult(http.StatusFailedDependency, "", NewError(http.StatusFailedDependency, ErrorCodeSkipped, "Skipped after an earlier item failed"))
+			continue
+		}
+
+		results[i] = fn(i)
+
+		if results[i].Status >= 400 {
+			failed = true
+			status = http.StatusMultiStatus
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	w.WriteHeader(status)
+	err := encoder.Encode(&HTTPBulkResponse{results})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Create every document of a JSON array. Called by HandleCreate when bulk
+// requests are allowed and the body is an array.
+func (e *Endpoint) handleBulkCreate(w http.ResponseWriter, req *http.Request, body io.Reader) {
+	var items []json.RawMessage
+
+	err := json.NewDecoder(body).Decode(&items)
+	if err != nil {
+		e.writeBodyError(w, req, err, ErrorCodeInvalidBody)
+		return
+	}
+
+	store := e.getStore()
+
+	e.runBulk(w, req, len(items), http.StatusCreated, func(i int) *BulkResult {
+		obj := e.Factory()
+
+		if trackable, ok := obj.(bongo.Trackable); ok {
+			trackable.GetDiffTracker().Reset()
+		}
+
+		protected := e.snapshotProtectedFields(obj, true)
+
+		err := json.Unmarshal(items[i], obj)
+		if err != nil {
+			return bulkErrorResult("", err, http.StatusBadRequest, ErrorCodeInvalidBody)
+		}
+
+		if errs := e.enforceFieldPolicies(obj, protected); len(errs) > 0 {
+			return newBulkResult(http.StatusBadRequest, "", errs...)
+		}
+
+		err = e.Hooks.beforeCreate(req, obj)
+		if err != nil {
+			return bulkErrorResult("", err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		err = e.checkScope(req, obj)
+		if err != nil {
+			return bulkErrorResult("", err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		err = store.Save(obj)
+		if err != nil {
+			return bulkErrorResult("", err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		logAfterHookError(req, "AfterCreate", e.Hooks.afterCreate(req, obj))
+
+		return newBulkResult(http.StatusCreated, obj.GetId().Hex())
+	})
+}
+
+// Handle a bulk update. The body is an array of objects identified by their
+// _id. PUT decodes each object over the stored document like HandleUpdate,
+// PATCH applies each one as a merge patch like HandlePatch.
+func (e *Endpoint) HandleBulkUpdate(w http.ResponseWriter, req *http.Request) {
+	defer e.handleError(w, req)
+	w.Header().Set("Content-Type", "application/json")
+
+	if !e.limitBody(w, req) {
+		return
+	}
+
+	var items []map[string]interface{}
+
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+
+	err := decoder.Decode(&items)
+	if err != nil {
+		e.writeBodyError(w, req, err, ErrorCodeInvalidBody)
+		return
+	}
+
+	patch := req.Method == "PATCH"
+	store := e.getStore()
+
+	e.runBulk(w, req, len(items), http.StatusOK, func(i int) *BulkResult {
+		id, _ := items[i]["_id"].(string)
+		if len(id) == 0 || !bson.IsObjectIdHex(id) {
+			return newBulkResult(http.StatusBadRequest, id, invalidIdError())
+		}
+
+		instance := e.Factory()
+
+		err := e.findById(req, store, bson.ObjectIdHex(id), instance, nil)
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusNotFound, ErrorCodeNotFound)
+		}
+
+		if trackable, ok := instance.(bongo.Trackable); ok {
+			trackable.GetDiffTracker().Reset()
+		}
+
+		actualId := instance.GetId()
+		protected := e.snapshotProtectedFields(instance, false)
+		original := e.originalForUpdate(instance)
+
+		before, err := encodeBson(instance)
+		if err != nil {
+			panic(err)
+		}
+
+		if patch {
+			err = applyMergePatchToDocument(instance, items[i])
+		} else {
+			var marshaled []byte
+			marshaled, err = json.Marshal(items[i])
+			if err == nil {
+				err = json.Unmarshal(marshaled, instance)
+			}
+		}
+
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusBadRequest, ErrorCodeInvalidBody)
+		}
+
+		instance.SetId(actualId)
+
+		if errs := e.enforceFieldPolicies(instance, protected); len(errs) > 0 {
+			return newBulkResult(http.StatusBadRequest, id, errs...)
+		}
+
+		if tt, ok := instance.(bongo.TimeTracker); ok {
+			tt.SetModified(time.Now())
+		}
+
+		err = e.Hooks.beforeUpdate(req, original, instance)
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		err = e.checkScope(req, instance)
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		if patch {
+			err = e.savePartial(store, instance, before, nil)
+		} else if e.dropsDeletedField(instance) {
+			err = saveWithUpdate(store, instance, before, nil)
+		} else {
+			err = store.Save(instance)
+		}
+
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		logAfterHookError(req, "AfterUpdate", e.Hooks.afterUpdate(req, instance))
+
+		return newBulkResult(http.StatusOK, id)
+	})
+}
+
+// Handle a bulk delete. The ids are passed either as a JSON array in the body
+// or comma separated in the _ids query parameter.
+func (e *Endpoint) HandleBulkDelete(w http.ResponseWriter, req *http.Request) {
+	defer e.handleError(w, req)
+	w.Header().Set("Content-Type", "application/json")
+
+	var ids []string
+
+	if idsParam := req.URL.Query().Get("_ids"); len(idsParam) > 0 {
+		ids = strings.Split(idsParam, ",")
+	} else {
+		if !e.limitBody(w, req) {
+			return
+		}
+
+		err := json.NewDecoder(req.Body).Decode(&ids)
+		if err != nil {
+			e.writeBodyError(w, req, err, ErrorCodeInvalidBody)
+			return
+		}
+	}
+
+	store := e.getStore()
+
+	e.runBulk(w, req, len(ids), http.StatusOK, func(i int) *BulkResult {
+		id := strings.TrimSpace(ids[i])
+		if !bson.IsObjectIdHex(id) {
+			return newBulkResult(http.StatusBadRequest, id, invalidIdError())
+		}
+
+		instance := e.Factory()
+
+		err := e.findById(req, store, bson.ObjectIdHex(id), instance, nil)
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusNotFound, ErrorCodeNotFound)
+		}
+
+		err = e.Hooks.beforeDelete(req, instance)
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		err = e.deleteDocument(store, instance, nil)
+		if err != nil {
+			return bulkErrorResult(id, err, http.StatusInternalServerError, ErrorCodeInternal)
+		}
+
+		logAfterHookError(req, "AfterDelete", e.Hooks.afterDelete(req, instance))
+
+		return newBulkResult(http.StatusOK, id)
+	})
+}
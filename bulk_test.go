@@ -0,0 +1,104 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type bulkResponse struct {
+	Data []BulkResult
+}
+
+func TestBulk(t *testing.T) {
+	conn := getConnection()
+	collection := conn.Collection("pages")
+	defer conn.Session.Close()
+
+	Convey("Bulk", t, func() {
+		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		endpoint.AllowBulk = true
+
+		Convey("create with per item validation errors", func() {
+			endpoint.Factory = ValidFactory
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			reader := strings.NewReader(`[{"content":"foo"},{"content":""},{"content":"bar"}]`)
+			req, _ := http.NewRequest("POST", "/api/pages?_ordered=false", reader)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 207)
+
+			response := &bulkResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(len(response.Data), ShouldEqual, 3)
+			So(response.Data[0].Status, ShouldEqual, 201)
+			So(response.Data[1].Status, ShouldEqual, 400)
+			So(len(response.Data[1].Errors), ShouldEqual, 1)
+			So(response.Data[1].Errors[0].Code, ShouldEqual, ErrorCodeValidation)
+			So(response.Data[1].Errors[0].Message, ShouldEqual, "Content is required")
+			So(response.Data[2].Status, ShouldEqual, 201)
+		})
+		Convey("ordered create stops at the first failure", func() {
+			endpoint.Factory = ValidFactory
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			reader := strings.NewReader(`[{"content":""},{"content":"bar"}]`)
+			req, _ := http.NewRequest("POST", "/api/pages", reader)
+			router.ServeHTTP(w, req)
+
+			response := &bulkResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data[1].Status, ShouldEqual, 424)
+
+			pagination, _ := collection.Find(nil).Paginate(50, 1)
+			So(pagination.TotalRecords, ShouldEqual, 0)
+		})
+		Convey("update and delete", func() {
+			endpoint.Factory = Factory
+
+			obj1 := &Page{Content: "foo"}
+			obj2 := &Page{Content: "bar"}
+			collection.Save(obj1)
+			collection.Save(obj2)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			reader := strings.NewReader(`[{"_id":"` + obj1.Id.Hex() + `","content":"baz"}]`)
+			req, _ := http.NewRequest("PATCH", "/api/pages", reader)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			found := &Page{}
+			err := collection.FindById(obj1.Id, found)
+			So(err, ShouldEqual, nil)
+			So(found.Content, ShouldEqual, "baz")
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/api/pages?_ids="+obj1.Id.Hex()+","+obj2.Id.Hex(), nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			pagination, _ := collection.Find(nil).Paginate(50, 1)
+			So(pagination.TotalRecords, ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongoz").DropDatabase()
+		})
+	})
+}
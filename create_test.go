@@ -71,7 +71,7 @@ func TestCreate(t *testing.T) {
 			router.ServeHTTP(w, req)
 
 			So(w.Code, ShouldEqual, 400)
-			So(w.Body.String(), ShouldEqual, "{\"errors\":[\"Content is required\"]}")
+			So(w.Body.String(), ShouldEqual, "{\"errors\":[{\"code\":\"validation_failed\",\"message\":\"Content is required\"}]}")
 		})
 
 		Reset(func() {
@@ -0,0 +1,287 @@
+package bongoz
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/maxwellhealth/bongo"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+type PaginationMode int
+
+const (
+	// Classic page/perPage pagination, backed by a count query
+	PaginationModePages PaginationMode = iota
+	// Keyset pagination with opaque _after/_before cursors. Never counts.
+	PaginationModeCursor
+)
+
+// Pagination block for cursor mode. Pass Next as _after to get the following
+// page and Prev as _before to get the preceding one.
+type CursorPaginationInfo struct {
+	PerPage       int    `json:"perPage"`
+	RecordsOnPage int    `json:"recordsOnPage"`
+	Next          string `json:"next,omitempty"`
+	Prev          string `json:"prev,omitempty"`
+}
+
+// Contents of a cursor token. The sort is stored as well so a token cannot
+// be reused with a different ordering.
+type cursorToken struct {
+	Sort   []string      `bson:"s"`
+	Values []interface{} `bson:"v"`
+}
+
+// Cursor mode is used if the request passes a cursor (an empty _after starts
+// at the beginning, an empty _before at the end), or if the endpoint defaults
+// to cursors and the request does not ask for pages, limit or skip.
+func (e *Endpoint) usesCursorPagination(req *http.Request) bool {
+	params := req.URL.Query()
+
+	for _, param := range []string{"_after", "_before"} {
+		if _, ok := params[param]; ok {
+			return true
+		}
+	}
+
+	for _, param := range []string{"_page", "_limit", "_skip"} {
+		if _, ok := params[param]; ok {
+			return false
+		}
+	}
+
+	return e.Pagination.Mode == PaginationModeCursor
+}
+
+func encodeCursor(sort []SortConfig, doc interface{}) (string, error) {
+	encoded, err := encodeBson(doc)
+	if err != nil {
+		return "", err
+	}
+
+	token := &cursorToken{
+		Sort:   sortConfigToStrings(sort),
+		Values: make([]interface{}, len(sort)),
+	}
+
+	for i, s := range sort {
+		token.Values[i], _ = lookupPath(encoded, s.Field)
+	}
+
+	marshaled, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(marshaled), nil
+}
+
+func decodeCursor(cursor string, sort []SortConfig) (*cursorToken, error) {
+	invalid := errors.New("Invalid cursor")
+
+	marshaled, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalid
+	}
+
+	token := &cursorToken{}
+	err = bson.Unmarshal(marshaled, token)
+	if err != nil {
+		return nil, invalid
+	}
+
+	if !reflect.DeepEqual(token.Sort, sortConfigToStrings(sort)) || len(token.Values) != len(sort) {
+		return nil, errors.New("Cursor does not match the requested sort")
+	}
+
+	// Tokens are not signed and their values end up in the query, so
+	// operator documents, regular expressions and the like are refused
+	for _, value := range token.Values {
+		if !isCursorValue(value) {
+			return nil, invalid
+		}
+	}
+
+	return token, nil
+}
+
+// Whether a decoded cursor value is a scalar that can only be compared
+func isCursorValue(value interface{}) bool {
+	switch value.(type) {
+	case nil, string, bool, int, int32, int64, float64, time.Time, bson.ObjectId:
+		return true
+	}
+
+	return false
+}
+
+// Build the filter selecting documents positioned after (or before) the
+// given sort key values. Missing and null values sort before all others,
+// which comparisons with null do not select, so they are handled apart.
+func keysetFilter(sort []SortConfig, values []interface{}, forward bool) bson.M {
+	or := []bson.M{}
+
+	for i := range sort {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[sort[j].Field] = values[j]
+		}
+
+		field := sort[i].Field
+		greater := (sort[i].Direction < 0) != forward
+
+		if values[i] == nil {
+			if !greater {
+				// Nothing comes before null
+				continue
+			}
+			clause[field] = bson.M{"$ne": nil}
+		} else if greater {
+			clause[field] = bson.M{"$gt": values[i]}
+		} else {
+			clause["$or"] = []bson.M{
+				{field: bson.M{"$lt": values[i]}},
+				{field: nil},
+			}
+		}
+
+		or = append(or, clause)
+	}
+
+	if len(or) == 0 {
+		return bson.M{"_id": bson.M{"$in": []interface{}{}}}
+	}
+
+	return bson.M{"$or": or}
+}
+
+// Handle a list request in cursor mode. Fetches one document more than the
+// page size to find out if there is another page, so no count is needed.
+func (e *Endpoint) handleReadListWithCursor(w http.ResponseWriter, req *http.Request, query bson.M, encoder Encoder) {
+	var err error
+
+	params := req.URL.Query()
+
+	perPage := e.getPerPage(req)
+	sort, err := e.getSort(req)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
+		return
+	}
+
+	forward := true
+	cursor := params.Get("_after")
+	if _, ok := params["_before"]; ok {
+		forward = false
+		cursor = params.Get("_before")
+	}
+
+	filter := query
+	if len(cursor) > 0 {
+		token, err := decodeCursor(cursor, sort)
+		if err != nil {
+			e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
+			return
+		}
+
+		filter = andFilters(query, keysetFilter(sort, token.Values, forward))
+	}
+
+	querySort := sort
+	if !forward {
+		querySort = reverseSort(sort)
+	}
+
+	selection, err := e.getFieldSelection(req)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
+		return
+	}
+
+	options := &FindOptions{
+		Sort:  sortConfigToStrings(querySort),
+		Limit: perPage + 1,
+	}
+
+	if selection != nil {
+		// The sort keys are needed to build the cursors
+		for _, s := range sort {
+			selection.Projection[s.Field] = 1
+		}
+		options.Projection = selection.Projection
+	}
+
+	results, err := e.getStore().Find(filter, options)
+	if err != nil {
+		panic(err)
+	}
+	defer results.Close()
+
+	response := make([]interface{}, 0, perPage)
+	hasMore := false
+
+	for {
+		res := e.Factory()
+		if !results.Next(res) {
+			break
+		}
+
+		if len(response) == perPage {
+			hasMore = true
+			break
+		}
+		response = append(response, res)
+	}
+
+	if !forward {
+		for i, j := 0, len(response)-1; i < j; i, j = i+1, j-1 {
+			response[i], response[j] = response[j], response[i]
+		}
+	}
+
+	data := make([]interface{}, len(response))
+	for i, res := range response {
+		err = e.Hooks.afterRead(req, res.(bongo.Document))
+		if err != nil {
+			e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+			return
+		}
+
+		data[i], err = e.renderDocument(res, selection)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	pageInfo := &CursorPaginationInfo{
+		PerPage:       perPage,
+		RecordsOnPage: len(response),
+	}
+
+	if len(response) > 0 {
+		if hasMore && forward || !forward && len(cursor) > 0 {
+			pageInfo.Next, err = encodeCursor(sort, response[len(response)-1])
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if hasMore && !forward || forward && len(cursor) > 0 {
+			pageInfo.Prev, err = encodeCursor(sort, response[0])
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	httpResponse := &HTTPListResponse{Pagination: pageInfo, Data: data}
+
+	err = e.writeList(w, req, encoder, httpResponse)
+
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+	}
+}
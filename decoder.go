@@ -0,0 +1,443 @@
+package bongoz
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormContentType          = "application/x-www-form-urlencoded"
+	MultipartFormContentType = "multipart/form-data"
+)
+
+// Decodes create and update bodies of one content type into a model
+// instance. params are the parameters of the Content-Type header, e.g. the
+// boundary of multipart bodies. Fields missing from the body keep their
+// values, so updates only change the fields they pass.
+type Decoder interface {
+	Decode(r io.Reader, params map[string]string, doc interface{}) error
+}
+
+// The decoders of a new endpoint, by media type
+func DefaultDecoders() map[string]Decoder {
+	form := &FormDecoder{}
+
+	return map[string]Decoder{
+		"application/json":       &JSONDecoder{},
+		FormContentType:          form,
+		MultipartFormContentType: form,
+		MessagePackContentType:   &MessagePackDecoder{},
+		ExtendedJSONContentType:  &ExtendedJSONDecoder{},
+		JSONAPIContentType:       &JSONAPIDecoder{},
+	}
+}
+
+func (e *Endpoint) decoders() map[string]Decoder {
+	if e.Decoders == nil {
+		e.Decoders = DefaultDecoders()
+	}
+
+	return e.Decoders
+}
+
+// Pick the decoder for the body by its Content-Type. Bodies without one are
+// decoded as JSON. Writes a 415 and returns false for other types.
+func (e *Endpoint) negotiateDecoder(w http.ResponseWriter, req *http.Request) (Decoder, map[string]string, bool) {
+	decoders := e.decoders()
+
+	contentType := req.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		if decoder, ok := decoders["application/json"]; ok {
+			return decoder, nil, true
+		}
+		return &JSONDecoder{}, nil, true
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		if decoder, ok := decoders[mediaType]; ok {
+			return decoder, params, true
+		}
+	}
+
+	supported := make([]string, 0, len(decoders))
+	for mediaType := range decoders {
+		supported = append(supported, mediaType)
+	}
+	sort.Strings(supported)
+
+	e.writeErrors(w, req, []*Error{NewError(http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, "Unsupported content type "+contentType+", use one of "+strings.Join(supported, ", "))})
+	return nil, nil, false
+}
+
+var errBodyTooLarge = errors.New("Request body is too large")
+
+// Request body failing with errBodyTooLarge once more than remaining bytes
+// are read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errBodyTooLarge
+	}
+
+	// Read a byte past the limit to tell whether there is more
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		return n, err
+	}
+
+	n = int(l.remaining)
+	l.remaining = 0
+	l.exceeded = true
+
+	return n, errBodyTooLarge
+}
+
+func bodyTooLargeError(max int64) *Error {
+	return NewError(http.StatusRequestEntityTooLarge, ErrorCodeBodyTooLarge, fmt.Sprintf("Request bodies are limited to %d bytes", max))
+}
+
+// Enforce MaxBodySize on the request body. Bodies declaring a larger
+// Content-Length are answered with a 413 right away, returning false.
+func (e *Endpoint) limitBody(w http.ResponseWriter, req *http.Request) bool {
+	if e.MaxBodySize <= 0 {
+		return true
+	}
+
+	if req.ContentLength > e.MaxBodySize {
+		e.writeErrors(w, req, []*Error{bodyTooLargeError(e.MaxBodySize)})
+		return false
+	}
+
+	req.Body = &limitedBody{ReadCloser: req.Body, remaining: e.MaxBodySize}
+
+	return true
+}
+
+// Write the error of decoding the body. Decoders may wrap read errors, so
+// bodies over the limit are told by the body itself.
+func (e *Endpoint) writeBodyError(w http.ResponseWriter, req *http.Request, err error, code string) {
+	if body, ok := req.Body.(*limitedBody); ok && body.exceeded {
+		e.writeErrors(w, req, []*Error{bodyTooLargeError(e.MaxBodySize)})
+		return
+	}
+
+	e.writeError(w, req, err, http.StatusBadRequest, code)
+}
+
+type JSONDecoder struct{}
+
+func (j *JSONDecoder) Decode(r io.Reader, params map[string]string, doc interface{}) error {
+	return json.NewDecoder(r).Decode(doc)
+}
+
+// Decode the JSON encoding of value into doc
+func decodeJSONValue(value interface{}, doc interface{}) error {
+	marshaled, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(marshaled, doc)
+}
+
+// Decodes urlencoded forms, and multipart forms if the Content-Type has a
+// boundary. Keys are the JSON or bson keys of fields, with dots for fields
+// of nested structs (address.city). Values are converted to the field
+// types like filter values, and slices take every value of their key.
+// Unknown keys and uploaded files are ignored.
+type FormDecoder struct {
+	// Memory used for multipart bodies before parts are stored in
+	// temporary files, 32 MB if zero
+	MaxMemory int64
+}
+
+func (f *FormDecoder) Decode(r io.Reader, params map[string]string, doc interface{}) error {
+	var values url.Values
+
+	if boundary, ok := params["boundary"]; ok {
+		maxMemory := f.MaxMemory
+		if maxMemory == 0 {
+			maxMemory = 32 << 20
+		}
+
+		form, err := multipart.NewReader(r, boundary).ReadForm(maxMemory)
+		if err != nil {
+			return err
+		}
+		defer form.RemoveAll()
+
+		values = form.Value
+	} else {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		values, err = url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+	}
+
+	object := map[string]interface{}{}
+	typ := reflectValue(doc).Type()
+
+	for key, items := range values {
+		err := setFormValue(object, typ, strings.Split(key, "."), items)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err.Error())
+		}
+	}
+
+	return decodeJSONValue(object, doc)
+}
+
+// Set the converted value of the field at path in object, under JSON keys
+func setFormValue(object map[string]interface{}, typ reflect.Type, path []string, items []string) error {
+	var field *resolvedField
+	for _, f := range listFieldsOfType(typ, []int{}) {
+		if f.JSONKey == path[0] || f.BsonKey == path[0] {
+			field = f
+			break
+		}
+	}
+
+	if field == nil {
+		return nil
+	}
+
+	fieldType := indirectType(typ.FieldByIndex(field.Index).Type)
+
+	if len(path) > 1 {
+		if fieldType.Kind() != reflect.Struct || fieldType == timeType {
+			return nil
+		}
+
+		nested, ok := object[field.JSONKey].(map[string]interface{})
+		if !ok {
+			nested = map[string]interface{}{}
+			object[field.JSONKey] = nested
+		}
+
+		return setFormValue(nested, fieldType, path[1:], items)
+	}
+
+	converted := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		// Empty inputs leave fields other than strings alone
+		if len(item) == 0 && fieldType.Kind() != reflect.String {
+			continue
+		}
+
+		value, err := coerceFilterValue(fieldType, item)
+		if err != nil {
+			return err
+		}
+		converted = append(converted, value)
+	}
+
+	if (fieldType.Kind() == reflect.Slice || fieldType.Kind() == reflect.Array) && fieldType.Elem().Kind() != reflect.Uint8 {
+		object[field.JSONKey] = converted
+	} else if len(converted) > 0 {
+		object[field.JSONKey] = converted[0]
+	}
+
+	return nil
+}
+
+// Decodes MessagePack maps keyed like the JSON encoding of the model
+type MessagePackDecoder struct{}
+
+func (m *MessagePackDecoder) Decode(r io.Reader, params map[string]string, doc interface{}) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	value, err := readMessagePack(body)
+	if err != nil {
+		return err
+	}
+
+	return decodeJSONValue(value, doc)
+}
+
+// Decodes MongoDB extended JSON as written by ExtendedJSONEncoder, keyed by
+// bson keys
+type ExtendedJSONDecoder struct{}
+
+func (x *ExtendedJSONDecoder) Decode(r io.Reader, params map[string]string, doc interface{}) error {
+	var value interface{}
+
+	err := json.NewDecoder(r).Decode(&value)
+	if err != nil {
+		return err
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("Expected a document")
+	}
+
+	converted, err := fromExtendedJSON(object)
+	if err != nil {
+		return err
+	}
+
+	// Fields missing from JSON can not be set through JSON bodies either
+	document, ok := converted.(bson.M)
+	if !ok {
+		return errors.New("Expected a document")
+	}
+
+	target := reflectValue(doc)
+	removeNonJSONKeys(document, target.Type())
+
+	marshaled, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	// bson.Unmarshal resets the whole struct, so decode into a new one and
+	// copy over the fields of the body
+	decoded := reflect.New(target.Type())
+
+	err = bson.Unmarshal(marshaled, decoded.Interface())
+	if err != nil {
+		return err
+	}
+
+	for key := range document {
+		if field, found := resolveField(key, doc); found && field.BsonKey == key {
+			target.FieldByIndex(field.Index).Set(decoded.Elem().FieldByIndex(field.Index))
+		}
+	}
+
+	return nil
+}
+
+// Convert the type wrappers of extended JSON ($oid, $date, ...) to bson
+// values
+func fromExtendedJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			converted[i], err = fromExtendedJSON(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for key, wrapped := range v {
+				if strings.HasPrefix(key, "$") {
+					return fromExtendedJSONWrapper(key, wrapped)
+				}
+			}
+		}
+
+		converted := bson.M{}
+		for key, item := range v {
+			var err error
+			converted[key], err = fromExtendedJSON(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	}
+
+	return value, nil
+}
+
+func fromExtendedJSONWrapper(key string, wrapped interface{}) (interface{}, error) {
+	invalid := fmt.Errorf("Invalid %s value", key)
+
+	switch key {
+	case "$oid":
+		hex, _ := wrapped.(string)
+		if !bson.IsObjectIdHex(hex) {
+			return nil, invalid
+		}
+		return bson.ObjectIdHex(hex), nil
+	case "$date":
+		switch date := wrapped.(type) {
+		case string:
+			t, err := time.Parse(time.RFC3339, date)
+			if err != nil {
+				return nil, invalid
+			}
+			return t, nil
+		case float64:
+			return time.Unix(0, int64(date)*int64(time.Millisecond)), nil
+		case map[string]interface{}:
+			millis, err := fromExtendedJSON(date)
+			if n, ok := millis.(int64); ok && err == nil {
+				return time.Unix(0, n*int64(time.Millisecond)), nil
+			}
+		}
+		return nil, invalid
+	case "$numberLong", "$numberInt":
+		s, _ := wrapped.(string)
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		return n, nil
+	case "$numberDouble":
+		s, _ := wrapped.(string)
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		return f, nil
+	case "$binary":
+		binary, _ := wrapped.(map[string]interface{})
+		encoded, _ := binary["base64"].(string)
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, invalid
+		}
+		return data, nil
+	case "$regularExpression":
+		regex, _ := wrapped.(map[string]interface{})
+		pattern, ok := regex["pattern"].(string)
+		options, _ := regex["options"].(string)
+		if !ok {
+			return nil, invalid
+		}
+		return bson.RegEx{Pattern: pattern, Options: options}, nil
+	}
+
+	// Not a type wrapper, e.g. an operator stored as a key
+	converted, err := fromExtendedJSON(wrapped)
+	return bson.M{key: converted}, err
+}
@@ -0,0 +1,183 @@
+package bongoz
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vmihailenco/msgpack"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecoders(t *testing.T) {
+	Convey("Request body decoding", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+
+		router := endpoint.GetRouter()
+
+		send := func(method string, url string, contentType string, body io.Reader) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, body)
+			if len(contentType) > 0 {
+				req.Header.Set("Content-Type", contentType)
+			}
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		stored := func(w *httptest.ResponseRecorder) *Page {
+			response := &singleResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+
+			id, _ := response.Data["_id"].(string)
+			So(bson.IsObjectIdHex(id), ShouldEqual, true)
+
+			page := &Page{}
+			So(store.FindById(bson.ObjectIdHex(id), page), ShouldEqual, nil)
+			return page
+		}
+
+		Convey("urlencoded forms", func() {
+			w := send("POST", "/api/pages", FormContentType, strings.NewReader("content=foo&intValue=5&arrValue=a&arrValue=b&unknown=1&dateValue=2015-04-08T00:00:00Z"))
+
+			So(w.Code, ShouldEqual, 201)
+
+			page := stored(w)
+			So(page.Content, ShouldEqual, "foo")
+			So(page.IntValue, ShouldEqual, 5)
+			So(page.ArrValue, ShouldResemble, []string{"a", "b"})
+			So(page.DateValue.Equal(time.Date(2015, 4, 8, 0, 0, 0, 0, time.UTC)), ShouldEqual, true)
+		})
+		Convey("invalid form values", func() {
+			w := send("POST", "/api/pages", FormContentType, strings.NewReader("intValue=abc"))
+
+			So(w.Code, ShouldEqual, 400)
+			So(w.Body.String(), ShouldContainSubstring, ErrorCodeInvalidBody)
+		})
+		Convey("multipart forms", func() {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			writer.WriteField("content", "bar")
+			writer.WriteField("intValue", "7")
+			writer.Close()
+
+			w := send("POST", "/api/pages", writer.FormDataContentType(), body)
+
+			So(w.Code, ShouldEqual, 201)
+
+			page := stored(w)
+			So(page.Content, ShouldEqual, "bar")
+			So(page.IntValue, ShouldEqual, 7)
+		})
+		Convey("MessagePack", func() {
+			body, err := msgpack.Marshal(map[string]interface{}{"content": "baz", "intValue": -300, "arrValue": []string{"x"}})
+			So(err, ShouldEqual, nil)
+
+			w := send("POST", "/api/pages", MessagePackContentType, bytes.NewReader(body))
+
+			So(w.Code, ShouldEqual, 201)
+
+			page := stored(w)
+			So(page.Content, ShouldEqual, "baz")
+			So(page.IntValue, ShouldEqual, -300)
+			So(page.ArrValue, ShouldResemble, []string{"x"})
+		})
+		Convey("MessagePack integers above 2^53", func() {
+			body, err := msgpack.Marshal(map[string]interface{}{"intValue": int64(1<<53 + 1)})
+			So(err, ShouldEqual, nil)
+
+			w := send("POST", "/api/pages", MessagePackContentType, bytes.NewReader(body))
+
+			So(w.Code, ShouldEqual, 201)
+			So(stored(w).IntValue, ShouldEqual, 1<<53+1)
+		})
+		Convey("invalid MessagePack", func() {
+			w := send("POST", "/api/pages", MessagePackContentType, bytes.NewReader([]byte{0x82, 0xa1, 'a'}))
+
+			So(w.Code, ShouldEqual, 400)
+		})
+		Convey("extended JSON", func() {
+			idValue := bson.NewObjectId()
+
+			w := send("POST", "/api/pages", ExtendedJSONContentType, strings.NewReader(`{"content":"qux","intValue":{"$numberLong":"9"},"idValue":{"$oid":"`+idValue.Hex()+`"},"dateValue":{"$date":"2015-04-08T00:00:00.000Z"}}`))
+
+			So(w.Code, ShouldEqual, 201)
+
+			page := stored(w)
+			So(page.Content, ShouldEqual, "qux")
+			So(page.IntValue, ShouldEqual, 9)
+			So(page.IdValue, ShouldEqual, idValue)
+			So(page.DateValue.Equal(time.Date(2015, 4, 8, 0, 0, 0, 0, time.UTC)), ShouldEqual, true)
+		})
+		Convey("extended JSON without fields left out of JSON", func() {
+			endpoint.Factory = TokenFactory
+
+			w := send("POST", "/api/pages", ExtendedJSONContentType, strings.NewReader(`{"content":"qux","token":"secret"}`))
+
+			So(w.Code, ShouldEqual, 201)
+
+			page := stored(w)
+			So(page.Content, ShouldEqual, "qux")
+
+			model := &tokenModel{}
+			So(store.FindById(page.Id, model), ShouldEqual, nil)
+			So(model.Token, ShouldEqual, "")
+		})
+		Convey("updates keep fields missing from the body", func() {
+			page := &Page{Content: "foo", IntValue: 5}
+			So(store.Save(page), ShouldEqual, nil)
+
+			url := "/api/pages/" + page.Id.Hex()
+
+			w := send("PUT", url, FormContentType, strings.NewReader("intValue=6"))
+			So(w.Code, ShouldEqual, 200)
+
+			w = send("PUT", url, ExtendedJSONContentType, strings.NewReader(`{"arrValue":["a"]}`))
+			So(w.Code, ShouldEqual, 200)
+
+			updated := stored(w)
+			So(updated.Content, ShouldEqual, "foo")
+			So(updated.IntValue, ShouldEqual, 6)
+			So(updated.ArrValue, ShouldResemble, []string{"a"})
+		})
+		Convey("unsupported content types", func() {
+			w := send("POST", "/api/pages", "text/plain", strings.NewReader("foo"))
+
+			So(w.Code, ShouldEqual, 415)
+			So(w.Body.String(), ShouldContainSubstring, ErrorCodeUnsupportedMediaType)
+		})
+		Convey("body size limit", func() {
+			endpoint.MaxBodySize = 16
+
+			Convey("by Content-Length", func() {
+				w := send("POST", "/api/pages", "", strings.NewReader(`{"content":"a long content"}`))
+
+				So(w.Code, ShouldEqual, 413)
+				So(w.Body.String(), ShouldContainSubstring, ErrorCodeBodyTooLarge)
+			})
+			Convey("while reading", func() {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "/api/pages", strings.NewReader(`{"content":"a long content"}`))
+				req.ContentLength = -1
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 413)
+			})
+			Convey("small bodies", func() {
+				w := send("POST", "/api/pages", "", strings.NewReader(`{"content":"a"}`))
+
+				So(w.Code, ShouldEqual, 201)
+			})
+		})
+	})
+}
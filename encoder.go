@@ -0,0 +1,572 @@
+package bongoz
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NDJSONContentType       = "application/x-ndjson"
+	CSVContentType          = "text/csv"
+	ExtendedJSONContentType = "application/x-extended-json"
+	MessagePackContentType  = "application/msgpack"
+)
+
+// Encodes read responses in one format. model is an empty document of the
+// endpoint's model, e.g. to derive CSV columns from. Documents in the
+// responses are rendered already (see renderDocument), so they are either
+// models or maps of JSON keys if fields were selected or hidden.
+type Encoder interface {
+	ContentType() string
+	EncodeList(w io.Writer, model interface{}, response *HTTPListResponse) error
+	EncodeOne(w io.Writer, model interface{}, response *HTTPSingleResponse) error
+}
+
+// The encoders of a new endpoint, by the name clients pass as _format
+func DefaultEncoders() map[string]Encoder {
+	return map[string]Encoder{
+		"json":    &JSONEncoder{},
+		"ndjson":  &NDJSONEncoder{},
+		"csv":     &CSVEncoder{},
+		"extjson": &ExtendedJSONEncoder{},
+		"msgpack": &MessagePackEncoder{},
+	}
+}
+
+func (e *Endpoint) encoders() map[string]Encoder {
+	if e.Encoders == nil {
+		e.Encoders = DefaultEncoders()
+	}
+
+	return e.Encoders
+}
+
+// Pick the encoder for a read response, by the _format parameter or the
+// Accept header. JSON is used if neither is given. Writes an error and
+// returns false if no encoder fits.
+func (e *Endpoint) negotiateEncoder(w http.ResponseWriter, req *http.Request) (Encoder, bool) {
+	w.Header().Add("Vary", "Accept")
+
+	encoders := e.encoders()
+
+	if format := req.URL.Query().Get("_format"); len(format) > 0 {
+		encoder, ok := encoders[format]
+		if !ok {
+			e.writeErrors(w, req, []*Error{NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "_format", "Unknown format "+format)})
+		}
+		return encoder, ok
+	}
+
+	accept := req.Header.Get("Accept")
+	if len(accept) == 0 {
+		return e.defaultEncoder(), true
+	}
+
+	// JSON first, so it wins wildcards
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		if name != "json" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := encoders["json"]; ok {
+		names = append([]string{"json"}, names...)
+	}
+
+	for _, mediaType := range parseAccept(accept) {
+		if mediaType == "*/*" || mediaType == ProblemContentType {
+			return e.defaultEncoder(), true
+		}
+
+		for _, name := range names {
+			// JSON is also accepted as the envelope's media type
+			for _, contentType := range []string{encoders[name].ContentType(), e.contentType(encoders[name])} {
+				contentType, _, _ = mime.ParseMediaType(contentType)
+				if contentType == mediaType || strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaType, "*")) {
+					return encoders[name], true
+				}
+			}
+		}
+	}
+
+	available := make([]string, len(names))
+	for i, name := range names {
+		available[i] = e.contentType(encoders[name])
+	}
+
+	e.writeErrors(w, req, []*Error{NewError(http.StatusNotAcceptable, ErrorCodeNotAcceptable, "None of the accepted types can be returned, use one of "+strings.Join(available, ", "))})
+	return nil, false
+}
+
+func (e *Endpoint) defaultEncoder() Encoder {
+	if encoder, ok := e.encoders()["json"]; ok {
+		return encoder
+	}
+
+	return &JSONEncoder{}
+}
+
+// Media types of an Accept header, most preferred first. Types with q=0 are
+// left out.
+func parseAccept(accept string) []string {
+	type acceptedType struct {
+		mediaType string
+		q         float64
+	}
+
+	accepted := []acceptedType{}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qParam, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qParam, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		if q > 0 {
+			accepted = append(accepted, acceptedType{mediaType, q})
+		}
+	}
+
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].q > accepted[j].q
+	})
+
+	mediaTypes := make([]string, len(accepted))
+	for i, a := range accepted {
+		mediaTypes[i] = a.mediaType
+	}
+
+	return mediaTypes
+}
+
+func (e *Endpoint) writeList(w http.ResponseWriter, req *http.Request, encoder Encoder, response *HTTPListResponse) error {
+	links := listLinks(req, response.Pagination)
+	setLinkHeader(w, links)
+
+	links["self"] = req.URL.RequestURI()
+	response.Links = halLinks(links)
+
+	w.Header().Set("Content-Type", e.contentType(encoder))
+
+	if envelopeEncoder, ok := encoder.(EnvelopeEncoder); ok {
+		value, err := e.envelope().RenderList(e, req, response)
+		if err != nil {
+			return err
+		}
+
+		return envelopeEncoder.EncodeValue(w, value)
+	}
+
+	return encoder.EncodeList(w, e.Factory(), response)
+}
+
+func (e *Endpoint) writeOne(w http.ResponseWriter, req *http.Request, encoder Encoder, status int, response *HTTPSingleResponse) error {
+	w.Header().Set("Content-Type", e.contentType(encoder))
+
+	if envelopeEncoder, ok := encoder.(EnvelopeEncoder); ok {
+		value, err := e.envelope().RenderOne(e, req, response)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(status)
+		return envelopeEncoder.EncodeValue(w, value)
+	}
+
+	w.WriteHeader(status)
+	return encoder.EncodeOne(w, e.Factory(), response)
+}
+
+// Convert a document to the values its JSON encoding decodes to. Numbers
+// are json.Numbers, so integers above 2^53 keep their precision.
+func toJSONValue(doc interface{}) (interface{}, error) {
+	marshaled, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(marshaled))
+	decoder.UseNumber()
+
+	var value interface{}
+	err = decoder.Decode(&value)
+
+	return value, err
+}
+
+// Replace the json.Numbers of a value from toJSONValue, in place where
+// possible
+func convertJSONNumbers(value interface{}, convert func(json.Number) (interface{}, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return convert(v)
+	case []interface{}:
+		for i, item := range v {
+			converted, err := convertJSONNumbers(item, convert)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			converted, err := convertJSONNumbers(item, convert)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+	}
+
+	return value, nil
+}
+
+// The envelope every other format is based on
+type JSONEncoder struct{}
+
+func (j *JSONEncoder) ContentType() string {
+	return "application/json"
+}
+
+func (j *JSONEncoder) EncodeList(w io.Writer, model interface{}, response *HTTPListResponse) error {
+	return json.NewEncoder(w).Encode(response)
+}
+
+func (j *JSONEncoder) EncodeOne(w io.Writer, model interface{}, response *HTTPSingleResponse) error {
+	return json.NewEncoder(w).Encode(response)
+}
+
+func (j *JSONEncoder) EncodeValue(w io.Writer, value interface{}) error {
+	return json.NewEncoder(w).Encode(value)
+}
+
+// Newline delimited JSON, one document per line. Pagination is left out.
+type NDJSONEncoder struct{}
+
+func (n *NDJSONEncoder) ContentType() string {
+	return NDJSONContentType
+}
+
+func (n *NDJSONEncoder) EncodeList(w io.Writer, model interface{}, response *HTTPListResponse) error {
+	encoder := json.NewEncoder(w)
+
+	for _, doc := range response.Data {
+		err := encoder.Encode(doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *NDJSONEncoder) EncodeOne(w io.Writer, model interface{}, response *HTTPSingleResponse) error {
+	return json.NewEncoder(w).Encode(response.Data)
+}
+
+// A CSV column and the JSON key path of its values, e.g. location.type
+type CSVColumn struct {
+	Header string
+	Key    string
+}
+
+// CSV with a header row. Pagination is left out. Columns default to the
+// fields of the model, with nested structs flattened into keys like
+// location.type. Fields can be renamed with a `csv:"Header"` tag or left out
+// with `csv:"-"`. Arrays and documents are written as JSON.
+type CSVEncoder struct {
+	// Used instead of the model's fields if set
+	Columns []CSVColumn
+}
+
+func (c *CSVEncoder) ContentType() string {
+	return CSVContentType + "; charset=utf-8"
+}
+
+func (c *CSVEncoder) EncodeList(w io.Writer, model interface{}, response *HTTPListResponse) error {
+	return c.encode(w, model, response.Data)
+}
+
+func (c *CSVEncoder) EncodeOne(w io.Writer, model interface{}, response *HTTPSingleResponse) error {
+	return c.encode(w, model, []interface{}{response.Data})
+}
+
+func (c *CSVEncoder) encode(w io.Writer, model interface{}, docs []interface{}) error {
+	rows := make([]map[string]interface{}, len(docs))
+	trimmed := false
+
+	for i, doc := range docs {
+		var err error
+		var docTrimmed bool
+
+		rows[i], docTrimmed, err = csvRow(doc)
+		if err != nil {
+			return err
+		}
+
+		trimmed = trimmed || docTrimmed
+	}
+
+	stream := &csvListStream{encoder: c, model: model, writer: csv.NewWriter(w)}
+
+	err := stream.writeHeader(rows, trimmed)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		err = stream.writeRow(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return stream.Close(nil)
+}
+
+// The flattened JSON values of a document, and whether it was trimmed to
+// selected fields
+func csvRow(doc interface{}) (map[string]interface{}, bool, error) {
+	value, err := toJSONValue(doc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	row := map[string]interface{}{}
+	if object, ok := value.(map[string]interface{}); ok {
+		flattenJSON(row, "", object)
+	}
+
+	return row, reflect.ValueOf(doc).Kind() == reflect.Map, nil
+}
+
+func (c *CSVEncoder) columns(model interface{}, rows []map[string]interface{}, trimmed bool) []CSVColumn {
+	if c.Columns != nil {
+		return c.Columns
+	}
+
+	columns := csvColumnsOfType(reflectValue(model).Type(), "", "")
+	if !trimmed {
+		return columns
+	}
+
+	// Keep the columns of selected fields only
+	kept := []CSVColumn{}
+	for _, column := range columns {
+		for _, row := range rows {
+			if _, ok := row[column.Key]; ok {
+				kept = append(kept, column)
+				break
+			}
+		}
+	}
+
+	return kept
+}
+
+func csvColumnsOfType(typ reflect.Type, keyPrefix string, headerPrefix string) []CSVColumn {
+	columns := []CSVColumn{}
+
+	for _, field := range listFieldsOfType(typ, []int{}) {
+		structField := typ.FieldByIndex(field.Index)
+
+		header := structField.Tag.Get("csv")
+		if header == "-" {
+			continue
+		} else if len(header) == 0 {
+			header = field.JSONKey
+		}
+
+		fieldType := indirectType(structField.Type)
+		if fieldType.Kind() == reflect.Struct && fieldType != timeType {
+			columns = append(columns, csvColumnsOfType(fieldType, keyPrefix+field.JSONKey+".", headerPrefix+header+".")...)
+			continue
+		}
+
+		columns = append(columns, CSVColumn{headerPrefix + header, keyPrefix + field.JSONKey})
+	}
+
+	return columns
+}
+
+// Copy the values of nested objects into row under dotted keys
+func flattenJSON(row map[string]interface{}, prefix string, object map[string]interface{}) {
+	for key, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenJSON(row, prefix+key+".", nested)
+			continue
+		}
+
+		row[prefix+key] = value
+	}
+}
+
+func csvCell(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+
+	marshaled, err := json.Marshal(value)
+	return string(marshaled), err
+}
+
+// MongoDB extended JSON (relaxed mode) of the bson encoding of documents,
+// so object IDs and dates keep their types. Documents trimmed by field
+// selection or hidden fields only carry their JSON values.
+type ExtendedJSONEncoder struct{}
+
+func (x *ExtendedJSONEncoder) ContentType() string {
+	return ExtendedJSONContentType
+}
+
+func (x *ExtendedJSONEncoder) EncodeList(w io.Writer, model interface{}, response *HTTPListResponse) error {
+	data := make([]interface{}, len(response.Data))
+
+	for i, doc := range response.Data {
+		var err error
+		data[i], err = toExtendedJSONDocument(doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return json.NewEncoder(w).Encode(&HTTPListResponse{Pagination: response.Pagination, Data: data, Links: response.Links})
+}
+
+func (x *ExtendedJSONEncoder) EncodeOne(w io.Writer, model interface{}, response *HTTPSingleResponse) error {
+	data, err := toExtendedJSONDocument(response.Data)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(&HTTPSingleResponse{Data: data, Links: response.Links})
+}
+
+func toExtendedJSONDocument(doc interface{}) (interface{}, error) {
+	encoded, err := encodeBson(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	removeNonJSONKeys(encoded, reflect.TypeOf(doc))
+
+	return toExtendedJSON(encoded), nil
+}
+
+// Remove the keys of fields missing from the JSON encoding (json:"-") from
+// the bson encoding of a value of type typ, so extended JSON shows the same
+// fields as JSON
+func removeNonJSONKeys(encoded bson.M, typ reflect.Type) {
+	typ = indirectType(typ)
+	if typ.Kind() != reflect.Struct {
+		return
+	}
+
+	fields := map[string]*resolvedField{}
+	for _, field := range listFieldsOfType(typ, []int{}) {
+		fields[field.BsonKey] = field
+	}
+
+	for key, value := range encoded {
+		field, ok := fields[key]
+		if !ok {
+			delete(encoded, key)
+			continue
+		}
+
+		fieldType := indirectType(typ.FieldByIndex(field.Index).Type)
+
+		switch v := value.(type) {
+		case bson.M:
+			removeNonJSONKeys(v, fieldType)
+		case []interface{}:
+			if fieldType.Kind() != reflect.Slice && fieldType.Kind() != reflect.Array {
+				continue
+			}
+			for _, item := range v {
+				if nested, ok := item.(bson.M); ok {
+					removeNonJSONKeys(nested, fieldType.Elem())
+				}
+			}
+		}
+	}
+}
+
+func toExtendedJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		converted := map[string]interface{}{}
+		for key, item := range v {
+			converted[key] = toExtendedJSON(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = toExtendedJSON(item)
+		}
+		return converted
+	case bson.ObjectId:
+		return map[string]interface{}{"$oid": v.Hex()}
+	case time.Time:
+		return map[string]interface{}{"$date": v.UTC().Format("2006-01-02T15:04:05.000Z")}
+	case []byte:
+		return map[string]interface{}{"$binary": map[string]interface{}{
+			"base64":  base64.StdEncoding.EncodeToString(v),
+			"subType": "00",
+		}}
+	case bson.RegEx:
+		return map[string]interface{}{"$regularExpression": map[string]interface{}{
+			"pattern": v.Pattern,
+			"options": v.Options,
+		}}
+	}
+
+	return value
+}
+
+// MessagePack of the same envelope and values as the JSON responses
+type MessagePackEncoder struct{}
+
+func (m *MessagePackEncoder) ContentType() string {
+	return MessagePackContentType
+}
+
+func (m *MessagePackEncoder) EncodeList(w io.Writer, model interface{}, response *HTTPListResponse) error {
+	return m.EncodeValue(w, response)
+}
+
+func (m *MessagePackEncoder) EncodeOne(w io.Writer, model interface{}, response *HTTPSingleResponse) error {
+	return m.EncodeValue(w, response)
+}
+
+func (m *MessagePackEncoder) EncodeValue(w io.Writer, response interface{}) error {
+	return encodeMessagePack(w, response)
+}
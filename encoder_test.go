@@ -0,0 +1,170 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vmihailenco/msgpack"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type csvAddress struct {
+	City string `json:"city"`
+}
+
+type csvModel struct {
+	Page    `bson:",inline"`
+	Address csvAddress `json:"address" csv:"Address"`
+	Secret  string     `json:"secret" csv:"-"`
+}
+
+func CSVFactory() bongo.Document {
+	return &csvModel{}
+}
+
+type tokenModel struct {
+	Page  `bson:",inline"`
+	Token string `json:"-"`
+}
+
+func TokenFactory() bongo.Document {
+	return &tokenModel{}
+}
+
+func TestEncoders(t *testing.T) {
+	Convey("Content negotiation", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+
+		page := &Page{Content: "foo, bar", IntValue: 5, ArrValue: []string{"a"}, DateValue: time.Date(2015, 4, 8, 0, 0, 0, 0, time.UTC)}
+		So(store.Save(page), ShouldEqual, nil)
+		So(store.Save(&Page{Content: "baz", IntValue: 7}), ShouldEqual, nil)
+
+		router := endpoint.GetRouter()
+
+		get := func(url string, accept string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", url, nil)
+			if len(accept) > 0 {
+				req.Header.Set("Accept", accept)
+			}
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("defaults to JSON", func() {
+			w := get("/api/pages", "text/html;q=0.9, */*;q=0.8")
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			So(w.Header().Get("Vary"), ShouldEqual, "Accept")
+		})
+		Convey("CSV by Accept header", func() {
+			w := get("/api/pages?_fields=content,intValue", "application/json;q=0.5, text/csv")
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "text/csv; charset=utf-8")
+			So(w.Body.String(), ShouldEqual, "_id,content,intValue\n"+
+				page.Id.Hex()+",\"foo, bar\",5\n"+
+				store.ids[1].Hex()+",baz,7\n")
+		})
+		Convey("CSV columns from the model", func() {
+			endpoint.Factory = CSVFactory
+			So(store.Save(&csvModel{Page: Page{Content: "qux"}, Address: csvAddress{"Berlin"}, Secret: "x"}), ShouldEqual, nil)
+
+			w := get("/api/pages/"+store.ids[2].Hex()+"?_format=csv", "")
+
+			So(w.Code, ShouldEqual, 200)
+			lines := strings.Split(w.Body.String(), "\n")
+			So(lines[0], ShouldEqual, "_id,_created,_modified,content,intValue,dateValue,arrValue,idArr,idValue,randomMap,Address.city")
+			So(lines[1], ShouldEndWith, ",qux,0,0001-01-01T00:00:00Z,[],[],,,Berlin")
+		})
+		Convey("NDJSON", func() {
+			w := get("/api/pages?_format=ndjson", "")
+
+			So(w.Code, ShouldEqual, 200)
+			lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			So(len(lines), ShouldEqual, 2)
+
+			doc := map[string]interface{}{}
+			So(json.Unmarshal([]byte(lines[1]), &doc), ShouldEqual, nil)
+			So(doc["content"], ShouldEqual, "baz")
+		})
+		Convey("extended JSON", func() {
+			w := get("/api/pages/"+page.Id.Hex(), ExtendedJSONContentType)
+
+			So(w.Code, ShouldEqual, 200)
+
+			response := &singleResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			So(response.Data["_id"], ShouldResemble, map[string]interface{}{"$oid": page.Id.Hex()})
+			So(response.Data["dateValue"], ShouldResemble, map[string]interface{}{"$date": "2015-04-08T00:00:00.000Z"})
+		})
+		Convey("extended JSON without fields left out of JSON", func() {
+			endpoint.Factory = TokenFactory
+			So(store.Save(&tokenModel{Page: Page{Content: "qux"}, Token: "secret"}), ShouldEqual, nil)
+
+			w := get("/api/pages/"+store.ids[2].Hex(), ExtendedJSONContentType)
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Body.String(), ShouldNotContainSubstring, "secret")
+
+			response := &singleResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			So(response.Data["content"], ShouldEqual, "qux")
+			So(response.Data, ShouldNotContainKey, "token")
+		})
+		Convey("MessagePack", func() {
+			w := get("/api/pages/"+page.Id.Hex()+"?_fields=intValue", "application/msgpack")
+
+			So(w.Code, ShouldEqual, 200)
+			// {"_links": {"self": {"href": "/api/pages/..."}}, "data": {"_id": "...", "intValue": 5}}
+			expected := []byte{0x82, 0xa6, '_', 'l', 'i', 'n', 'k', 's', 0x81, 0xa4, 's', 'e', 'l', 'f', 0x81, 0xa4, 'h', 'r', 'e', 'f', 0xd9, 35}
+			expected = append(expected, "/api/pages/"+page.Id.Hex()...)
+			expected = append(expected, 0xa4, 'd', 'a', 't', 'a', 0x82, 0xa3, '_', 'i', 'd', 0xb8)
+			expected = append(expected, page.Id.Hex()...)
+			expected = append(expected, 0xa8, 'i', 'n', 't', 'V', 'a', 'l', 'u', 'e', 0x05)
+			So(w.Body.Bytes(), ShouldResemble, expected)
+		})
+		Convey("MessagePack integers above 2^53", func() {
+			big := &Page{IntValue: 1<<53 + 1}
+			So(store.Save(big), ShouldEqual, nil)
+
+			w := get("/api/pages/"+big.Id.Hex()+"?_fields=intValue", "application/msgpack")
+
+			So(w.Code, ShouldEqual, 200)
+
+			response := &struct {
+				Data struct {
+					IntValue int64 `msgpack:"intValue"`
+				} `msgpack:"data"`
+			}{}
+			So(msgpack.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			So(response.Data.IntValue, ShouldEqual, 1<<53+1)
+		})
+		Convey("unknown formats", func() {
+			w := get("/api/pages", "image/png")
+
+			So(w.Code, ShouldEqual, 406)
+
+			w = get("/api/pages?_format=xml", "")
+
+			So(w.Code, ShouldEqual, 400)
+		})
+		Convey("custom encoders", func() {
+			endpoint.Encoders["text"] = &CSVEncoder{Columns: []CSVColumn{{"Text", "content"}}}
+
+			w := get("/api/pages?_format=text", "")
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Body.String(), ShouldEqual, "Text\n\"foo, bar\"\nbaz\n")
+		})
+	})
+}
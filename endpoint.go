@@ -1,17 +1,14 @@
 package bongoz
 
 import (
-	"errors"
-	"fmt"
+	"bufio"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 	"github.com/maxwellhealth/bongo"
 	"github.com/maxwellhealth/go-enhanced-json"
 	"gopkg.in/mgo.v2/bson"
-	"io"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -22,18 +19,27 @@ type SortConfig struct {
 
 type PaginationConfig struct {
 	PerPage int
-	Sort    []SortConfig
+	// Default sort, by Go name or bson key. Registering the routes panics
+	// on unknown and hidden fields.
+	Sort []SortConfig
+	Mode PaginationMode
 }
 
 type HTTPListResponse struct {
-	Pagination *bongo.PaginationInfo
+	// Either a *bongo.PaginationInfo or a *CursorPaginationInfo
+	Pagination interface{}
 	Data       []interface{}
+	// The page itself and its neighbours, see listLinks
+	Links map[string]*Link `json:"_links,omitempty" bson:"_links,omitempty"`
 }
 
 type HTTPSingleResponse struct {
-	Data interface{}
+	Data  interface{}
+	Links map[string]*Link `json:"_links,omitempty" bson:"_links,omitempty"`
 }
 
+// Body of an error response. Use Endpoint.writeError in handlers, which also
+// sets the status and supports RFC 7807 problem details.
 type HTTPErrorResponse struct {
 	Errors []error
 }
@@ -45,10 +51,7 @@ func NewErrorResponse(err error) *HTTPErrorResponse {
 
 func (e *HTTPErrorResponse) ToJSON() string {
 
-	errs := make([]string, len(e.Errors))
-	for i, err := range e.Errors {
-		errs[i] = err.Error()
-	}
+	errs := listToErrors(e.Errors, http.StatusInternalServerError, ErrorCodeInternal)
 	mp := map[string]interface{}{
 		"errors": errs,
 	}
@@ -58,6 +61,8 @@ func (e *HTTPErrorResponse) ToJSON() string {
 
 }
 
+// Deprecated: HTTPErrorResponse renders json.MultipleUnmarshalTypeError
+// entries the same way.
 type HTTPMultiErrorResponse struct {
 	Errors []string
 }
@@ -73,7 +78,14 @@ func NewMultiErrorResponse(errs []error) *HTTPMultiErrorResponse {
 }
 
 func (e *HTTPMultiErrorResponse) ToJSON() string {
-	marshaled, _ := json.Marshal(e)
+	errs := make([]*Error, len(e.Errors))
+	for i, message := range e.Errors {
+		errs[i] = NewError(http.StatusBadRequest, ErrorCodeInvalidType, message)
+	}
+
+	marshaled, _ := json.Marshal(map[string]interface{}{
+		"errors": errs,
+	})
 	return string(marshaled)
 }
 
@@ -84,7 +96,9 @@ type Middleware struct {
 	ReadList alice.Chain
 	Create   alice.Chain
 	Update   alice.Chain
+	Patch    alice.Chain
 	Delete   alice.Chain
+	Restore  alice.Chain
 }
 
 type Endpoint struct {
@@ -95,9 +109,115 @@ type Endpoint struct {
 	Pagination     *PaginationConfig
 	Factory        ModelFactory
 	Middleware     *Middleware
-
+	Hooks          *Hooks
+
+	// Storage backend. Defaults to a BongoStore for Connection and
+	// CollectionName, see MemoryStore for tests.
+	Store Store
+
+	// Fields clients may sort on with _sort. Any field is allowed if empty.
+	SortableFields []string
+
+	// Fields returned when the request has no _fields parameter. The whole
+	// document is returned if empty.
+	DefaultFields []string
+	// Fields clients may select with _fields. Any field is allowed if empty.
+	AllowedFields []string
+
+	// Hidden, read-only and create-only fields, keyed by Go or bson name.
+	// Changes to protected fields are reverted, or rejected with a 400 if
+	// RejectProtectedFields is set.
+	FieldPolicies         map[string]FieldPolicy
+	RejectProtectedFields bool
+
+	// Field (Go or bson name) used to build ETags, e.g. a revision counter.
+	// Defaults to bongo.TimeTracker's Modified. Documents without a value
+	// for it get an ETag hashed from their encoded content. Writes with
+	// If-Match only happen if the stored document still has the version,
+	// otherwise they fail with a 412. They still run the model's bongo
+	// save and delete hooks.
+	VersionField string
+
+	// Fields (Go or bson name) clients may filter on with ?field[op]=value,
+	// along with the operators allowed for each. Values are converted to the
+	// field's type. The same fields can be combined in groups with
+	// ?or=(field:op:value,...), and=(...) and not=(...). Registering the
+	// routes panics on unknown fields.
+	Filters map[string]FilterOp
+
+	// Fields (Go or bson name) covered by the text index that _search
+	// queries with $text. Search is disabled if empty. EnsureTextIndex
+	// creates the index when the routes are registered, with SearchLanguage
+	// as its default language.
+	SearchableFields []string
+	EnsureTextIndex  bool
+	SearchLanguage   string
+	// Field (Go or bson name) of the model that receives the relevance score
+	// of searches. If set, paginated searches are sorted by relevance
+	// unless the request passes _sort.
+	TextScoreField string
+
+	// Field (Go or bson name) of the model that receives the distance in
+	// meters of each document for near filters (see FilterNear). Registering
+	// the routes panics if Filters allow near without it.
+	DistanceField string
+
+	// Formats of read responses by _format name, chosen by the _format
+	// parameter or the Accept header. See DefaultEncoders.
+	Encoders map[string]Encoder
+
+	// Shape of JSON and MessagePack responses, DefaultEnvelope if nil. See
+	// BareEnvelope and JSONAPIEnvelope.
+	Envelope Envelope
+
+	// Write list responses while their documents are read instead of
+	// buffering whole pages, for encoders that are StreamEncoders. The
+	// pagination block follows the data then. Requests passing _export=true
+	// get every matching document in one streamed response if CanExport
+	// returns true for them.
+	StreamLists bool
+	CanExport   func(*http.Request) bool
+
+	// Decoders of create and update bodies by media type. See
+	// DefaultDecoders.
+	Decoders map[string]Decoder
+	// Bodies of write requests larger than this many bytes are answered
+	// with a 413 if set
+	MaxBodySize int64
+
+	// Enables the _count, _aggregate and _facets routes
+	Aggregation *AggregationConfig
+
+	// Accept a JSON query in ?_query, validated against FullQuery
 	AllowFullQuery bool
+	FullQuery      *FullQueryConfig
 	DisableWrites  bool
+
+	// Render errors as RFC 7807 problem details. Clients may also ask for
+	// them with Accept: application/problem+json.
+	ProblemDetails bool
+
+	// Filter ANDed into every lookup, e.g. to isolate tenants based on
+	// details set by authentication middleware. Documents outside of it
+	// can not be read, updated or deleted, and created or updated
+	// documents must match it after the before hooks ran, or the request
+	// is answered with a 403. If it returns an error the request is
+	// answered with a 403 as well.
+	Scope func(*http.Request) (bson.M, error)
+
+	// Stamp DeletedField (a bson key, "deletedAt" by default) instead of
+	// deleting documents, and hide stamped documents from every handler.
+	// Requests may pass _includeDeleted=true to see them if
+	// CanIncludeDeleted returns true for the request. The stamp is
+	// read-only for create and update bodies.
+	SoftDelete        bool
+	DeletedField      string
+	CanIncludeDeleted func(*http.Request) bool
+
+	// Accept arrays on POST, PUT, PATCH and DELETE to the collection URI.
+	// MaxBulkItems limits the size of a batch if set.
+	AllowBulk    bool
+	MaxBulkItems int
 }
 
 func NewEndpoint(uri string, connection *bongo.Connection, collectionName string) *Endpoint {
@@ -106,15 +226,21 @@ func NewEndpoint(uri string, connection *bongo.Connection, collectionName string
 	endpoint.Connection = connection
 	endpoint.CollectionName = collectionName
 	endpoint.Pagination = &PaginationConfig{}
+	endpoint.FullQuery = &FullQueryConfig{}
 	endpoint.Middleware = new(Middleware)
+	endpoint.Hooks = new(Hooks)
+	endpoint.VersionField = "Modified"
+	endpoint.DeletedField = "deletedAt"
+	endpoint.Encoders = DefaultEncoders()
+	endpoint.Decoders = DefaultDecoders()
 	return endpoint
 }
 
 func methodsFromMethod(method string) []string {
 	if method == "*" || method == "all" {
-		return []string{"ReadOne", "ReadList", "Create", "Update", "Delete"}
+		return []string{"ReadOne", "ReadList", "Create", "Update", "Patch", "Delete", "Restore"}
 	} else if method == "write" {
-		return []string{"Create", "Update", "Delete"}
+		return []string{"Create", "Update", "Patch", "Delete", "Restore"}
 	} else if method == "read" {
 		return []string{"ReadOne", "ReadList"}
 	} else {
@@ -134,8 +260,12 @@ func (e *Endpoint) SetMiddleware(method string, chain alice.Chain) *Endpoint {
 			e.Middleware.Create = chain
 		case "Update":
 			e.Middleware.Update = chain
+		case "Patch":
+			e.Middleware.Patch = chain
 		case "Delete":
 			e.Middleware.Delete = chain
+		case "Restore":
+			e.Middleware.Restore = chain
 
 		}
 	}
@@ -153,14 +283,35 @@ func (e *Endpoint) GetRouter() *mux.Router {
 }
 
 func (e *Endpoint) registerRoutes(r *mux.Router) {
+	e.checkPaginationSort()
+	e.checkFilters()
+	e.checkFieldPolicies()
+	e.checkSearchFields()
+	e.ensureTextIndex()
+
 	r.Handle(e.Uri, e.Middleware.ReadList.ThenFunc(e.HandleReadList)).Methods("GET")
+
+	// Before the document routes, so the names are not taken for IDs
+	e.registerAggregationRoutes(r)
+
 	r.Handle(e.Uri+"/{id}", e.Middleware.ReadOne.ThenFunc(e.HandleReadOne)).Methods("GET")
 
 	if !e.DisableWrites {
 		r.Handle(e.Uri, e.Middleware.Create.ThenFunc(e.HandleCreate)).Methods("POST")
 
+		if e.AllowBulk {
+			r.Handle(e.Uri, e.Middleware.Update.ThenFunc(e.HandleBulkUpdate)).Methods("PUT")
+			r.Handle(e.Uri, e.Middleware.Patch.ThenFunc(e.HandleBulkUpdate)).Methods("PATCH")
+			r.Handle(e.Uri, e.Middleware.Delete.ThenFunc(e.HandleBulkDelete)).Methods("DELETE")
+		}
+
 		r.Handle(e.Uri+"/{id}", e.Middleware.Update.ThenFunc(e.HandleUpdate)).Methods("PUT")
+		r.Handle(e.Uri+"/{id}", e.Middleware.Patch.ThenFunc(e.HandlePatch)).Methods("PATCH")
 		r.Handle(e.Uri+"/{id}", e.Middleware.Delete.ThenFunc(e.HandleDelete)).Methods("DELETE")
+
+		if e.SoftDelete {
+			r.Handle(e.Uri+"/{id}/restore", e.Middleware.Restore.ThenFunc(e.HandleRestore)).Methods("POST")
+		}
 	}
 
 }
@@ -170,64 +321,143 @@ func (e *Endpoint) Register(r *mux.Router) {
 	e.registerRoutes(r)
 }
 
-func handleError(w http.ResponseWriter) {
-	var err error
-	if r := recover(); r != nil {
-		// panic(r)
-		// return
-		if e, ok := r.(error); ok {
-			if e.Error() == "EOF" {
-				err = errors.New("Lost database connection unexpectedly")
-			} else {
-				err = e
-			}
-
-		} else if e, ok := r.(string); ok {
-			err = errors.New(e)
-		} else {
-			err = errors.New(fmt.Sprint(r))
+// Get the page size for a list request, allowing override with _perPage
+func (e *Endpoint) getPerPage(req *http.Request) int {
+	// Default pagination is 50
+	if e.Pagination.PerPage == 0 {
+		e.Pagination.PerPage = 50
+	}
+
+	perPage := e.Pagination.PerPage
+
+	perPageParam := req.URL.Query().Get("_perPage")
+
+	if len(perPageParam) > 0 {
+		converted, err := strconv.Atoi(perPageParam)
+		// Hard limit to 500 so people can break it
+		if err == nil && converted > 0 && converted < 500 {
+			perPage = converted
 		}
+	}
 
-		http.Error(w, NewErrorResponse(err).ToJSON(), 500)
+	return perPage
+}
 
+// Build the pagination block for a page of a result set with total records.
+// Pages past the end are clamped to the last page.
+func newPaginationInfo(total int, perPage int, page int) *bongo.PaginationInfo {
+	info := &bongo.PaginationInfo{}
+
+	info.TotalRecords = total
+	info.PerPage = perPage
+	info.TotalPages = (total + perPage - 1) / perPage
+
+	if page > info.TotalPages && info.TotalPages > 0 {
+		page = info.TotalPages
+	}
+	info.Current = page
+
+	return info
+}
+
+// Fill in the pagination block once the records of a page are read. Lists
+// with limit and skip are treated as a single page of their records.
+func finishPaginationInfo(info *bongo.PaginationInfo, paginate bool, records int) {
+	info.RecordsOnPage = records
+
+	if !paginate {
+		info.TotalRecords = records
+		info.PerPage = records
+		if records == 0 {
+			info.TotalPages = 0
+		}
 	}
 }
 
 // Handle a "ReadList" request, including parsing pagination, query string, etc
 func (e *Endpoint) HandleReadList(w http.ResponseWriter, req *http.Request) {
-	defer handleError(w)
+	defer e.handleError(w, req)
 	w.Header().Set("Content-Type", "application/json")
 	var err error
-	var code int
+
+	encoder, ok := e.negotiateEncoder(w, req)
+	if !ok {
+		return
+	}
 
 	// Get the query
 	query, err := e.getQuery(req)
 
 	if err != nil {
-		w.WriteHeader(code)
-		io.WriteString(w, NewErrorResponse(err).ToJSON())
+		e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
+		return
+	}
+
+	// Near queries run as $geoNear, see addGeoNearToOptions
+	near, query := splitGeoNear(query)
 
+	if near != nil && len(e.getSearch(req)) > 0 {
+		e.writeErrors(w, req, []*Error{NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "_search", "Search can not be combined with near")})
 		return
 	}
 
-	connection := e.Connection
+	export, ok := e.getExport(w, req, encoder)
+	if !ok {
+		return
+	}
+
+	if !export && e.usesCursorPagination(req) {
+		if near != nil {
+			e.writeErrors(w, req, []*Error{NewError(http.StatusBadRequest, ErrorCodeInvalidQuery, "Near queries can not be used with cursor pagination")})
+			return
+		}
 
-	results := connection.Collection(e.CollectionName).Find(query)
+		e.handleReadListWithCursor(w, req, query, encoder)
+		return
+	}
 
-	defer results.Free()
+	sort, err := e.getSort(req)
 
-	// Default pagination is 50
-	if e.Pagination.PerPage == 0 {
-		e.Pagination.PerPage = 50
+	if err != nil {
+		e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
+		return
 	}
 
-	perPage := e.Pagination.PerPage
+	selection, err := e.getFieldSelection(req)
+
+	if err != nil {
+		e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
+		return
+	}
+
+	store := e.getStore()
+
+	// Sort before paginating so pages are stable
+	options := &FindOptions{
+		Sort: sortConfigToStrings(sort),
+	}
+
+	if selection != nil {
+		options.Projection = selection.Projection
+	}
+
+	e.addTextScoreToOptions(req, options, selection)
+
+	countQuery := query
+	if near != nil {
+		if nearErr := e.addGeoNearToOptions(req, near, options, selection); nearErr != nil {
+			e.writeErrors(w, req, []*Error{nearErr})
+			return
+		}
+		countQuery = andFilters(query, near.countFilter())
+	}
+
+	perPage := e.getPerPage(req)
 	limit := 0
 	skip := 0
 	page := 1
 
 	// Allow override with query vars
-	perPageParam := req.URL.Query().Get("_perPage")
 	pageParam := req.URL.Query().Get("_page")
 
 	// Allow support for limit and skip with no pagination
@@ -254,23 +484,6 @@ func (e *Endpoint) HandleReadList(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	var pageInfo *bongo.PaginationInfo
-
-	if limit > 0 {
-		results.Query.Limit(limit).Skip(skip)
-		pageInfo = &bongo.PaginationInfo{}
-		pageInfo.TotalPages = 1
-		pageInfo.Current = 1
-	}
-
-	if len(perPageParam) > 0 {
-		converted, err := strconv.Atoi(perPageParam)
-		// Hard limit to 500 so people can break it
-		if err == nil && converted > 0 && converted < 500 {
-			perPage = converted
-		}
-	}
-
 	if len(pageParam) > 0 {
 		converted, err := strconv.Atoi(pageParam)
 
@@ -279,94 +492,149 @@ func (e *Endpoint) HandleReadList(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	var total int
+	// Exports are never paginated or limited
+	if export {
+		paginate = false
+		limit = 0
+		skip = 0
+	}
+
+	var pageInfo *bongo.PaginationInfo
+
 	if paginate {
-		pageInfo, err = results.Paginate(perPage, page)
+		count, err := store.Count(countQuery)
 		if err != nil {
 			panic(err)
 		}
 
-		total = pageInfo.RecordsOnPage
+		pageInfo = newPaginationInfo(count, perPage, page)
 
+		options.Skip = (pageInfo.Current - 1) * perPage
+		options.Limit = perPage
 	} else {
-		total, err = results.Query.Count()
-		if err != nil {
-			panic(err)
-		}
+		options.Skip = skip
+		options.Limit = limit
 
-		pageInfo.RecordsOnPage = total
-		pageInfo.TotalRecords = total
-		pageInfo.PerPage = total
-		if total == 0 {
-			pageInfo.TotalPages = 0
-		}
+		pageInfo = &bongo.PaginationInfo{}
+		pageInfo.TotalPages = 1
+		pageInfo.Current = 1
+	}
+
+	results, err := store.Find(query, options)
+	if err != nil {
+		panic(err)
 	}
 
-	sortParam := req.URL.Query().Get("_sort")
-	if len(sortParam) > 0 {
-		sortFields := strings.Split(sortParam, ",")
-		results.Query.Sort(sortFields...)
+	defer results.Close()
+
+	if streamEncoder, ok := e.streamEncoder(encoder); ok && (e.StreamLists || export) {
+		e.streamList(w, req, streamEncoder, results, selection, pageInfo, paginate)
+		return
 	}
 
-	response := make([]interface{}, total)
-	for i := 0; i < total; i++ {
+	response := []interface{}{}
+	for {
 		res := e.Factory()
-		results.Next(res)
-		response[i] = res
+		if !results.Next(res) {
+			break
+		}
 
+		err = e.Hooks.afterRead(req, res)
+		if err != nil {
+			e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+			return
+		}
+
+		data, err := e.renderDocument(res, selection)
+		if err != nil {
+			panic(err)
+		}
+		response = append(response, data)
 	}
 
-	httpResponse := &HTTPListResponse{pageInfo, response}
+	finishPaginationInfo(pageInfo, paginate, len(response))
+
+	httpResponse := &HTTPListResponse{Pagination: pageInfo, Data: response}
 
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(httpResponse)
+	err = e.writeList(w, req, encoder, httpResponse)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(w, NewErrorResponse(err).ToJSON())
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
 	}
 }
 
 func (e *Endpoint) HandleReadOne(w http.ResponseWriter, req *http.Request) {
-	defer handleError(w)
+	defer e.handleError(w, req)
 	w.Header().Set("Content-Type", "application/json")
 
 	var err error
 
+	encoder, ok := e.negotiateEncoder(w, req)
+	if !ok {
+		return
+	}
+
 	// Step 1 - make sure provided ID is a valid mongo id hex
 	vars := mux.Vars(req)
 
 	id := vars["id"]
 
 	if len(id) == 0 || !bson.IsObjectIdHex(id) {
-		http.Error(w, "Invalid object ID", http.StatusBadRequest)
+		e.writeErrors(w, req, []*Error{invalidIdError()})
+		return
+	}
+
+	selection, err := e.getFieldSelection(req)
+
+	if err != nil {
+		e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidQuery)
 		return
 	}
 
 	// Execute the find
 	instance := e.Factory()
 
-	err = e.Connection.Collection(e.CollectionName).FindById(bson.ObjectIdHex(id), instance)
+	var projection bson.M
+	if selection != nil {
+		projection = selection.Projection
+	}
+
+	err = e.findById(req, e.getStore(), bson.ObjectIdHex(id), instance, projection)
 
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		io.WriteString(w, NewErrorResponse(err).ToJSON())
+		e.writeFindError(w, req, err)
 		return
 	}
 
-	httpResponse := &HTTPSingleResponse{instance}
+	etag := e.setETag(w, instance, selection != nil)
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 && etagMatches(ifNoneMatch, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = e.Hooks.afterRead(req, instance)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	data, err := e.renderDocument(instance, selection)
+	if err != nil {
+		panic(err)
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: data, Links: e.documentLinks(instance)}
 
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(httpResponse)
+	err = e.writeOne(w, req, encoder, http.StatusOK, httpResponse)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(w, NewErrorResponse(err).ToJSON())
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
 	}
 }
 
 func (e *Endpoint) HandleCreate(w http.ResponseWriter, req *http.Request) {
-	defer handleError(w)
+	defer e.handleError(w, req)
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -374,7 +642,17 @@ func (e *Endpoint) HandleCreate(w http.ResponseWriter, req *http.Request) {
 
 	// start := time.Now()
 
-	decoder := json.NewDecoder(req.Body)
+	decoder, params, ok := e.negotiateDecoder(w, req)
+	if !ok || !e.limitBody(w, req) {
+		return
+	}
+
+	body := bufio.NewReader(req.Body)
+
+	if _, isJSON := decoder.(*JSONDecoder); isJSON && e.AllowBulk && isJSONArray(body) {
+		e.handleBulkCreate(w, req, body)
+		return
+	}
 
 	obj := e.Factory()
 
@@ -383,41 +661,52 @@ func (e *Endpoint) HandleCreate(w http.ResponseWriter, req *http.Request) {
 		trackable.GetDiffTracker().Reset()
 	}
 
-	err = decoder.Decode(obj)
+	protected := e.snapshotProtectedFields(obj, true)
+
+	err = decoder.Decode(body, params, obj)
 
 	if err != nil {
-		if merr, ok := err.(*json.MultipleUnmarshalTypeError); ok {
+		e.writeBodyError(w, req, err, ErrorCodeInvalidBody)
+		return
+	}
 
-			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, NewMultiErrorResponse(merr.Errors).ToJSON())
-			return
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, NewErrorResponse(err).ToJSON())
-			return
-		}
+	if errs := e.enforceFieldPolicies(obj, protected); len(errs) > 0 {
+		e.writeErrors(w, req, errs)
+		return
+	}
+
+	err = e.Hooks.beforeCreate(req, obj)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
 
+	err = e.checkScope(req, obj)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
 	}
 
-	err = e.Connection.Collection(e.CollectionName).Save(obj)
+	err = e.getStore().Save(obj)
 
 	if err != nil {
-		if verr, ok := err.(*bongo.ValidationError); ok {
-			w.WriteHeader(http.StatusBadRequest)
-			errResponse := &HTTPErrorResponse{verr.Errors}
-			io.WriteString(w, errResponse.ToJSON())
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, NewErrorResponse(err).ToJSON())
-		}
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
 		return
 	}
 
-	httpResponse := &HTTPSingleResponse{obj}
+	logAfterHookError(req, "AfterCreate", e.Hooks.afterCreate(req, obj))
+
+	e.setETag(w, obj, false)
+
+	data, err := e.renderDocument(obj, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: data, Links: e.documentLinks(obj)}
 
-	encoder := json.NewEncoder(w)
-	w.WriteHeader(http.StatusCreated)
-	err = encoder.Encode(httpResponse)
+	w.Header().Set("Location", e.documentURI(obj.GetId().Hex()))
+	err = e.writeOne(w, req, e.defaultEncoder(), http.StatusCreated, httpResponse)
 
 	if err != nil {
 		panic(err)
@@ -426,9 +715,15 @@ func (e *Endpoint) HandleCreate(w http.ResponseWriter, req *http.Request) {
 }
 
 func (e *Endpoint) HandleUpdate(w http.ResponseWriter, req *http.Request) {
-	defer handleError(w)
+	defer e.handleError(w, req)
 	w.Header().Set("Content-Type", "application/json")
 
+	// A PUT replaces the document, so patches have to use PATCH
+	if isJSONPatchRequest(req) {
+		e.writeErrors(w, req, []*Error{NewError(http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, "JSON Patch documents must be sent with PATCH")})
+		return
+	}
+
 	var err error
 
 	vars := mux.Vars(req)
@@ -436,18 +731,28 @@ func (e *Endpoint) HandleUpdate(w http.ResponseWriter, req *http.Request) {
 	id := vars["id"]
 
 	if len(id) == 0 || !bson.IsObjectIdHex(id) {
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, NewErrorResponse(errors.New("Invalid Object ID")).ToJSON())
+		e.writeErrors(w, req, []*Error{invalidIdError()})
+		return
+	}
+
+	decoder, params, ok := e.negotiateDecoder(w, req)
+	if !ok || !e.limitBody(w, req) {
 		return
 	}
 
 	// Execute the find
 	instance := e.Factory()
 
-	err = e.Connection.Collection(e.CollectionName).FindById(bson.ObjectIdHex(id), instance)
+	store := e.getStore()
+
+	err = e.findById(req, store, bson.ObjectIdHex(id), instance, nil)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		io.WriteString(w, NewErrorResponse(err).ToJSON())
+		e.writeFindError(w, req, err)
+		return
+	}
+
+	condition, ok := e.checkIfMatch(w, req, instance)
+	if !ok {
 		return
 	}
 
@@ -458,46 +763,220 @@ func (e *Endpoint) HandleUpdate(w http.ResponseWriter, req *http.Request) {
 	// Save the ID and reapply it afterward, so we do not allow the http request to modify the ID
 	actualId := instance.GetId()
 
-	decoder := json.NewDecoder(req.Body)
-	err = decoder.Decode(instance)
+	protected := e.snapshotProtectedFields(instance, false)
+	original := e.originalForUpdate(instance)
+
+	before, err := encodeBson(instance)
+	if err != nil {
+		panic(err)
+	}
+
+	err = decoder.Decode(req.Body, params, instance)
+
+	if err != nil {
+		e.writeBodyError(w, req, err, ErrorCodeInvalidBody)
+		return
+	}
+
+	instance.SetId(actualId)
+
+	if errs := e.enforceFieldPolicies(instance, protected); len(errs) > 0 {
+		e.writeErrors(w, req, errs)
+		return
+	}
+
+	if tt, ok := instance.(bongo.TimeTracker); ok {
+		tt.SetModified(time.Now())
+	}
 
+	err = e.Hooks.beforeUpdate(req, original, instance)
 	if err != nil {
-		if merr, ok := err.(*json.MultipleUnmarshalTypeError); ok {
-			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, NewMultiErrorResponse(merr.Errors).ToJSON())
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	err = e.checkScope(req, instance)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	if condition != nil || e.dropsDeletedField(instance) {
+		err = saveWithUpdate(store, instance, before, condition)
+	} else {
+		err = store.Save(instance)
+	}
+
+	if err != nil {
+		e.writeConditionalError(w, req, err, condition)
+		return
+	}
+
+	logAfterHookError(req, "AfterUpdate", e.Hooks.afterUpdate(req, instance))
+
+	e.setETag(w, instance, false)
+
+	data, err := e.renderDocument(instance, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: data}
+
+	err = e.writeOne(w, req, e.defaultEncoder(), http.StatusOK, httpResponse)
+
+	if err != nil {
+		panic(err)
+	}
+
+}
+
+// Handle a "Patch" request. The body is either a JSON Patch (RFC 6902) when sent
+// as application/json-patch+json, or a JSON Merge Patch (RFC 7396) which is
+// applied on top of the stored document. A failing "test" operation results
+// in a 409 Conflict. For bongo.Trackable models only the
+// fields that actually changed are written with $set/$unset, otherwise the
+// whole document is saved like in HandleUpdate.
+func (e *Endpoint) HandlePatch(w http.ResponseWriter, req *http.Request) {
+	defer e.handleError(w, req)
+	w.Header().Set("Content-Type", "application/json")
+
+	var err error
+
+	vars := mux.Vars(req)
+
+	id := vars["id"]
+
+	if len(id) == 0 || !bson.IsObjectIdHex(id) {
+		e.writeErrors(w, req, []*Error{invalidIdError()})
+		return
+	}
+
+	if !e.limitBody(w, req) {
+		return
+	}
+
+	// Execute the find
+	instance := e.Factory()
+
+	store := e.getStore()
+
+	err = e.findById(req, store, bson.ObjectIdHex(id), instance, nil)
+	if err != nil {
+		e.writeFindError(w, req, err)
+		return
+	}
+
+	condition, ok := e.checkIfMatch(w, req, instance)
+	if !ok {
+		return
+	}
+
+	if trackable, ok := instance.(bongo.Trackable); ok {
+		trackable.GetDiffTracker().Reset()
+	}
+
+	// Save the ID and reapply it afterward, so we do not allow the http request to modify the ID
+	actualId := instance.GetId()
+
+	protected := e.snapshotProtectedFields(instance, false)
+	original := e.originalForUpdate(instance)
+
+	before, err := encodeBson(instance)
+	if err != nil {
+		panic(err)
+	}
+
+	jsonPatch := isJSONPatchRequest(req)
+
+	var operations []PatchOperation
+
+	decoder := json.NewDecoder(req.Body)
+
+	if jsonPatch {
+		err = decoder.Decode(&operations)
+
+		if err != nil {
+			e.writeBodyError(w, req, err, ErrorCodeInvalidPatch)
 			return
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, NewErrorResponse(err).ToJSON())
+		}
+
+		err = e.checkHiddenPatchPaths(instance, operations)
+		if err != nil {
+			e.writeError(w, req, err, http.StatusBadRequest, ErrorCodeInvalidPatch)
 			return
 		}
 
+		err = applyJSONPatchToDocument(instance, operations)
+	} else {
+		var patch interface{}
+		decoder.UseNumber()
+		err = decoder.Decode(&patch)
+
+		if err != nil {
+			e.writeBodyError(w, req, err, ErrorCodeInvalidPatch)
+			return
+		}
+
+		if _, ok := patch.(map[string]interface{}); !ok {
+			e.writeErrors(w, req, []*Error{NewError(http.StatusBadRequest, ErrorCodeInvalidPatch, "Merge patch must be a JSON object")})
+			return
+		}
+
+		err = applyMergePatchToDocument(instance, patch)
+	}
+
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
 	}
 
 	instance.SetId(actualId)
 
+	if errs := e.enforceFieldPolicies(instance, protected); len(errs) > 0 {
+		e.writeErrors(w, req, errs)
+		return
+	}
+
 	if tt, ok := instance.(bongo.TimeTracker); ok {
 		tt.SetModified(time.Now())
 	}
 
-	err = e.Connection.Collection(e.CollectionName).Save(instance)
+	err = e.Hooks.beforeUpdate(req, original, instance)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
 
+	err = e.checkScope(req, instance)
 	if err != nil {
-		if verr, ok := err.(*bongo.ValidationError); ok {
-			w.WriteHeader(http.StatusBadRequest)
-			errResponse := &HTTPErrorResponse{verr.Errors}
-			io.WriteString(w, errResponse.ToJSON())
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, NewErrorResponse(err).ToJSON())
-		}
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	if jsonPatch {
+		err = e.saveJSONPatch(store, instance, before, condition, operations)
+	} else {
+		err = e.savePartial(store, instance, before, condition)
+	}
+
+	if err != nil {
+		e.writeConditionalError(w, req, err, condition)
 		return
 	}
 
-	httpResponse := &HTTPSingleResponse{instance}
+	logAfterHookError(req, "AfterUpdate", e.Hooks.afterUpdate(req, instance))
 
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(httpResponse)
+	e.setETag(w, instance, false)
+
+	data, err := e.renderDocument(instance, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: data}
+
+	err = e.writeOne(w, req, e.defaultEncoder(), http.StatusOK, httpResponse)
 
 	if err != nil {
 		panic(err)
@@ -506,7 +985,7 @@ func (e *Endpoint) HandleUpdate(w http.ResponseWriter, req *http.Request) {
 }
 
 func (e *Endpoint) HandleDelete(w http.ResponseWriter, req *http.Request) {
-	defer handleError(w)
+	defer e.handleError(w, req)
 
 	var err error
 
@@ -515,36 +994,42 @@ func (e *Endpoint) HandleDelete(w http.ResponseWriter, req *http.Request) {
 	id := vars["id"]
 
 	if len(id) == 0 || !bson.IsObjectIdHex(id) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, NewErrorResponse(errors.New("Invalid Object ID")).ToJSON())
+		e.writeErrors(w, req, []*Error{invalidIdError()})
 		return
 	}
 
 	// Execute the find
 	instance := e.Factory()
 
-	// Use a FindOne instead of FindById since the query filters may need
-	// to add additional parameters to the search query, aside from just ID.
-	// Error here is just if there is no document
-	collection := e.Connection.Collection(e.CollectionName)
+	// Use findById instead of the collection's FindById since the scope and
+	// soft delete filters add additional parameters to the search query,
+	// aside from just ID. Error here is just if there is no document
+	store := e.getStore()
 
-	err = collection.FindById(bson.ObjectIdHex(id), instance)
+	err = e.findById(req, store, bson.ObjectIdHex(id), instance, nil)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		io.WriteString(w, NewErrorResponse(err).ToJSON())
+		e.writeFindError(w, req, err)
 		return
 	}
 
-	err = collection.DeleteDocument(instance)
+	condition, ok := e.checkIfMatch(w, req, instance)
+	if !ok {
+		return
+	}
 
+	err = e.Hooks.beforeDelete(req, instance)
 	if err != nil {
-		// Make a new JSON e
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, NewErrorResponse(err).ToJSON())
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
 		return
 	}
 
+	err = e.deleteDocument(store, instance, condition)
+
+	if err != nil {
+		e.writeConditionalError(w, req, err, condition)
+		return
+	}
+
+	logAfterHookError(req, "AfterDelete", e.Hooks.afterDelete(req, instance))
+
 }
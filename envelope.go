@@ -0,0 +1,215 @@
+package bongoz
+
+import (
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const JSONAPIContentType = "application/vnd.api+json"
+
+// Shapes the responses written by EnvelopeEncoders (JSON and MessagePack).
+// Responses of other encoders keep their own format.
+type Envelope interface {
+	// Media type of JSON responses
+	ContentType() string
+	RenderList(e *Endpoint, req *http.Request, response *HTTPListResponse) (interface{}, error)
+	RenderOne(e *Endpoint, req *http.Request, response *HTTPSingleResponse) (interface{}, error)
+}
+
+// Envelopes rendering the results of aggregations, which are not documents,
+// differently from documents. Others render them with RenderOne.
+type AggregateEnvelope interface {
+	RenderAggregate(e *Endpoint, req *http.Request, response *HTTPSingleResponse) (interface{}, error)
+}
+
+// Encoders writing the value rendered by the endpoint's Envelope
+type EnvelopeEncoder interface {
+	Encoder
+	EncodeValue(w io.Writer, value interface{}) error
+}
+
+func (e *Endpoint) envelope() Envelope {
+	if e.Envelope == nil {
+		return &DefaultEnvelope{}
+	}
+
+	return e.Envelope
+}
+
+// Content type of the responses of an encoder, which is the envelope's for
+// JSON
+func (e *Endpoint) contentType(encoder Encoder) string {
+	if _, ok := encoder.(*JSONEncoder); ok {
+		return e.envelope().ContentType()
+	}
+
+	return encoder.ContentType()
+}
+
+// The encoder if it can stream lists. Streamed JSON lists always use the
+// default envelope, so they are only streamed with it.
+func (e *Endpoint) streamEncoder(encoder Encoder) (StreamEncoder, bool) {
+	if _, ok := encoder.(EnvelopeEncoder); ok {
+		if _, ok := e.envelope().(*DefaultEnvelope); !ok {
+			return nil, false
+		}
+	}
+
+	streamEncoder, ok := encoder.(StreamEncoder)
+	return streamEncoder, ok
+}
+
+// The {"data": ..., "pagination": ...} envelope
+type DefaultEnvelope struct{}
+
+func (d *DefaultEnvelope) ContentType() string {
+	return "application/json"
+}
+
+func (d *DefaultEnvelope) RenderList(e *Endpoint, req *http.Request, response *HTTPListResponse) (interface{}, error) {
+	return response, nil
+}
+
+func (d *DefaultEnvelope) RenderOne(e *Endpoint, req *http.Request, response *HTTPSingleResponse) (interface{}, error) {
+	return response, nil
+}
+
+// Just the documents. Pagination is left to the Link header.
+type BareEnvelope struct{}
+
+func (b *BareEnvelope) ContentType() string {
+	return "application/json"
+}
+
+func (b *BareEnvelope) RenderList(e *Endpoint, req *http.Request, response *HTTPListResponse) (interface{}, error) {
+	return response.Data, nil
+}
+
+func (b *BareEnvelope) RenderOne(e *Endpoint, req *http.Request, response *HTTPSingleResponse) (interface{}, error) {
+	return response.Data, nil
+}
+
+// JSON:API documents (https://jsonapi.org). Documents become resources
+// with their _id as id and the other fields as attributes, and the
+// pagination block is the meta of lists.
+type JSONAPIEnvelope struct {
+	// Resource type, the last segment of the endpoint's URI if empty
+	Type string
+}
+
+func (j *JSONAPIEnvelope) ContentType() string {
+	return JSONAPIContentType
+}
+
+func (j *JSONAPIEnvelope) RenderList(e *Endpoint, req *http.Request, response *HTTPListResponse) (interface{}, error) {
+	data := make([]interface{}, len(response.Data))
+
+	for i, doc := range response.Data {
+		var err error
+		data[i], err = j.resource(e, doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	links := map[string]string{}
+	for rel, link := range response.Links {
+		links[rel] = link.Href
+	}
+
+	return map[string]interface{}{
+		"data":  data,
+		"links": links,
+		"meta":  response.Pagination,
+	}, nil
+}
+
+func (j *JSONAPIEnvelope) RenderOne(e *Endpoint, req *http.Request, response *HTTPSingleResponse) (interface{}, error) {
+	resource, err := j.resource(e, response.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"data":  resource,
+		"links": resource["links"],
+	}, nil
+}
+
+// Aggregations are not resources, so they are the meta of the document
+func (j *JSONAPIEnvelope) RenderAggregate(e *Endpoint, req *http.Request, response *HTTPSingleResponse) (interface{}, error) {
+	return map[string]interface{}{
+		"meta": response.Data,
+	}, nil
+}
+
+func (j *JSONAPIEnvelope) resource(e *Endpoint, doc interface{}) (map[string]interface{}, error) {
+	value, err := toJSONValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Documents must encode to JSON objects")
+	}
+
+	idKey := idJSONKey(e.Factory())
+	id := fmt.Sprint(attributes[idKey])
+	delete(attributes, idKey)
+
+	resourceType := j.Type
+	if len(resourceType) == 0 {
+		segments := strings.Split(strings.Trim(e.Uri, "/"), "/")
+		resourceType = segments[len(segments)-1]
+	}
+
+	return map[string]interface{}{
+		"type":       resourceType,
+		"id":         id,
+		"attributes": attributes,
+		"links":      map[string]string{"self": e.documentURI(id)},
+	}, nil
+}
+
+// Decodes JSON:API documents, taking the attributes and the id of the
+// resource in data
+type JSONAPIDecoder struct{}
+
+func (j *JSONAPIDecoder) Decode(r io.Reader, params map[string]string, doc interface{}) error {
+	var document map[string]interface{}
+
+	err := json.NewDecoder(r).Decode(&document)
+	if err != nil {
+		return err
+	}
+
+	resource, ok := document["data"].(map[string]interface{})
+	if !ok {
+		return errors.New("Expected a resource object in data")
+	}
+
+	attributes, ok := resource["attributes"].(map[string]interface{})
+	if !ok {
+		attributes = map[string]interface{}{}
+	}
+
+	if id, ok := resource["id"]; ok {
+		attributes[idJSONKey(doc)] = id
+	}
+
+	return decodeJSONValue(attributes, doc)
+}
+
+// The JSON key of a model's _id
+func idJSONKey(doc interface{}) string {
+	if field, found := resolveField("_id", doc); found {
+		return field.JSONKey
+	}
+
+	return "_id"
+}
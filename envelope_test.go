@@ -0,0 +1,128 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnvelopes(t *testing.T) {
+	Convey("Response envelopes", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+		endpoint.Pagination.PerPage = 2
+
+		pages := []*Page{}
+		for _, content := range []string{"a", "b", "c"} {
+			page := &Page{Content: content}
+			So(store.Save(page), ShouldEqual, nil)
+			pages = append(pages, page)
+		}
+
+		router := endpoint.GetRouter()
+
+		send := func(method string, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, strings.NewReader(body))
+			for key, value := range headers {
+				req.Header.Set(key, value)
+			}
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("Link headers", func() {
+			w := send("GET", "/api/pages?_sort=content&_page=2", "", nil)
+
+			So(w.Header().Get("Link"), ShouldEqual, `</api/pages?_page=1&_sort=content>; rel="first", </api/pages?_page=1&_sort=content>; rel="prev", </api/pages?_page=2&_sort=content>; rel="last"`)
+
+			Convey("with cursors", func() {
+				w := send("GET", "/api/pages?_after=", "", nil)
+
+				links := w.Header().Get("Link")
+				So(links, ShouldContainSubstring, `</api/pages?_after=>; rel="first"`)
+				So(links, ShouldContainSubstring, `rel="next"`)
+				So(links, ShouldNotContainSubstring, `rel="prev"`)
+			})
+			Convey("not for limit and skip", func() {
+				w := send("GET", "/api/pages?_limit=1", "", nil)
+				So(w.Header().Get("Link"), ShouldEqual, "")
+			})
+		})
+		Convey("bare", func() {
+			endpoint.Envelope = &BareEnvelope{}
+
+			w := send("GET", "/api/pages?_sort=content", "", nil)
+
+			data := []map[string]interface{}{}
+			So(json.Unmarshal(w.Body.Bytes(), &data), ShouldEqual, nil)
+			So(len(data), ShouldEqual, 2)
+			So(data[0]["content"], ShouldEqual, "a")
+			So(w.Header().Get("Link"), ShouldContainSubstring, `rel="next"`)
+
+			w = send("GET", "/api/pages/"+pages[0].Id.Hex(), "", nil)
+
+			doc := map[string]interface{}{}
+			So(json.Unmarshal(w.Body.Bytes(), &doc), ShouldEqual, nil)
+			So(doc["content"], ShouldEqual, "a")
+		})
+		Convey("JSON:API", func() {
+			endpoint.Envelope = &JSONAPIEnvelope{}
+
+			type resource struct {
+				Type       string
+				Id         string
+				Attributes map[string]interface{}
+				Links      map[string]string
+			}
+
+			Convey("lists", func() {
+				w := send("GET", "/api/pages?_sort=content", "", map[string]string{"Accept": JSONAPIContentType})
+
+				So(w.Code, ShouldEqual, 200)
+				So(w.Header().Get("Content-Type"), ShouldEqual, JSONAPIContentType)
+
+				response := &struct {
+					Data  []resource
+					Links map[string]string
+					Meta  bongo.PaginationInfo
+				}{}
+				So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+				So(len(response.Data), ShouldEqual, 2)
+				So(response.Data[0].Type, ShouldEqual, "pages")
+				So(response.Data[0].Id, ShouldEqual, pages[0].Id.Hex())
+				So(response.Data[0].Attributes["content"], ShouldEqual, "a")
+				So(response.Data[0].Attributes, ShouldNotContainKey, "_id")
+				So(response.Data[0].Links["self"], ShouldEqual, "/api/pages/"+pages[0].Id.Hex())
+				So(response.Links["self"], ShouldEqual, "/api/pages?_sort=content")
+				So(response.Links["next"], ShouldEqual, "/api/pages?_page=2&_sort=content")
+				So(response.Meta.TotalRecords, ShouldEqual, 3)
+			})
+			Convey("creates", func() {
+				w := send("POST", "/api/pages", `{"data":{"type":"pages","attributes":{"content":"d"}}}`, map[string]string{"Content-Type": JSONAPIContentType})
+
+				So(w.Code, ShouldEqual, 201)
+
+				response := &struct {
+					Data resource
+				}{}
+				So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+				So(response.Data.Attributes["content"], ShouldEqual, "d")
+				So(len(response.Data.Id), ShouldEqual, 24)
+			})
+			Convey("lists are not streamed", func() {
+				endpoint.StreamLists = true
+
+				w := send("GET", "/api/pages", "", nil)
+				So(w.Body.String(), ShouldStartWith, `{"data":[{"attributes"`)
+			})
+		})
+	})
+}
@@ -0,0 +1,183 @@
+package bongoz
+
+import (
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/bongo"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Stable, machine-readable error codes
+const (
+	ErrorCodeInternal             = "internal_error"
+	ErrorCodeInvalidId            = "invalid_id"
+	ErrorCodeNotFound             = "not_found"
+	ErrorCodeForbidden            = "forbidden"
+	ErrorCodeInvalidBody          = "invalid_body"
+	ErrorCodeInvalidType          = "invalid_type"
+	ErrorCodeInvalidQuery         = "invalid_query"
+	ErrorCodeInvalidPatch         = "invalid_patch"
+	ErrorCodeValidation           = "validation_failed"
+	ErrorCodeProtectedField       = "protected_field"
+	ErrorCodePatchTestFailed      = "patch_test_failed"
+	ErrorCodePreconditionFailed   = "precondition_failed"
+	ErrorCodeTooManyItems         = "too_many_items"
+	ErrorCodeSkipped              = "skipped"
+	ErrorCodeRejected             = "rejected"
+	ErrorCodeNotAcceptable        = "not_acceptable"
+	ErrorCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrorCodeBodyTooLarge         = "body_too_large"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// An error as reported to clients. Field is the path of the offending field,
+// if any. Validate hooks may return these to report field paths and codes.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func NewError(status int, code string, message string) *Error {
+	return &Error{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func NewFieldError(status int, code string, field string, message string) *Error {
+	return &Error{
+		Status:  status,
+		Code:    code,
+		Message: message,
+		Field:   field,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Turn an error into the errors reported to clients. Validation and JSON type
+// errors get an entry per problem, errors of known types get their own status
+// and code, anything else gets the given status and code.
+func toErrors(err error, status int, code string) []*Error {
+	switch e := err.(type) {
+	case *Error:
+		return []*Error{e}
+	case *QueryError:
+		return e.Errors
+	case *HookError:
+		return toErrors(e.Err, e.Status, ErrorCodeRejected)
+	case *ScopeError:
+		return []*Error{NewError(http.StatusForbidden, ErrorCodeForbidden, e.Error())}
+	case *PatchTestFailedError:
+		return []*Error{NewError(http.StatusConflict, ErrorCodePatchTestFailed, e.Error())}
+	case *InvalidPatchError:
+		return []*Error{NewError(http.StatusBadRequest, ErrorCodeInvalidPatch, e.Error())}
+	case *bongo.ValidationError:
+		return listToErrors(e.Errors, http.StatusBadRequest, ErrorCodeValidation)
+	case *json.MultipleUnmarshalTypeError:
+		return listToErrors(e.Errors, http.StatusBadRequest, ErrorCodeInvalidType)
+	case *json.UnmarshalTypeError:
+		return []*Error{NewError(http.StatusBadRequest, ErrorCodeInvalidType, e.Error())}
+	case *json.SyntaxError:
+		return []*Error{NewError(http.StatusBadRequest, ErrorCodeInvalidBody, e.Error())}
+	}
+
+	return []*Error{NewError(status, code, err.Error())}
+}
+
+func listToErrors(errs []error, status int, code string) []*Error {
+	converted := []*Error{}
+
+	for _, err := range errs {
+		converted = append(converted, toErrors(err, status, code)...)
+	}
+
+	return converted
+}
+
+// Recover from a panic in a handler and answer with a 500
+func (e *Endpoint) handleError(w http.ResponseWriter, req *http.Request) {
+	var err error
+	if r := recover(); r != nil {
+		// Responses that were partly written already, see streamList
+		if r == http.ErrAbortHandler {
+			panic(r)
+		}
+
+		if rerr, ok := r.(error); ok {
+			if rerr.Error() == "EOF" {
+				err = errors.New("Lost database connection unexpectedly")
+			} else {
+				err = rerr
+			}
+
+		} else if s, ok := r.(string); ok {
+			err = errors.New(s)
+		} else {
+			err = errors.New(fmt.Sprint(r))
+		}
+
+		e.writeErrors(w, req, []*Error{NewError(http.StatusInternalServerError, ErrorCodeInternal, err.Error())})
+	}
+}
+
+// Whether errors should be rendered as RFC 7807 problem details
+func (e *Endpoint) wantsProblemDetails(req *http.Request) bool {
+	return e.ProblemDetails || strings.Contains(req.Header.Get("Accept"), ProblemContentType)
+}
+
+// Write err as the response, see toErrors
+func (e *Endpoint) writeError(w http.ResponseWriter, req *http.Request, err error, status int, code string) {
+	e.writeErrors(w, req, toErrors(err, status, code))
+}
+
+// Write errors as the response, with the status of the first one
+func (e *Endpoint) writeErrors(w http.ResponseWriter, req *http.Request, errs []*Error) {
+	status := http.StatusInternalServerError
+	if len(errs) > 0 && errs[0].Status > 0 {
+		status = errs[0].Status
+	}
+
+	var body interface{}
+
+	if e.wantsProblemDetails(req) {
+		w.Header().Set("Content-Type", ProblemContentType)
+
+		problem := map[string]interface{}{
+			"type":   "about:blank",
+			"title":  http.StatusText(status),
+			"status": status,
+			"errors": errs,
+		}
+
+		if len(errs) > 0 {
+			problem["code"] = errs[0].Code
+			problem["detail"] = errs[0].Message
+		}
+
+		body = problem
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		body = map[string]interface{}{
+			"errors": errs,
+		}
+	}
+
+	marshaled, _ := json.Marshal(body)
+
+	w.WriteHeader(status)
+	io.WriteString(w, string(marshaled))
+}
+
+func invalidIdError() *Error {
+	return NewError(http.StatusBadRequest, ErrorCodeInvalidId, "Invalid Object ID")
+}
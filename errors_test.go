@@ -0,0 +1,111 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type errorResponse struct {
+	Errors []*Error
+}
+
+type problemResponse struct {
+	Type   string
+	Title  string
+	Status int
+	Code   string
+	Detail string
+	Errors []*Error
+}
+
+func TestErrors(t *testing.T) {
+	Convey("Errors", t, func() {
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = NewMemoryStore()
+
+		Convey("invalid id on read one", func() {
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequest("GET", "/api/pages/foo", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 400)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+			response := &errorResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(len(response.Errors), ShouldEqual, 1)
+			So(response.Errors[0].Code, ShouldEqual, ErrorCodeInvalidId)
+		})
+		Convey("problem details", func() {
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequest("GET", "/api/pages/540e05189b2212ee6b1f44d3", nil)
+			req.Header.Set("Accept", ProblemContentType)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 404)
+			So(w.Header().Get("Content-Type"), ShouldEqual, ProblemContentType)
+
+			response := &problemResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(response.Status, ShouldEqual, 404)
+			So(response.Title, ShouldEqual, "Not Found")
+			So(response.Code, ShouldEqual, ErrorCodeNotFound)
+		})
+		Convey("field errors from validation", func() {
+			endpoint.Hooks.BeforeCreate = func(req *http.Request, doc bongo.Document) error {
+				return &bongo.ValidationError{Errors: []error{
+					NewFieldError(422, "too_short", "content", "Content is too short"),
+				}}
+			}
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequest("POST", "/api/pages", strings.NewReader(`{"content":"a"}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 422)
+
+			response := &errorResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(response.Errors[0].Code, ShouldEqual, "too_short")
+			So(response.Errors[0].Field, ShouldEqual, "content")
+		})
+		Convey("panics", func() {
+			endpoint.Hooks.AfterRead = func(req *http.Request, doc bongo.Document) error {
+				panic("boom")
+			}
+			endpoint.ProblemDetails = true
+
+			page := &Page{Content: "foo"}
+			So(endpoint.Store.Save(page), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequest("GET", "/api/pages/"+page.Id.Hex(), nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 500)
+
+			response := &problemResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(response.Code, ShouldEqual, ErrorCodeInternal)
+			So(response.Detail, ShouldEqual, "boom")
+		})
+	})
+}
@@ -0,0 +1,158 @@
+package bongoz
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/maxwellhealth/bongo"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Compute a strong ETag for a document. If the endpoint has a VersionField and
+// the document has a non-zero value for it, the tag is derived from that
+// value. Otherwise it is a hash of the encoded document.
+func (e *Endpoint) documentETag(doc bongo.Document) (string, error) {
+	hash := sha1.New()
+	io.WriteString(hash, doc.GetId().Hex())
+	io.WriteString(hash, ":")
+
+	if version, ok := e.documentVersion(doc); ok {
+		io.WriteString(hash, version)
+	} else {
+		// Go through bson first, so times are truncated to what is
+		// actually stored and map keys end up sorted by the JSON encoder
+		encoded, err := encodeBson(doc)
+		if err != nil {
+			return "", err
+		}
+
+		marshaled, err := json.Marshal(encoded)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(marshaled)
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, nil
+}
+
+func (e *Endpoint) documentVersion(doc bongo.Document) (string, bool) {
+	if len(e.VersionField) == 0 {
+		return "", false
+	}
+
+	field, ok := findFieldByNameOrBsonTag(e.VersionField, doc)
+	if !ok || !field.CanInterface() {
+		return "", false
+	}
+
+	if t, ok := field.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return "", false
+		}
+		// Mongo stores milliseconds, so the in-memory value needs to be
+		// truncated to produce the same tag as the stored one
+		return fmt.Sprint(t.UnixNano() / int64(time.Millisecond)), true
+	}
+
+	if reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+		return "", false
+	}
+
+	return fmt.Sprint(field.Interface()), true
+}
+
+// Check an If-Match or If-None-Match header value against an ETag. If-Match
+// uses the strong comparison, so weak tags never match it.
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Enforce If-Match for a write. Returns false (after writing a 412) if the
+// request must not proceed. Otherwise returns the condition to write the
+// document with, so it can not change between this check and the write.
+// That takes a version, documents with hashed ETags are only checked here.
+func (e *Endpoint) checkIfMatch(w http.ResponseWriter, req *http.Request, doc bongo.Document) (bson.M, bool) {
+	ifMatch := req.Header.Get("If-Match")
+	if len(ifMatch) == 0 {
+		return nil, true
+	}
+
+	etag, err := e.documentETag(doc)
+	if err != nil {
+		panic(err)
+	}
+
+	if !etagMatches(ifMatch, etag, false) {
+		w.Header().Set("ETag", etag)
+		e.writeErrors(w, req, []*Error{preconditionFailedError()})
+		return nil, false
+	}
+
+	field, found := resolveField(e.VersionField, doc)
+	if _, ok := e.documentVersion(doc); !ok || !found {
+		return nil, true
+	}
+
+	version := reflectValue(doc).FieldByIndex(field.Index).Interface()
+
+	return bson.M{field.BsonKey: version}, true
+}
+
+func preconditionFailedError() *Error {
+	return NewError(http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "Document has been modified")
+}
+
+// Write the error of a write made with the condition of checkIfMatch. No
+// document matching it means the document was modified in between.
+func (e *Endpoint) writeConditionalError(w http.ResponseWriter, req *http.Request, err error, condition bson.M) {
+	if err == ErrNotFound && condition != nil {
+		e.writeErrors(w, req, []*Error{preconditionFailedError()})
+		return
+	}
+
+	e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+}
+
+// Set the ETag header for a document, and return the tag without any weak
+// prefix. A partial document (read with _fields) without a version gets a
+// weak tag, as the hash of its content is not the one If-Match checks.
+func (e *Endpoint) setETag(w http.ResponseWriter, doc bongo.Document, partial bool) string {
+	etag, err := e.documentETag(doc)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, ok := e.documentVersion(doc); partial && !ok {
+		w.Header().Set("ETag", "W/"+etag)
+	} else {
+		w.Header().Set("ETag", etag)
+	}
+
+	return etag
+}
@@ -0,0 +1,226 @@
+package bongoz
+
+import (
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestETag(t *testing.T) {
+	conn := getConnection()
+	collection := conn.Collection("pages")
+	defer conn.Session.Close()
+
+	Convey("ETag", t, func() {
+		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		endpoint.Factory = Factory
+
+		obj := &Page{
+			Content: "foo",
+		}
+
+		err := collection.Save(obj)
+		So(err, ShouldEqual, nil)
+
+		uri := strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/")
+
+		router := endpoint.GetRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", uri, nil)
+		router.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, 200)
+		etag := w.Header().Get("ETag")
+		So(etag, ShouldNotEqual, "")
+
+		Convey("not modified", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", uri, nil)
+			req.Header.Set("If-None-Match", etag)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 304)
+			So(w.Body.Len(), ShouldEqual, 0)
+		})
+		Convey("update with matching tag", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PUT", uri, strings.NewReader(`{"content":"bar"}`))
+			req.Header.Set("If-Match", etag)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("ETag"), ShouldNotEqual, etag)
+
+			Convey("stale tag is rejected", func() {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("DELETE", uri, nil)
+				req.Header.Set("If-Match", etag)
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 412)
+
+				found := &Page{}
+				err := collection.FindById(obj.Id, found)
+				So(err, ShouldEqual, nil)
+			})
+		})
+		Convey("documents modified before the write are not overwritten", func() {
+			store := NewMemoryStore()
+
+			endpoint := NewEndpoint("/api/pages", nil, "pages")
+			endpoint.Factory = Factory
+			endpoint.Store = store
+
+			page := &Page{Content: "foo"}
+			So(store.Save(page), ShouldEqual, nil)
+
+			uri := "/api/pages/" + page.Id.Hex()
+			router := endpoint.GetRouter()
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", uri, nil)
+			router.ServeHTTP(w, req)
+			etag := w.Header().Get("ETag")
+
+			// Another request writes the document right after the If-Match check
+			writes := 0
+			concurrentWrite := func() {
+				writes++
+				update := bson.M{"$set": bson.M{"content": "other", "_modified": time.Now().Add(time.Duration(writes) * time.Hour)}}
+				So(store.Update(page.Id, nil, update), ShouldEqual, nil)
+			}
+			endpoint.Hooks.BeforeUpdate = func(req *http.Request, original bongo.Document, doc bongo.Document) error {
+				concurrentWrite()
+				return nil
+			}
+			endpoint.Hooks.BeforeDelete = func(req *http.Request, doc bongo.Document) error {
+				concurrentWrite()
+				return nil
+			}
+
+			for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, uri, strings.NewReader(`{"content":"bar"}`))
+				req.Header.Set("If-Match", etag)
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 412)
+
+				found := &Page{}
+				So(store.FindById(page.Id, found), ShouldEqual, nil)
+				So(found.Content, ShouldEqual, "other")
+
+				etag = endpoint.setETag(httptest.NewRecorder(), found, false)
+			}
+		})
+		Convey("reads with selected fields", func() {
+			store := NewMemoryStore()
+
+			endpoint := NewEndpoint("/api/pages", nil, "pages")
+			endpoint.Factory = Factory
+			endpoint.Store = store
+
+			page := &Page{Content: "foo"}
+			So(store.Save(page), ShouldEqual, nil)
+
+			uri := "/api/pages/" + page.Id.Hex()
+			router := endpoint.GetRouter()
+
+			read := func(query string) string {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", uri+query, nil)
+				router.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 200)
+				return w.Header().Get("ETag")
+			}
+
+			Convey("get the tag of their version", func() {
+				etag := read("?_fields=content")
+				So(etag, ShouldEqual, read(""))
+
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("PUT", uri, strings.NewReader(`{"content":"bar"}`))
+				req.Header.Set("If-Match", etag)
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 200)
+			})
+
+			Convey("get a weak tag without a version", func() {
+				endpoint.VersionField = ""
+
+				etag := read("?_fields=content")
+				So(etag, ShouldStartWith, "W/")
+				So(etag, ShouldNotEqual, "W/"+read(""))
+
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", uri+"?_fields=content", nil)
+				req.Header.Set("If-None-Match", etag)
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 304)
+
+				w = httptest.NewRecorder()
+				req, _ = http.NewRequest("PUT", uri, strings.NewReader(`{"content":"bar"}`))
+				req.Header.Set("If-Match", etag)
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 412)
+			})
+		})
+		Convey("conditional writes run the model's hooks", func() {
+			store := NewMemoryStore()
+
+			endpoint := NewEndpoint("/api/pages", nil, "pages")
+			endpoint.Factory = HookedFactory
+			endpoint.Store = store
+			router := endpoint.GetRouter()
+
+			requests := []struct {
+				method      string
+				contentType string
+				body        string
+				hooks       []string
+			}{
+				{"PUT", "application/json", `{"content":"bar"}`, []string{"BeforeSave", "AfterSave"}},
+				{"PATCH", "application/json", `{"content":"baz"}`, []string{"BeforeSave", "AfterSave"}},
+				{"PATCH", JSONPatchContentType, `[{"op":"replace","path":"/content","value":"qux"}]`, []string{"BeforeSave", "AfterSave"}},
+				{"DELETE", "application/json", "", []string{"BeforeDelete", "AfterDelete"}},
+			}
+
+			for _, conditional := range []bool{false, true} {
+				page := &hookedPage{Page: Page{Content: "foo"}}
+				So(store.Save(page), ShouldEqual, nil)
+				uri := "/api/pages/" + page.Id.Hex()
+
+				for _, r := range requests {
+					w := httptest.NewRecorder()
+					req, _ := http.NewRequest("GET", uri, nil)
+					router.ServeHTTP(w, req)
+					etag := w.Header().Get("ETag")
+
+					hookCalls = nil
+					w = httptest.NewRecorder()
+					req, _ = http.NewRequest(r.method, uri, strings.NewReader(r.body))
+					req.Header.Set("Content-Type", r.contentType)
+					if conditional {
+						req.Header.Set("If-Match", etag)
+					}
+					router.ServeHTTP(w, req)
+
+					So(w.Code, ShouldBeLessThan, 300)
+					So(hookCalls, ShouldResemble, r.hooks)
+				}
+			}
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongoz").DropDatabase()
+		})
+	})
+}
@@ -0,0 +1,511 @@
+package bongoz
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operators a field may be filtered with using ?field[op]=value. They can be
+// combined, e.g. FilterEq | FilterIn.
+type FilterOp int
+
+const (
+	FilterEq FilterOp = 1 << iota
+	FilterNe
+	FilterLt
+	FilterLte
+	FilterGt
+	FilterGte
+	FilterIn
+	FilterNin
+	FilterExists
+	FilterRegex
+	// Inclusive range, ?field[between]=min,max
+	FilterBetween
+	// Length of an array
+	FilterSize
+	// Conditions on array elements, ?field[elemMatch]=op:value,... for
+	// arrays of values or field:op:value,... for arrays of documents
+	FilterElemMatch
+	// Geospatial operators for fields holding GeoJSON points, see
+	// buildGeoCondition for their values. Near queries return documents
+	// closest first, with their distance in Endpoint.DistanceField, which
+	// is required for them.
+	FilterNear
+	FilterWithinBox
+	FilterWithinPolygon
+	FilterWithinRadius
+
+	FilterComparison = FilterEq | FilterNe | FilterLt | FilterLte | FilterGt | FilterGte | FilterIn | FilterNin | FilterBetween
+	FilterAll        = FilterComparison | FilterExists | FilterRegex | FilterSize | FilterElemMatch
+	FilterGeo        = FilterNear | FilterWithinBox | FilterWithinPolygon | FilterWithinRadius
+)
+
+var filterOps = map[string]FilterOp{
+	"eq":        FilterEq,
+	"ne":        FilterNe,
+	"lt":        FilterLt,
+	"lte":       FilterLte,
+	"gt":        FilterGt,
+	"gte":       FilterGte,
+	"in":        FilterIn,
+	"nin":       FilterNin,
+	"exists":    FilterExists,
+	"regex":     FilterRegex,
+	"between":   FilterBetween,
+	"size":      FilterSize,
+	"elemMatch": FilterElemMatch,
+
+	"near":          FilterNear,
+	"withinBox":     FilterWithinBox,
+	"withinPolygon": FilterWithinPolygon,
+	"withinRadius":  FilterWithinRadius,
+}
+
+var (
+	objectIdType = reflect.TypeOf(bson.ObjectId(""))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// Split a filter parameter like intValue[gte] into the field name and the
+// operator. Parameters without brackets use eq.
+func parseFilterParam(param string) (string, string, bool) {
+	open := strings.Index(param, "[")
+	if open < 0 {
+		return param, "eq", true
+	}
+
+	if open == 0 || !strings.HasSuffix(param, "]") {
+		return "", "", false
+	}
+
+	return param[:open], param[open+1 : len(param)-1], true
+}
+
+// Check that Filters only names fields of the model, and that near filters
+// have a DistanceField to return distances in. Panics otherwise, when the
+// routes are registered.
+func (e *Endpoint) checkFilters() {
+	if len(e.Filters) == 0 {
+		return
+	}
+
+	instance := e.Factory()
+
+	for name, ops := range e.Filters {
+		if _, ok := resolveField(name, instance); !ok {
+			panic(fmt.Errorf("Unknown field %s in Filters", name))
+		}
+
+		if ops&FilterNear != 0 {
+			e.checkDistanceField()
+		}
+	}
+}
+
+// Find the filter spec for a field, by any of its names
+func (e *Endpoint) filterOpsFor(instance interface{}, field *resolvedField) (FilterOp, bool) {
+	for name, ops := range e.Filters {
+		resolved, ok := resolveField(name, instance)
+		if ok && resolved.Name == field.Name {
+			return ops, true
+		}
+	}
+
+	return 0, false
+}
+
+// Add the conditions of the filter parameters (see Endpoint.Filters) to q.
+// Parameters that are neither bracketed nor name a filterable field are left
+// alone, so they can be used for something else.
+func (e *Endpoint) addFiltersToQuery(instance interface{}, params url.Values, q bson.M) []*Error {
+	errs := []*Error{}
+
+	if len(e.Filters) == 0 {
+		return errs
+	}
+
+	// Sort the parameters so errors are reported in a stable order
+	keys := make([]string, 0, len(params))
+	for param := range params {
+		keys = append(keys, param)
+	}
+	sort.Strings(keys)
+
+	for _, param := range keys {
+		if stringInSlice(param, e.QueryParams) {
+			continue
+		}
+
+		name, op, ok := parseFilterParam(param)
+		bracketed := name != param
+
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, param, fmt.Sprintf(format, args...)))
+		}
+
+		if !ok {
+			fail("Invalid filter %s", param)
+			continue
+		}
+
+		field, found := resolveField(name, instance)
+
+		var allowed FilterOp
+		if found {
+			allowed, found = e.filterOpsFor(instance, field)
+		}
+
+		if !found {
+			if bracketed {
+				fail("Field %s can not be filtered", name)
+			}
+			continue
+		}
+
+		flag, known := filterOps[op]
+		if !known {
+			fail("Unknown operator %s", op)
+			continue
+		}
+
+		if allowed&flag == 0 {
+			fail("Operator %s is not allowed for field %s", op, name)
+			continue
+		}
+
+		typ := reflectValue(instance).Type().FieldByIndex(field.Index).Type
+
+		cond, err := buildFilterCondition(typ, op, params[param])
+		if err != nil {
+			fail("%s", err.Error())
+			continue
+		}
+
+		mergeCondition(q, field.BsonKey, cond)
+	}
+
+	return errs
+}
+
+// Build the condition for one operator. values are all values of the
+// parameter; list operators also accept comma separated values.
+func buildFilterCondition(typ reflect.Type, op string, values []string) (interface{}, error) {
+	if isListFilterOp(op) {
+		items := []string{}
+		for i, v := range values {
+			// Only in and nin combine repeated parameters
+			if op == "in" || op == "nin" || i == len(values)-1 {
+				items = append(items, strings.Split(v, ",")...)
+			}
+		}
+
+		return buildListFilterCondition(typ, op, items)
+	}
+
+	value := ""
+	if len(values) > 0 {
+		value = values[len(values)-1]
+	}
+
+	switch op {
+	case "eq", "ne", "lt", "lte", "gt", "gte":
+		coerced, err := coerceFilterValue(typ, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if op == "eq" {
+			return coerced, nil
+		}
+		return bson.M{"$" + op: coerced}, nil
+	case "exists":
+		exists, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid boolean %s", value)
+		}
+		return bson.M{"$exists": exists}, nil
+	case "regex":
+		err := checkRegex(value, defaultMaxRegexLength)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$regex": bson.RegEx{Pattern: value}}, nil
+	case "size":
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Invalid size %s", value)
+		}
+		return bson.M{"$size": size}, nil
+	case "elemMatch":
+		return buildElemMatch(typ, value)
+	}
+
+	return nil, fmt.Errorf("Unknown operator %s", op)
+}
+
+// Build the condition for a list operator from its separate items
+func buildListFilterCondition(typ reflect.Type, op string, items []string) (interface{}, error) {
+	switch op {
+	case "in", "nin":
+		list := []interface{}{}
+		for _, item := range items {
+			coerced, err := coerceFilterValue(typ, item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, coerced)
+		}
+		return bson.M{"$" + op: list}, nil
+	case "between":
+		if len(items) != 2 {
+			return nil, fmt.Errorf("between requires two values")
+		}
+
+		min, err := coerceFilterValue(typ, items[0])
+		if err != nil {
+			return nil, err
+		}
+		max, err := coerceFilterValue(typ, items[1])
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$gte": min, "$lte": max}, nil
+	case "near", "withinBox", "withinPolygon", "withinRadius":
+		return buildGeoCondition(op, strings.Join(items, ","))
+	}
+
+	return nil, fmt.Errorf("Unknown operator %s", op)
+}
+
+// Whether the value of an operator is a comma separated list
+func isListFilterOp(op string) bool {
+	switch op {
+	case "in", "nin", "between", "near", "withinBox", "withinPolygon", "withinRadius":
+		return true
+	}
+
+	return false
+}
+
+// Build an $elemMatch from op:value (or field:op:value for documents)
+// conditions separated by commas
+func buildElemMatch(typ reflect.Type, value string) (interface{}, error) {
+	elemType := indirectType(typ)
+	if elemType.Kind() != reflect.Slice && elemType.Kind() != reflect.Array {
+		return nil, fmt.Errorf("elemMatch requires an array field")
+	}
+	elemType = indirectType(elemType.Elem())
+
+	match := bson.M{}
+
+	for _, part := range strings.Split(value, ",") {
+		pieces := strings.SplitN(part, ":", 3)
+
+		condType := elemType
+		key := ""
+
+		if elemType.Kind() == reflect.Struct && elemType != timeType {
+			if len(pieces) != 3 {
+				return nil, fmt.Errorf("Invalid elemMatch condition %s, expected field:op:value", part)
+			}
+
+			field, ok := resolveFieldOfType(pieces[0], elemType, []int{})
+			if !ok {
+				return nil, fmt.Errorf("No such field: %s", pieces[0])
+			}
+
+			key = field.BsonKey
+			condType = elemType.FieldByIndex(field.Index).Type
+			pieces = pieces[1:]
+		} else {
+			pieces = strings.SplitN(part, ":", 2)
+			if len(pieces) != 2 {
+				return nil, fmt.Errorf("Invalid elemMatch condition %s, expected op:value", part)
+			}
+		}
+
+		switch pieces[0] {
+		case "eq", "ne", "lt", "lte", "gt", "gte", "regex", "exists":
+		default:
+			return nil, fmt.Errorf("Operator %s is not allowed in elemMatch", pieces[0])
+		}
+
+		cond, err := buildFilterCondition(condType, pieces[0], []string{pieces[1]})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(key) > 0 {
+			mergeCondition(match, key, cond)
+		} else if sub, ok := cond.(bson.M); ok {
+			for op, operand := range sub {
+				match[op] = operand
+			}
+		} else {
+			match["$eq"] = cond
+		}
+	}
+
+	return bson.M{"$elemMatch": match}, nil
+}
+
+const defaultMaxRegexLength = 100
+
+// Check a client supplied regular expression before it runs on the database.
+// Backreferences and nested quantifiers like (a+)+ can take exponential
+// time to fail with a backtracking engine, so they are rejected.
+func checkRegex(pattern string, maxLength int) error {
+	if len(pattern) > maxLength {
+		return fmt.Errorf("Regular expressions are limited to %d characters", maxLength)
+	}
+
+	for i := 0; i < len(pattern)-1; i++ {
+		if pattern[i] != '\\' {
+			continue
+		}
+		if next := pattern[i+1]; (next >= '1' && next <= '9') || next == 'k' || next == 'g' {
+			return fmt.Errorf("Backreferences are not allowed in regular expressions")
+		}
+		i++
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("Invalid regular expression %s", pattern)
+	}
+
+	if hasNestedRepeat(re, false) {
+		return fmt.Errorf("Nested quantifiers are not allowed in regular expressions")
+	}
+
+	return nil
+}
+
+func hasNestedRepeat(re *syntax.Regexp, repeated bool) bool {
+	repeat := false
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		repeat = true
+	case syntax.OpRepeat:
+		repeat = re.Max == -1 || re.Max > 1
+	}
+
+	if repeat && repeated {
+		return true
+	}
+
+	for _, sub := range re.Sub {
+		if hasNestedRepeat(sub, repeated || repeat) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func indirectType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	return typ
+}
+
+// Convert a query string value to the type of the field it is compared with.
+// Times are RFC 3339 or unix timestamps. Values compared with arrays are
+// converted to the element type.
+func coerceFilterValue(typ reflect.Type, value string) (interface{}, error) {
+	typ = indirectType(typ)
+
+	switch {
+	case typ == objectIdType:
+		if !bson.IsObjectIdHex(value) {
+			return nil, fmt.Errorf("Invalid object ID %s", value)
+		}
+		return bson.ObjectIdHex(value), nil
+	case typ == timeType:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(unix, 0), nil
+		}
+		return nil, fmt.Errorf("Invalid time %s, expected RFC 3339 or a unix timestamp", value)
+	}
+
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, typ.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid integer %s", value)
+		}
+		return parsed, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, typ.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid integer %s", value)
+		}
+		return parsed, nil
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, typ.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %s", value)
+		}
+		return parsed, nil
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid boolean %s", value)
+		}
+		return parsed, nil
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() != reflect.Uint8 {
+			return coerceFilterValue(typ.Elem(), value)
+		}
+	}
+
+	return value, nil
+}
+
+// Add a condition on key to a query, combining it with an existing one.
+// Operator documents are merged, anything else is combined with $and.
+func mergeCondition(q bson.M, key string, cond interface{}) {
+	existing, ok := q[key]
+	if !ok {
+		q[key] = cond
+		return
+	}
+
+	existingOps, existingIsOps := existing.(bson.M)
+	condOps, condIsOps := cond.(bson.M)
+
+	if existingIsOps && condIsOps && isOperatorDocument(existingOps) && isOperatorDocument(condOps) {
+		conflict := false
+		for op := range condOps {
+			if _, ok := existingOps[op]; ok {
+				conflict = true
+			}
+		}
+
+		if !conflict {
+			for op, operand := range condOps {
+				existingOps[op] = operand
+			}
+			return
+		}
+	}
+
+	delete(q, key)
+
+	and, _ := q["$and"].([]interface{})
+	q["$and"] = append(and, bson.M{key: existing}, bson.M{key: cond})
+}
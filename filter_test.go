@@ -0,0 +1,103 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilters(t *testing.T) {
+	Convey("Filters", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+		endpoint.Filters = map[string]FilterOp{
+			"intValue":  FilterComparison,
+			"arrValue":  FilterIn | FilterSize | FilterElemMatch,
+			"dateValue": FilterGte | FilterLt,
+			"idValue":   FilterEq,
+			"Content":   FilterEq | FilterRegex,
+		}
+
+		getQuery := func(rawQuery string) (bson.M, error) {
+			parsed, _ := url.Parse("http://localhost:8000?" + rawQuery)
+			return endpoint.getQuery(&http.Request{URL: parsed})
+		}
+
+		Convey("coerces values to the field type", func() {
+			query, err := getQuery("intValue[gte]=5&intValue[lt]=10&dateValue[gte]=2015-04-08T00:00:00Z&idValue=5525444a91692844dbfef192")
+
+			So(err, ShouldEqual, nil)
+			So(query["intValue"], ShouldResemble, bson.M{"$gte": int64(5), "$lt": int64(10)})
+			So(query["dateValue"], ShouldResemble, bson.M{"$gte": time.Date(2015, 4, 8, 0, 0, 0, 0, time.UTC)})
+			So(query["idValue"], ShouldEqual, bson.ObjectIdHex("5525444a91692844dbfef192"))
+		})
+		Convey("lists, ranges and arrays", func() {
+			query, err := getQuery("arrValue[in]=a,b&intValue[between]=1,3&arrValue[size]=2")
+
+			So(err, ShouldEqual, nil)
+			So(query["arrValue"], ShouldResemble, bson.M{"$in": []interface{}{"a", "b"}, "$size": 2})
+			So(query["intValue"], ShouldResemble, bson.M{"$gte": int64(1), "$lte": int64(3)})
+
+			query, err = getQuery("arrValue[elemMatch]=gte:b,lt:d")
+
+			So(err, ShouldEqual, nil)
+			So(query["arrValue"], ShouldResemble, bson.M{"$elemMatch": bson.M{"$gte": "b", "$lt": "d"}})
+		})
+		Convey("reports disallowed operators and bad values", func() {
+			_, err := getQuery("content[gt]=a&intValue[gte]=abc&randomMap[eq]=1&intValue[like]=1")
+
+			qerr, ok := err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(len(qerr.Errors), ShouldEqual, 4)
+			So(qerr.Errors[0].Message, ShouldEqual, "Operator gt is not allowed for field content")
+			So(qerr.Errors[1].Message, ShouldEqual, "Invalid integer abc")
+			So(qerr.Errors[2].Message, ShouldEqual, "Unknown operator like")
+			So(qerr.Errors[3].Message, ShouldEqual, "Field randomMap can not be filtered")
+		})
+		Convey("rejects regular expressions that can backtrack", func() {
+			_, err := getQuery("content[regex]=" + url.QueryEscape("(x+x+)+y"))
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldEqual, "Nested quantifiers are not allowed in regular expressions")
+
+			_, err = getQuery("content[regex]=" + url.QueryEscape(strings.Repeat("a", 101)))
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldEqual, "Regular expressions are limited to 100 characters")
+
+			query, err := getQuery("content[regex]=" + url.QueryEscape("^fo+"))
+			So(err, ShouldEqual, nil)
+			So(query["content"], ShouldResemble, bson.M{"$regex": bson.RegEx{Pattern: "^fo+"}})
+		})
+		Convey("filters list requests", func() {
+			So(store.Save(&Page{Content: "foo", IntValue: 3, ArrValue: []string{"a"}}), ShouldEqual, nil)
+			So(store.Save(&Page{Content: "bar", IntValue: 7, ArrValue: []string{"b", "c"}}), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequest("GET", "/api/pages?intValue[gt]=2&arrValue[in]=b", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			response := &listResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(len(response.Data), ShouldEqual, 1)
+			So(response.Data[0]["content"], ShouldEqual, "bar")
+		})
+		Convey("unknown fields panic when the routes are registered", func() {
+			endpoint.Filters["nope"] = FilterEq
+
+			So(func() { endpoint.GetRouter() }, ShouldPanic)
+		})
+	})
+}
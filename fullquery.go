@@ -0,0 +1,410 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operators allowed in ?_query by default
+var DefaultFullQueryOperators = []string{
+	"$and", "$or", "$nor", "$not",
+	"$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$in", "$nin",
+	"$exists", "$regex", "$options", "$all", "$size", "$elemMatch",
+}
+
+// Operators that can run code on the database server. They are rejected even
+// if they are listed in AllowedOperators.
+var bannedFullQueryOperators = []string{"$where", "$function", "$accumulator", "$expr"}
+
+// Limits for ?_query documents on endpoints with AllowFullQuery
+type FullQueryConfig struct {
+	// Defaults to DefaultFullQueryOperators if empty
+	AllowedOperators []string
+	BannedOperators  []string
+	// Fields (Go or bson name) that may be queried. Any field of the model
+	// except hidden ones is allowed if empty.
+	AllowedFields []string
+	// Nesting depth of documents and arrays, 5 by default
+	MaxDepth int
+	// Number of fields and operators in the whole query, 50 by default
+	MaxClauses int
+	// Length of $regex patterns, 100 by default. Patterns with nested
+	// quantifiers or backreferences are always rejected.
+	MaxRegexLength int
+}
+
+func (c *FullQueryConfig) maxDepth() int {
+	if c.MaxDepth > 0 {
+		return c.MaxDepth
+	}
+	return 5
+}
+
+func (c *FullQueryConfig) maxClauses() int {
+	if c.MaxClauses > 0 {
+		return c.MaxClauses
+	}
+	return 50
+}
+
+func (c *FullQueryConfig) maxRegexLength() int {
+	if c.MaxRegexLength > 0 {
+		return c.MaxRegexLength
+	}
+	return defaultMaxRegexLength
+}
+
+// Walks a client supplied query, building a clean bson.M and collecting
+// every violation along with its path
+type fullQueryValidator struct {
+	endpoint *Endpoint
+	config   *FullQueryConfig
+	instance interface{}
+	clauses  int
+	errs     []*Error
+}
+
+// Parse and validate the JSON of a ?_query parameter. Extended JSON $oid and
+// $date values are decoded. Returns a *QueryError naming the offending paths.
+func (e *Endpoint) parseFullQuery(raw string) (bson.M, error) {
+	var parsed map[string]interface{}
+
+	err := json.Unmarshal([]byte(raw), &parsed)
+	if err != nil {
+		return nil, &QueryError{[]*Error{NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "_query", "Invalid JSON in _query")}}
+	}
+
+	config := e.FullQuery
+	if config == nil {
+		config = &FullQueryConfig{}
+	}
+
+	v := &fullQueryValidator{
+		endpoint: e,
+		config:   config,
+		instance: e.Factory(),
+		errs:     []*Error{},
+	}
+
+	q := v.queryDocument(parsed, "", 1, true)
+
+	if len(v.errs) > 0 {
+		return nil, &QueryError{v.errs}
+	}
+
+	return q, nil
+}
+
+func (v *fullQueryValidator) fail(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, path, fmt.Sprintf(format, args...)))
+}
+
+func joinQueryPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func sortedKeys(doc map[string]interface{}) []string {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Count a clause and check the depth. Returns false if the walk should stop.
+func (v *fullQueryValidator) enter(path string, depth int) bool {
+	if depth > v.config.maxDepth() {
+		v.fail(path, "Query is nested deeper than %d levels", v.config.maxDepth())
+		return false
+	}
+
+	v.clauses++
+	if v.clauses == v.config.maxClauses()+1 {
+		v.fail(path, "Query has more than %d clauses", v.config.maxClauses())
+	}
+
+	return v.clauses <= v.config.maxClauses()
+}
+
+func (v *fullQueryValidator) checkOperator(op string, path string) bool {
+	allowed := v.config.AllowedOperators
+	if len(allowed) == 0 {
+		allowed = DefaultFullQueryOperators
+	}
+
+	if stringInSlice(op, bannedFullQueryOperators) || stringInSlice(op, v.config.BannedOperators) || !stringInSlice(op, allowed) {
+		v.fail(path, "Operator %s is not allowed", op)
+		return false
+	}
+
+	return true
+}
+
+// Check the first segment of a field path against the model and return the
+// path with that segment replaced by its bson key
+func (v *fullQueryValidator) checkField(key string, path string) (string, bool) {
+	segments := strings.SplitN(key, ".", 2)
+
+	field, ok := resolveField(segments[0], v.instance)
+	if !ok {
+		v.fail(path, "Unknown field %s", segments[0])
+		return "", false
+	}
+
+	allowedFields := v.config.AllowedFields
+	if v.endpoint.isHiddenField(v.instance, field) || len(allowedFields) > 0 && !stringInSlice(field.Name, allowedFields) && !stringInSlice(field.BsonKey, allowedFields) {
+		v.fail(path, "Field %s can not be queried", segments[0])
+		return "", false
+	}
+
+	segments[0] = field.BsonKey
+
+	return strings.Join(segments, "."), true
+}
+
+// A document of field conditions and logical operators. Fields are only
+// checked against the model at the top level (and in $and/$or/$nor), not
+// inside $elemMatch.
+func (v *fullQueryValidator) queryDocument(doc map[string]interface{}, path string, depth int, checkFields bool) bson.M {
+	out := bson.M{}
+
+	for _, key := range sortedKeys(doc) {
+		value := doc[key]
+		keyPath := joinQueryPath(path, key)
+
+		if !v.enter(keyPath, depth) {
+			continue
+		}
+
+		if strings.HasPrefix(key, "$") {
+			if !v.checkOperator(key, keyPath) {
+				continue
+			}
+
+			switch key {
+			case "$and", "$or", "$nor":
+				items, ok := value.([]interface{})
+				if !ok || len(items) == 0 {
+					v.fail(keyPath, "%s requires a non-empty array", key)
+					continue
+				}
+
+				clauses := []interface{}{}
+				for i, item := range items {
+					itemPath := joinQueryPath(keyPath, strconv.Itoa(i))
+
+					sub, ok := item.(map[string]interface{})
+					if !ok {
+						v.fail(itemPath, "%s requires an array of documents", key)
+						continue
+					}
+
+					clauses = append(clauses, v.queryDocument(sub, itemPath, depth+1, checkFields))
+				}
+				out[key] = clauses
+			default:
+				v.fail(keyPath, "Operator %s can not be used here", key)
+			}
+
+			continue
+		}
+
+		fieldKey := key
+		if checkFields {
+			var ok bool
+			fieldKey, ok = v.checkField(key, keyPath)
+			if !ok {
+				continue
+			}
+		}
+
+		out[fieldKey] = v.condition(value, keyPath, depth+1)
+	}
+
+	return out
+}
+
+// The value of a field: an operator document or a literal
+func (v *fullQueryValidator) condition(value interface{}, path string, depth int) interface{} {
+	if doc, ok := value.(map[string]interface{}); ok && isOperatorMap(doc) {
+		if decoded, ok := v.extendedJSON(doc, path); ok {
+			return decoded
+		}
+
+		return v.operators(doc, path, depth)
+	}
+
+	return v.literal(value, path, depth)
+}
+
+func (v *fullQueryValidator) operators(doc map[string]interface{}, path string, depth int) bson.M {
+	out := bson.M{}
+
+	for _, op := range sortedKeys(doc) {
+		operand := doc[op]
+		opPath := joinQueryPath(path, op)
+
+		if !v.enter(opPath, depth) || !v.checkOperator(op, opPath) {
+			continue
+		}
+
+		switch op {
+		case "$regex":
+			pattern, ok := operand.(string)
+			if !ok {
+				v.fail(opPath, "$regex requires a string")
+			} else if err := checkRegex(pattern, v.config.maxRegexLength()); err != nil {
+				v.fail(opPath, "%s", err.Error())
+			} else {
+				out[op] = pattern
+			}
+		case "$options":
+			options, ok := operand.(string)
+			if !ok || strings.Trim(options, "imsx") != "" {
+				v.fail(opPath, "Invalid regular expression options")
+			} else {
+				out[op] = options
+			}
+		case "$not":
+			sub, ok := operand.(map[string]interface{})
+			if !ok || !isOperatorMap(sub) {
+				v.fail(opPath, "$not requires an operator document")
+				continue
+			}
+			out[op] = v.operators(sub, opPath, depth+1)
+		case "$elemMatch":
+			sub, ok := operand.(map[string]interface{})
+			if !ok {
+				v.fail(opPath, "$elemMatch requires a document")
+			} else if isOperatorMap(sub) {
+				out[op] = v.operators(sub, opPath, depth+1)
+			} else {
+				out[op] = v.queryDocument(sub, opPath, depth+1, false)
+			}
+		case "$in", "$nin", "$all":
+			if _, ok := operand.([]interface{}); !ok {
+				v.fail(opPath, "%s requires an array", op)
+				continue
+			}
+			out[op] = v.literal(operand, opPath, depth+1)
+		case "$exists":
+			if _, ok := operand.(bool); !ok {
+				v.fail(opPath, "$exists requires a boolean")
+				continue
+			}
+			out[op] = operand
+		case "$size":
+			size, ok := operand.(float64)
+			if !ok || size < 0 || size != float64(int(size)) {
+				v.fail(opPath, "$size requires a non-negative integer")
+				continue
+			}
+			out[op] = int(size)
+		default:
+			out[op] = v.literal(operand, opPath, depth+1)
+		}
+	}
+
+	return out
+}
+
+// A plain value. Documents may only contain $ keys as extended JSON.
+func (v *fullQueryValidator) literal(value interface{}, path string, depth int) interface{} {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		if depth > v.config.maxDepth() {
+			v.fail(path, "Query is nested deeper than %d levels", v.config.maxDepth())
+			return nil
+		}
+
+		if decoded, ok := v.extendedJSON(val, path); ok {
+			return decoded
+		}
+
+		out := bson.M{}
+		for _, key := range sortedKeys(val) {
+			keyPath := joinQueryPath(path, key)
+			if strings.HasPrefix(key, "$") {
+				v.fail(keyPath, "Operator %s can not be used in a value", key)
+				continue
+			}
+			out[key] = v.literal(val[key], keyPath, depth+1)
+		}
+		return out
+	case []interface{}:
+		if depth > v.config.maxDepth() {
+			v.fail(path, "Query is nested deeper than %d levels", v.config.maxDepth())
+			return nil
+		}
+
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = v.literal(item, joinQueryPath(path, strconv.Itoa(i)), depth+1)
+		}
+		return out
+	}
+
+	return value
+}
+
+// Decode {"$oid": "..."} and {"$date": ...} values. Dates may be RFC 3339
+// strings, milliseconds since the epoch or {"$numberLong": "..."}.
+func (v *fullQueryValidator) extendedJSON(doc map[string]interface{}, path string) (interface{}, bool) {
+	if len(doc) != 1 {
+		return nil, false
+	}
+
+	if oid, ok := doc["$oid"]; ok {
+		hex, ok := oid.(string)
+		if !ok || !bson.IsObjectIdHex(hex) {
+			v.fail(joinQueryPath(path, "$oid"), "Invalid object ID")
+			return nil, true
+		}
+		return bson.ObjectIdHex(hex), true
+	}
+
+	if date, ok := doc["$date"]; ok {
+		datePath := joinQueryPath(path, "$date")
+
+		if long, ok := date.(map[string]interface{}); ok && len(long) == 1 {
+			date = long["$numberLong"]
+		}
+
+		switch d := date.(type) {
+		case string:
+			if t, err := time.Parse(time.RFC3339, d); err == nil {
+				return t, true
+			}
+			if ms, err := strconv.ParseInt(d, 10, 64); err == nil {
+				return millisToTime(ms), true
+			}
+		case float64:
+			return millisToTime(int64(d)), true
+		}
+
+		v.fail(datePath, "Invalid date")
+		return nil, true
+	}
+
+	return nil, false
+}
+
+func millisToTime(ms int64) time.Time {
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+func isOperatorMap(doc map[string]interface{}) bool {
+	return isOperatorDocument(bson.M(doc))
+}
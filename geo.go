@@ -0,0 +1,423 @@
+package bongoz
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Radius MongoDB uses to convert spherical distances to meters
+const earthRadius = 6378100.0
+
+// A $near condition taken out of a list query. It is run with $geoNear so
+// the distance of each document (in meters) can be returned in
+// DistanceField, and so the query can still be counted for pagination.
+type GeoNear struct {
+	// bson key of the field holding GeoJSON points
+	Field string
+	// Longitude and latitude
+	Point []float64
+	// In meters, 0 for no limit
+	MinDistance float64
+	MaxDistance float64
+
+	DistanceField string
+}
+
+func geoJSONPoint(coordinates []float64) bson.M {
+	return bson.M{"type": "Point", "coordinates": coordinates}
+}
+
+// Parse comma separated numbers
+func parseGeoNumbers(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	numbers := make([]float64, len(parts))
+
+	for i, part := range parts {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return nil, fmt.Errorf("Invalid number %s", part)
+		}
+		numbers[i] = parsed
+	}
+
+	return numbers, nil
+}
+
+func checkCoordinates(lng float64, lat float64) error {
+	if lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+		return fmt.Errorf("Invalid coordinates %v,%v, expected longitude,latitude", lng, lat)
+	}
+
+	return nil
+}
+
+func checkDistance(distance float64) error {
+	if distance < 0 {
+		return fmt.Errorf("Invalid distance %v", distance)
+	}
+
+	return nil
+}
+
+// Build the condition for a geo operator:
+//
+//	near=lng,lat[,maxMeters[,minMeters]]
+//	withinBox=lng,lat,lng,lat (two opposite corners)
+//	withinPolygon=lng,lat,lng,lat,lng,lat,...
+//	withinRadius=lng,lat,meters
+func buildGeoCondition(op string, value string) (interface{}, error) {
+	numbers, err := parseGeoNumbers(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "near":
+		if len(numbers) < 2 || len(numbers) > 4 {
+			return nil, errors.New("near requires longitude,latitude[,maxDistance[,minDistance]]")
+		}
+	case "withinBox":
+		if len(numbers) != 4 {
+			return nil, errors.New("withinBox requires two corners, longitude,latitude,longitude,latitude")
+		}
+	case "withinPolygon":
+		if len(numbers) < 6 || len(numbers)%2 != 0 {
+			return nil, errors.New("withinPolygon requires at least three longitude,latitude points")
+		}
+	case "withinRadius":
+		if len(numbers) != 3 {
+			return nil, errors.New("withinRadius requires longitude,latitude,distance")
+		}
+	}
+
+	// The other numbers of near and withinRadius are distances
+	pairs := len(numbers) / 2
+	if op == "near" || op == "withinRadius" {
+		pairs = 1
+	}
+
+	for i := 0; i < pairs; i++ {
+		err = checkCoordinates(numbers[2*i], numbers[2*i+1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch op {
+	case "near":
+		near := bson.M{"$geometry": geoJSONPoint(numbers[:2])}
+		if len(numbers) > 2 {
+			if err = checkDistance(numbers[2]); err != nil {
+				return nil, err
+			}
+			near["$maxDistance"] = numbers[2]
+		}
+		if len(numbers) > 3 {
+			if err = checkDistance(numbers[3]); err != nil {
+				return nil, err
+			}
+			near["$minDistance"] = numbers[3]
+		}
+		return bson.M{"$near": near}, nil
+	case "withinBox":
+		minLng, maxLng := math.Min(numbers[0], numbers[2]), math.Max(numbers[0], numbers[2])
+		minLat, maxLat := math.Min(numbers[1], numbers[3]), math.Max(numbers[1], numbers[3])
+
+		ring := [][]float64{{minLng, minLat}, {maxLng, minLat}, {maxLng, maxLat}, {minLng, maxLat}, {minLng, minLat}}
+		return geoWithinPolygon(ring), nil
+	case "withinPolygon":
+		ring := [][]float64{}
+		for i := 0; i < len(numbers); i += 2 {
+			ring = append(ring, numbers[i:i+2])
+		}
+
+		// GeoJSON rings end with their first point
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			ring = append(ring, first)
+		}
+		return geoWithinPolygon(ring), nil
+	case "withinRadius":
+		if err = checkDistance(numbers[2]); err != nil {
+			return nil, err
+		}
+		return bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{numbers[:2], numbers[2] / earthRadius}}}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown operator %s", op)
+}
+
+func geoWithinPolygon(ring [][]float64) bson.M {
+	return bson.M{"$geoWithin": bson.M{"$geometry": bson.M{
+		"type":        "Polygon",
+		"coordinates": [][][]float64{ring},
+	}}}
+}
+
+// Take the $near condition out of a query. $and clauses are searched as
+// well, since scope and soft delete filters are combined with $and.
+func splitGeoNear(query bson.M) (*GeoNear, bson.M) {
+	var near *GeoNear
+	rest := bson.M{}
+
+	for key, value := range query {
+		if key == "$and" {
+			clauses, ok := toSlice(value)
+			if !ok {
+				rest[key] = value
+				continue
+			}
+
+			split := make([]interface{}, len(clauses))
+			for i, clause := range clauses {
+				split[i] = clause
+
+				if clauseDoc, ok := toDocument(clause); ok {
+					found, clauseRest := splitGeoNear(clauseDoc)
+					if found != nil {
+						near = found
+					}
+					split[i] = clauseRest
+				}
+			}
+			rest[key] = split
+			continue
+		}
+
+		cond, ok := toDocument(value)
+		if !ok || cond["$near"] == nil {
+			rest[key] = value
+			continue
+		}
+
+		near = geoNearFromCondition(key, cond["$near"])
+
+		others := bson.M{}
+		for op, operand := range cond {
+			if op != "$near" {
+				others[op] = operand
+			}
+		}
+		if len(others) > 0 {
+			rest[key] = others
+		}
+	}
+
+	return near, rest
+}
+
+func geoNearFromCondition(field string, condition interface{}) *GeoNear {
+	near := &GeoNear{Field: field}
+
+	cond, _ := toDocument(condition)
+	geometry, _ := toDocument(cond["$geometry"])
+	near.Point, _ = geometry["coordinates"].([]float64)
+	near.MaxDistance, _ = toFloat(cond["$maxDistance"])
+	near.MinDistance, _ = toFloat(cond["$minDistance"])
+
+	return near
+}
+
+// Filter matching the same documents as the near query, for counting them
+func (n *GeoNear) countFilter() bson.M {
+	filters := []bson.M{{n.Field: bson.M{"$exists": true}}}
+
+	if n.MaxDistance > 0 {
+		filters = append(filters, bson.M{n.Field: n.within(n.MaxDistance)})
+	}
+
+	if n.MinDistance > 0 {
+		filters = append(filters, bson.M{"$nor": []bson.M{{n.Field: n.within(n.MinDistance)}}})
+	}
+
+	return andFilters(filters...)
+}
+
+func (n *GeoNear) within(distance float64) bson.M {
+	return bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{n.Point, distance / earthRadius}}}
+}
+
+// The $geoNear stage for the query
+func (n *GeoNear) stage(query bson.M) bson.M {
+	geoNear := bson.M{
+		"near":          geoJSONPoint(n.Point),
+		"key":           n.Field,
+		"distanceField": n.DistanceField,
+		"spherical":     true,
+		"query":         query,
+	}
+
+	if n.MaxDistance > 0 {
+		geoNear["maxDistance"] = n.MaxDistance
+	}
+
+	if n.MinDistance > 0 {
+		geoNear["minDistance"] = n.MinDistance
+	}
+
+	return bson.M{"$geoNear": geoNear}
+}
+
+// Endpoints with near filters must have a DistanceField, since the distance
+// is the point of them. Panics otherwise, see checkFilters.
+func (e *Endpoint) checkDistanceField() {
+	if len(e.DistanceField) == 0 {
+		panic(errors.New("Near filters require a DistanceField"))
+	}
+
+	if _, ok := resolveField(e.DistanceField, e.Factory()); !ok {
+		panic(fmt.Errorf("Unknown field %s in DistanceField", e.DistanceField))
+	}
+}
+
+// Run a near query with $geoNear, returning distances in DistanceField.
+// Results are sorted by distance unless the request passes _sort.
+func (e *Endpoint) addGeoNearToOptions(req *http.Request, near *GeoNear, options *FindOptions, selection *fieldSelection) *Error {
+	field, ok := resolveField(e.DistanceField, e.Factory())
+	if !ok {
+		return NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, near.Field, "Near filters are not enabled")
+	}
+
+	near.DistanceField = field.BsonKey
+
+	if options.Projection != nil {
+		options.Projection[field.BsonKey] = 1
+	}
+	if selection != nil {
+		selection.JSONKeys = append(selection.JSONKeys, field.JSONKey)
+	}
+
+	options.Near = near
+
+	if len(req.URL.Query().Get("_sort")) == 0 {
+		options.Sort = []string{near.DistanceField, "_id"}
+	}
+
+	return nil
+}
+
+// Longitude and latitude of a GeoJSON point or a legacy coordinate pair
+func geoPoint(value interface{}) ([]float64, bool) {
+	if doc, ok := toDocument(value); ok {
+		if doc["type"] != "Point" {
+			return nil, false
+		}
+		value = doc["coordinates"]
+	}
+
+	coordinates, ok := toSlice(value)
+	if !ok || len(coordinates) != 2 {
+		return nil, false
+	}
+
+	lng, lngOk := toFloat(coordinates[0])
+	lat, latOk := toFloat(coordinates[1])
+
+	return []float64{lng, lat}, lngOk && latOk
+}
+
+// Great circle distance in meters
+func geoDistance(a []float64, b []float64) float64 {
+	toRadians := func(degrees float64) float64 {
+		return degrees * math.Pi / 180
+	}
+
+	dLat := toRadians(b[1] - a[1])
+	dLng := toRadians(b[0] - a[0])
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRadians(a[1]))*math.Cos(toRadians(b[1]))*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+// Ray casting on the plane of longitudes and latitudes, which is close
+// enough for small polygons
+func pointInRing(point []float64, ring [][]float64) bool {
+	inside := false
+
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > point[1]) != (b[1] > point[1]) && point[0] < (b[0]-a[0])*(point[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Match $geoWithin with a $centerSphere or a GeoJSON polygon, for the memory
+// store
+func matchGeoWithin(value interface{}, operand interface{}) (bool, error) {
+	within, ok := toDocument(operand)
+	if !ok {
+		return false, errors.New("$geoWithin requires a document")
+	}
+
+	point, ok := geoPoint(value)
+	if !ok {
+		return false, nil
+	}
+
+	if sphere, ok := toSlice(within["$centerSphere"]); ok && len(sphere) == 2 {
+		center, _ := geoPoint(sphere[0])
+		radians, _ := toFloat(sphere[1])
+		return center != nil && geoDistance(point, center) <= radians*earthRadius, nil
+	}
+
+	if geometry, ok := toDocument(within["$geometry"]); ok && geometry["type"] == "Polygon" {
+		rings, _ := toSlice(geometry["coordinates"])
+		if len(rings) == 0 {
+			return false, errors.New("Polygon requires coordinates")
+		}
+
+		points, _ := toSlice(rings[0])
+		ring := [][]float64{}
+		for _, p := range points {
+			if parsed, ok := geoPoint(p); ok {
+				ring = append(ring, parsed)
+			}
+		}
+		return pointInRing(point, ring), nil
+	}
+
+	return false, errors.New("$geoWithin supports $centerSphere and Polygon geometries in the memory store")
+}
+
+// Keep the documents within the distances of a near query, with their
+// distance in DistanceField, closest first
+func applyGeoNear(docs []bson.M, near *GeoNear) []bson.M {
+	found := []bson.M{}
+
+	for _, doc := range docs {
+		value, _ := lookupPath(doc, near.Field)
+		point, ok := geoPoint(value)
+		if !ok {
+			continue
+		}
+
+		distance := geoDistance(near.Point, point)
+		if distance < near.MinDistance || near.MaxDistance > 0 && distance > near.MaxDistance {
+			continue
+		}
+
+		withDistance := bson.M{}
+		for key, value := range doc {
+			withDistance[key] = value
+		}
+		withDistance[near.DistanceField] = distance
+
+		found = append(found, withDistance)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i][near.DistanceField].(float64) < found[j][near.DistanceField].(float64)
+	})
+
+	return found
+}
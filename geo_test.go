@@ -0,0 +1,141 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type geoPointValue struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+type place struct {
+	bongo.DocumentBase `bson:",inline"`
+	Name               string         `json:"name" bson:"name"`
+	Location           *geoPointValue `json:"location" bson:"location"`
+	Distance           float64        `json:"distance,omitempty" bson:"distance,omitempty"`
+}
+
+func PlaceFactory() bongo.Document {
+	return &place{}
+}
+
+func newPlace(name string, lng float64, lat float64) *place {
+	return &place{Name: name, Location: &geoPointValue{"Point", []float64{lng, lat}}}
+}
+
+func TestGeoFilters(t *testing.T) {
+	Convey("Geo filters", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/places", nil, "places")
+		endpoint.Factory = PlaceFactory
+		endpoint.Store = store
+		endpoint.DistanceField = "Distance"
+		endpoint.Filters = map[string]FilterOp{
+			"location": FilterGeo,
+			"name":     FilterEq,
+		}
+
+		getQuery := func(rawQuery string) (bson.M, error) {
+			parsed, _ := url.Parse("http://localhost:8000?" + rawQuery)
+			return endpoint.getQuery(&http.Request{URL: parsed})
+		}
+
+		Convey("builds GeoJSON conditions", func() {
+			query, err := getQuery("location[withinBox]=1,2,0,0")
+
+			So(err, ShouldEqual, nil)
+			So(query["location"], ShouldResemble, bson.M{"$geoWithin": bson.M{"$geometry": bson.M{
+				"type":        "Polygon",
+				"coordinates": [][][]float64{{{0, 0}, {1, 0}, {1, 2}, {0, 2}, {0, 0}}},
+			}}})
+
+			query, err = getQuery("location[near]=13.4,52.5,1000")
+
+			So(err, ShouldEqual, nil)
+			So(query["location"], ShouldResemble, bson.M{"$near": bson.M{
+				"$geometry":    bson.M{"type": "Point", "coordinates": []float64{13.4, 52.5}},
+				"$maxDistance": 1000.0,
+			}})
+		})
+		Convey("validates coordinates", func() {
+			_, err := getQuery("location[near]=200,10&location[withinRadius]=1,2,-5&location[withinPolygon]=1,2,3,4")
+
+			qerr, ok := err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(len(qerr.Errors), ShouldEqual, 3)
+			So(qerr.Errors[0].Message, ShouldEqual, "Invalid coordinates 200,10, expected longitude,latitude")
+			So(qerr.Errors[1].Message, ShouldEqual, "withinPolygon requires at least three longitude,latitude points")
+			So(qerr.Errors[2].Message, ShouldEqual, "Invalid distance -5")
+
+			_, err = getQuery("or=" + url.QueryEscape("(location:near:1|2,name:eq:a)"))
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("lists places", func() {
+			So(store.Save(newPlace("far", 1, 1)), ShouldEqual, nil)
+			So(store.Save(newPlace("near", 0.01, 0)), ShouldEqual, nil)
+			So(store.Save(newPlace("nearer", 0.001, 0)), ShouldEqual, nil)
+			So(store.Save(&place{Name: "nowhere"}), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+
+			list := func(rawQuery string) (int, *listResponse) {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/api/places?"+rawQuery, nil)
+				router.ServeHTTP(w, req)
+
+				response := &listResponse{}
+				json.Unmarshal(w.Body.Bytes(), response)
+				return w.Code, response
+			}
+
+			Convey("closest first with their distance", func() {
+				code, response := list("location[near]=0,0,5000&_perPage=1&_page=2")
+
+				So(code, ShouldEqual, 200)
+				So(response.Pagination.TotalRecords, ShouldEqual, 2)
+				So(len(response.Data), ShouldEqual, 1)
+				So(response.Data[0]["name"], ShouldEqual, "near")
+				So(response.Data[0]["distance"], ShouldAlmostEqual, 1113, 1)
+			})
+			Convey("within a radius or polygon", func() {
+				code, response := list("location[withinRadius]=1,1,100")
+
+				So(code, ShouldEqual, 200)
+				So(len(response.Data), ShouldEqual, 1)
+				So(response.Data[0]["name"], ShouldEqual, "far")
+
+				code, response = list("location[withinPolygon]=-1,-1,0.005,-1,0.005,1")
+
+				So(code, ShouldEqual, 200)
+				So(len(response.Data), ShouldEqual, 1)
+				So(response.Data[0]["name"], ShouldEqual, "nearer")
+			})
+			Convey("only with a DistanceField", func() {
+				endpoint.DistanceField = ""
+
+				code, _ := list("location[near]=0,0")
+
+				So(code, ShouldEqual, 400)
+
+				So(func() { endpoint.GetRouter() }, ShouldPanic)
+
+				endpoint.DistanceField = "nope"
+				So(func() { endpoint.GetRouter() }, ShouldPanic)
+			})
+			Convey("not with cursors", func() {
+				code, _ := list("location[near]=0,0&_after=")
+
+				So(code, ShouldEqual, 400)
+			})
+		})
+	})
+}
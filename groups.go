@@ -0,0 +1,299 @@
+package bongoz
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Query parameters holding logical groups of filter conditions, e.g.
+// ?or=(status:eq:open,priority:gte:3). Groups nest with and(...), or(...)
+// and not(...); conditions use the operators of Endpoint.Filters. Values of
+// list operators like in and between are separated by |, and values
+// containing , | or ) can be quoted with "".
+var filterGroupParams = []string{"and", "or", "not"}
+
+const maxFilterGroupDepth = 5
+
+// A parsed group or condition
+type filterNode struct {
+	// and, or or not for groups
+	Group    string
+	Children []*filterNode
+
+	Field string
+	Op    string
+	Value string
+	// Items of list operators
+	Values []string
+}
+
+type filterGroupParser struct {
+	input string
+	pos   int
+}
+
+func parseFilterGroup(group string, input string) (*filterNode, error) {
+	p := &filterGroupParser{input: input}
+
+	node, err := p.group(group, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.input) {
+		return nil, p.errorf("Unexpected %q", p.input[p.pos:])
+	}
+
+	return node, nil
+}
+
+func (p *filterGroupParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *filterGroupParser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+
+	return p.input[p.pos]
+}
+
+func (p *filterGroupParser) expect(c byte) error {
+	if p.peek() != c {
+		if p.pos >= len(p.input) {
+			return p.errorf("Expected %q but the group ended", c)
+		}
+		return p.errorf("Expected %q", c)
+	}
+
+	p.pos++
+
+	return nil
+}
+
+// Read up to the next separator
+func (p *filterGroupParser) token(separators string) string {
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(separators, rune(p.input[p.pos])) {
+		p.pos++
+	}
+
+	return strings.TrimSpace(p.input[start:p.pos])
+}
+
+// ( item, item, ... )
+func (p *filterGroupParser) group(name string, depth int) (*filterNode, error) {
+	if depth > maxFilterGroupDepth {
+		return nil, p.errorf("Groups are nested deeper than %d levels", maxFilterGroupDepth)
+	}
+
+	err := p.expect('(')
+	if err != nil {
+		return nil, err
+	}
+
+	node := &filterNode{Group: name}
+
+	for {
+		child, err := p.item(depth)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, child)
+
+		if p.peek() == ',' {
+			p.pos++
+			continue
+		}
+
+		return node, p.expect(')')
+	}
+}
+
+// A nested group or a field:op:value condition
+func (p *filterGroupParser) item(depth int) (*filterNode, error) {
+	name := p.token(":(,)")
+
+	if p.peek() == '(' {
+		if !stringInSlice(name, filterGroupParams) {
+			return nil, p.errorf("Unknown group %s", name)
+		}
+
+		return p.group(name, depth+1)
+	}
+
+	if len(name) == 0 {
+		return nil, p.errorf("Expected a condition")
+	}
+
+	err := p.expect(':')
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.token(":,)")
+
+	err = p.expect(':')
+	if err != nil {
+		return nil, err
+	}
+
+	if isListFilterOp(op) {
+		values, err := p.values()
+		if err != nil {
+			return nil, err
+		}
+
+		return &filterNode{Field: name, Op: op, Values: values}, nil
+	}
+
+	value, err := p.value(",)")
+	if err != nil {
+		return nil, err
+	}
+
+	return &filterNode{Field: name, Op: op, Value: value}, nil
+}
+
+// value|value|...
+func (p *filterGroupParser) values() ([]string, error) {
+	values := []string{}
+
+	for {
+		value, err := p.value("|,)")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		if p.peek() != '|' {
+			return values, nil
+		}
+		p.pos++
+	}
+}
+
+// A plain value up to one of the separators or a quoted one
+func (p *filterGroupParser) value(separators string) (string, error) {
+	if p.peek() != '"' {
+		return p.token(separators), nil
+	}
+
+	p.pos++
+
+	var value []byte
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+
+		if c == '\\' && p.pos < len(p.input) {
+			value = append(value, p.input[p.pos])
+			p.pos++
+		} else if c == '"' {
+			return string(value), nil
+		} else {
+			value = append(value, c)
+		}
+	}
+
+	return "", p.errorf("Unterminated quoted value")
+}
+
+// Add the groups passed as and, or and not parameters to q
+func (e *Endpoint) addFilterGroupsToQuery(instance interface{}, params url.Values, q bson.M) []*Error {
+	errs := []*Error{}
+
+	for _, group := range filterGroupParams {
+		for _, value := range params[group] {
+			node, err := parseFilterGroup(group, value)
+			if err == nil {
+				var clause bson.M
+				clause, err = e.buildFilterNode(instance, node)
+				if err == nil {
+					for key, cond := range clause {
+						mergeCondition(q, key, cond)
+					}
+				}
+			}
+
+			if err != nil {
+				errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, group, err.Error()))
+			}
+		}
+	}
+
+	return errs
+}
+
+func (e *Endpoint) buildFilterNode(instance interface{}, node *filterNode) (bson.M, error) {
+	if len(node.Group) == 0 {
+		return e.buildFilterLeaf(instance, node)
+	}
+
+	clauses := make([]interface{}, len(node.Children))
+	for i, child := range node.Children {
+		clause, err := e.buildFilterNode(instance, child)
+		if err != nil {
+			return nil, err
+		}
+		clauses[i] = clause
+	}
+
+	switch node.Group {
+	case "or":
+		return bson.M{"$or": clauses}, nil
+	case "not":
+		if len(clauses) == 1 {
+			return bson.M{"$nor": clauses}, nil
+		}
+		return bson.M{"$nor": []interface{}{bson.M{"$and": clauses}}}, nil
+	}
+
+	return bson.M{"$and": clauses}, nil
+}
+
+func (e *Endpoint) buildFilterLeaf(instance interface{}, node *filterNode) (bson.M, error) {
+	field, found := resolveField(node.Field, instance)
+
+	var allowed FilterOp
+	if found {
+		allowed, found = e.filterOpsFor(instance, field)
+	}
+
+	if !found {
+		return nil, fmt.Errorf("Field %s can not be filtered", node.Field)
+	}
+
+	flag, known := filterOps[node.Op]
+	if !known {
+		return nil, fmt.Errorf("Unknown operator %s", node.Op)
+	}
+
+	if allowed&flag == 0 {
+		return nil, fmt.Errorf("Operator %s is not allowed for field %s", node.Op, node.Field)
+	}
+
+	// $near can only be used at the top level of a query
+	if node.Op == "near" {
+		return nil, fmt.Errorf("Operator near can not be used in a group")
+	}
+
+	typ := reflectValue(instance).Type().FieldByIndex(field.Index).Type
+
+	var cond interface{}
+	var err error
+	if isListFilterOp(node.Op) {
+		cond, err = buildListFilterCondition(typ, node.Op, node.Values)
+	} else {
+		cond, err = buildFilterCondition(typ, node.Op, []string{node.Value})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{field.BsonKey: cond}, nil
+}
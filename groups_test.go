@@ -0,0 +1,98 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFilterGroups(t *testing.T) {
+	Convey("Filter groups", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+		endpoint.QueryParams = []string{"$gte_intValue", "$lt_intValue"}
+		endpoint.Filters = map[string]FilterOp{
+			"intValue": FilterComparison,
+			"arrValue": FilterIn,
+			"Content":  FilterEq | FilterRegex,
+		}
+
+		getQuery := func(rawQuery string) (bson.M, error) {
+			parsed, _ := url.Parse("http://localhost:8000?" + rawQuery)
+			return endpoint.getQuery(&http.Request{URL: parsed})
+		}
+
+		Convey("merges query params on the same field", func() {
+			query, err := getQuery("$gte_intValue=3&$lt_intValue=8")
+
+			So(err, ShouldEqual, nil)
+			So(query["intValue"], ShouldResemble, bson.M{"$gte": 3, "$lt": 8})
+		})
+		Convey("parses nested groups", func() {
+			query, err := getQuery(url.Values{"or": {`(content:eq:"a,b",and(intValue:gte:3,not(arrValue:in:x|y)))`}}.Encode())
+
+			So(err, ShouldEqual, nil)
+			So(query, ShouldResemble, bson.M{"$or": []interface{}{
+				bson.M{"content": "a,b"},
+				bson.M{"$and": []interface{}{
+					bson.M{"intValue": bson.M{"$gte": int64(3)}},
+					bson.M{"$nor": []interface{}{bson.M{"arrValue": bson.M{"$in": []interface{}{"x", "y"}}}}},
+				}},
+			}})
+		})
+		Convey("keeps commas in quoted list values", func() {
+			query, err := getQuery(url.Values{"and": {`(arrValue:in:"a,b"|c|"d|e",intValue:between:1|"5")`}}.Encode())
+
+			So(err, ShouldEqual, nil)
+			So(query, ShouldResemble, bson.M{"$and": []interface{}{
+				bson.M{"arrValue": bson.M{"$in": []interface{}{"a,b", "c", "d|e"}}},
+				bson.M{"intValue": bson.M{"$gte": int64(1), "$lte": int64(5)}},
+			}})
+		})
+		Convey("reports syntax and filter errors", func() {
+			_, err := getQuery(url.Values{
+				"and": {"(intValue:gt:1"},
+				"or":  {"(intValue:like:1,content:eq:a)"},
+				"not": {"(randomMap:eq:1)"},
+			}.Encode())
+
+			qerr, ok := err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(len(qerr.Errors), ShouldEqual, 3)
+			So(qerr.Errors[0].Field, ShouldEqual, "and")
+			So(qerr.Errors[0].Message, ShouldEqual, "Expected ')' but the group ended at position 14")
+			So(qerr.Errors[1].Message, ShouldEqual, "Unknown operator like")
+			So(qerr.Errors[2].Message, ShouldEqual, "Field randomMap can not be filtered")
+
+			_, err = getQuery("or=" + url.QueryEscape("(or(or(or(or(or(intValue:eq:1))))))"))
+			qerr, ok = err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(qerr.Errors[0].Message, ShouldStartWith, "Groups are nested deeper than 5 levels")
+		})
+		Convey("filters list requests", func() {
+			So(store.Save(&Page{Content: "foo", IntValue: 3}), ShouldEqual, nil)
+			So(store.Save(&Page{Content: "bar", IntValue: 7}), ShouldEqual, nil)
+			So(store.Save(&Page{Content: "baz", IntValue: 1}), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequest("GET", "/api/pages?or="+url.QueryEscape("(content:eq:foo,intValue:gte:5)"), nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			response := &listResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(len(response.Data), ShouldEqual, 2)
+		})
+	})
+}
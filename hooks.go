@@ -0,0 +1,119 @@
+package bongoz
+
+import (
+	"errors"
+	"github.com/maxwellhealth/bongo"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+)
+
+// Typed hooks run by the handlers around each operation. Unlike middleware
+// they see the decoded documents and may modify them. Returning an error
+// aborts the request; use a *HookError or an *Error to choose the status code.
+// Any other error results in a 500, except for *bongo.ValidationError which
+// is a 400. AfterCreate, AfterUpdate and AfterDelete run once the write
+// succeeded, so their errors are only logged and the request still succeeds.
+type Hooks struct {
+	BeforeCreate func(req *http.Request, doc bongo.Document) error
+	AfterCreate  func(req *http.Request, doc bongo.Document) error
+	// Receives a copy of the stored document along with the one the request
+	// body was applied to
+	BeforeUpdate func(req *http.Request, original bongo.Document, doc bongo.Document) error
+	AfterUpdate  func(req *http.Request, doc bongo.Document) error
+	BeforeDelete func(req *http.Request, doc bongo.Document) error
+	AfterDelete  func(req *http.Request, doc bongo.Document) error
+	// Run for every document returned by HandleReadList and HandleReadOne
+	AfterRead func(req *http.Request, doc bongo.Document) error
+}
+
+type HookError struct {
+	Status int
+	Err    error
+}
+
+func NewHookError(status int, message string) *HookError {
+	return &HookError{status, errors.New(message)}
+}
+
+func (e *HookError) Error() string {
+	return e.Err.Error()
+}
+
+func (h *Hooks) beforeCreate(req *http.Request, doc bongo.Document) error {
+	if h.BeforeCreate == nil {
+		return nil
+	}
+	return h.BeforeCreate(req, doc)
+}
+
+func (h *Hooks) afterCreate(req *http.Request, doc bongo.Document) error {
+	if h.AfterCreate == nil {
+		return nil
+	}
+	return h.AfterCreate(req, doc)
+}
+
+func (h *Hooks) beforeUpdate(req *http.Request, original bongo.Document, doc bongo.Document) error {
+	if h.BeforeUpdate == nil {
+		return nil
+	}
+	return h.BeforeUpdate(req, original, doc)
+}
+
+func (h *Hooks) afterUpdate(req *http.Request, doc bongo.Document) error {
+	if h.AfterUpdate == nil {
+		return nil
+	}
+	return h.AfterUpdate(req, doc)
+}
+
+func (h *Hooks) beforeDelete(req *http.Request, doc bongo.Document) error {
+	if h.BeforeDelete == nil {
+		return nil
+	}
+	return h.BeforeDelete(req, doc)
+}
+
+func (h *Hooks) afterDelete(req *http.Request, doc bongo.Document) error {
+	if h.AfterDelete == nil {
+		return nil
+	}
+	return h.AfterDelete(req, doc)
+}
+
+// Log the error of a hook run after a write, which can no longer fail the
+// request
+func logAfterHookError(req *http.Request, hook string, err error) {
+	if err != nil {
+		log.Printf("bongoz: %s hook failed for %s %s: %s", hook, req.Method, req.URL.Path, err)
+	}
+}
+
+func (h *Hooks) afterRead(req *http.Request, doc bongo.Document) error {
+	if h.AfterRead == nil {
+		return nil
+	}
+	return h.AfterRead(req, doc)
+}
+
+// Copy of a document to hand to BeforeUpdate as the original. Only made if
+// the hook is set.
+func (e *Endpoint) originalForUpdate(doc bongo.Document) bongo.Document {
+	if e.Hooks.BeforeUpdate == nil {
+		return nil
+	}
+
+	marshaled, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+
+	original := e.Factory()
+	err = bson.Unmarshal(marshaled, original)
+	if err != nil {
+		panic(err)
+	}
+
+	return original
+}
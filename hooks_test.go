@@ -0,0 +1,134 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	conn := getConnection()
+	collection := conn.Collection("pages")
+	defer conn.Session.Close()
+
+	Convey("Hooks", t, func() {
+		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		endpoint.Factory = Factory
+
+		Convey("before create can modify the document", func() {
+			endpoint.Hooks.BeforeCreate = func(req *http.Request, doc bongo.Document) error {
+				doc.(*Page).Content = req.Header.Get("X-User")
+				return nil
+			}
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/pages", strings.NewReader(`{"content":"foo"}`))
+			req.Header.Set("X-User", "bob")
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+
+			response := &singleResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data["content"], ShouldEqual, "bob")
+		})
+		Convey("before update can abort with a status", func() {
+			endpoint.Hooks.BeforeUpdate = func(req *http.Request, original bongo.Document, doc bongo.Document) error {
+				if original.(*Page).IntValue != doc.(*Page).IntValue {
+					return NewHookError(422, "IntValue can not change")
+				}
+				return nil
+			}
+
+			obj := &Page{IntValue: 5}
+			err := collection.Save(obj)
+			So(err, ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PUT", strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/"), strings.NewReader(`{"intValue":6}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 422)
+			So(w.Body.String(), ShouldEqual, "{\"errors\":[{\"code\":\"rejected\",\"message\":\"IntValue can not change\"}]}")
+		})
+		Convey("after read can redact documents", func() {
+			endpoint.Hooks.AfterRead = func(req *http.Request, doc bongo.Document) error {
+				doc.(*Page).Content = "redacted"
+				return nil
+			}
+
+			err := collection.Save(&Page{Content: "foo"})
+			So(err, ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages", nil)
+			router.ServeHTTP(w, req)
+
+			response := &listResponse{}
+			err = json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data[0]["content"], ShouldEqual, "redacted")
+		})
+		Convey("after hooks can not fail a write", func() {
+			endpoint.Store = NewMemoryStore()
+			failed := []string{}
+			fail := func(req *http.Request, doc bongo.Document) error {
+				failed = append(failed, req.Method)
+				return errors.New("Notification failed")
+			}
+			endpoint.Hooks.AfterCreate = fail
+			endpoint.Hooks.AfterUpdate = fail
+			endpoint.Hooks.AfterDelete = fail
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/pages", strings.NewReader(`{"content":"foo"}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+
+			response := &singleResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			uri := "/api/pages/" + response.Data["_id"].(string)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("PUT", uri, strings.NewReader(`{"content":"bar"}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("PATCH", uri, strings.NewReader(`{"content":"baz"}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", uri, nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+			So(failed, ShouldResemble, []string{"POST", "PUT", "PATCH", "DELETE"})
+
+			count, err := endpoint.Store.Count(bson.M{})
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongoz").DropDatabase()
+		})
+	})
+}
@@ -0,0 +1,602 @@
+package bongoz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/bongo"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"gopkg.in/mgo.v2/bson"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const JSONPatchContentType = "application/json-patch+json"
+
+// A single JSON Patch (RFC 6902) operation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+
+	// Set when a decoded operation has no value, which is not the same as
+	// a null one
+	missingValue bool
+}
+
+// Decode an operation, with the numbers of its value as json.Numbers
+func (op *PatchOperation) UnmarshalJSON(data []byte) error {
+	type plainOperation PatchOperation
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	decoded := plainOperation{}
+	err := decoder.Decode(&decoded)
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	_, hasValue := fields["value"]
+	decoded.missingValue = !hasValue
+
+	*op = PatchOperation(decoded)
+	return nil
+}
+
+// Returned when a patch document is malformed or cannot be applied
+type InvalidPatchError struct {
+	Index   int
+	Message string
+}
+
+func (e *InvalidPatchError) Error() string {
+	return fmt.Sprintf("Invalid patch operation %d: %s", e.Index, e.Message)
+}
+
+// Returned when a "test" operation does not match the document
+type PatchTestFailedError struct {
+	Index int
+	Path  string
+}
+
+func (e *PatchTestFailedError) Error() string {
+	return fmt.Sprintf("Patch test operation %d failed for path %s", e.Index, e.Path)
+}
+
+func isJSONPatchRequest(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == JSONPatchContentType
+}
+
+// Split a JSON pointer (RFC 6901) into its unescaped reference tokens
+func parsePointer(path string) ([]string, error) {
+	if len(path) == 0 {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("Path must start with /")
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for i, token := range tokens {
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+// Reject operations reading or writing fields hidden by FieldHidden, which
+// would let test, copy and move reveal their values. A test of the whole
+// document compares them too.
+func (e *Endpoint) checkHiddenPatchPaths(doc interface{}, operations []PatchOperation) error {
+	hidden := e.fieldsWithPolicy(doc, FieldHidden)
+	if len(hidden) == 0 {
+		return nil
+	}
+
+	for i, op := range operations {
+		paths := []string{op.Path}
+		if op.Op == "move" || op.Op == "copy" {
+			paths = append(paths, op.From)
+		}
+
+		for _, path := range paths {
+			tokens, err := parsePointer(path)
+			if err != nil {
+				continue
+			}
+
+			if len(tokens) == 0 {
+				return &InvalidPatchError{i, "Operations on the document root are not supported"}
+			}
+
+			for _, field := range hidden {
+				if tokens[0] == field.JSONKey {
+					return &InvalidPatchError{i, fmt.Sprintf("Path %s does not exist", path)}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply the operations to the JSON representation of the document and decode
+// the result back into it. The document is only touched if every operation
+// succeeded.
+func applyJSONPatchToDocument(doc bongo.Document, operations []PatchOperation) error {
+	tree, err := toJSONValue(doc)
+	if err != nil {
+		return err
+	}
+
+	for i, op := range operations {
+		tree, err = applyPatchOperation(tree, op)
+		if err != nil {
+			if perr, ok := err.(*PatchTestFailedError); ok {
+				perr.Index = i
+				return perr
+			}
+			return &InvalidPatchError{i, err.Error()}
+		}
+	}
+
+	return decodeJSONDocument(tree, doc)
+}
+
+func applyPatchOperation(tree interface{}, op PatchOperation) (interface{}, error) {
+	tokens, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if op.missingValue && (op.Op == "add" || op.Op == "replace" || op.Op == "test") {
+		return nil, fmt.Errorf("Operation %s requires a value", op.Op)
+	}
+
+	if op.Op == "test" {
+		value, err := getPointerValue(tree, tokens)
+		if err != nil {
+			return nil, err
+		}
+
+		if !jsonValuesEqual(value, op.Value) {
+			return nil, &PatchTestFailedError{Path: op.Path}
+		}
+		return tree, nil
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("Operations on the document root are not supported")
+	}
+
+	switch op.Op {
+	case "add":
+		return addPointerValue(tree, tokens, op.Value)
+	case "remove":
+		tree, _, err = removePointerValue(tree, tokens)
+		return tree, err
+	case "replace":
+		return replacePointerValue(tree, tokens, op.Value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, errors.New("Cannot move a value into one of its children")
+			}
+			tree, value, err = removePointerValue(tree, from)
+		} else {
+			value, err = getPointerValue(tree, from)
+			if err == nil {
+				value, err = copyJSONValue(value)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		return addPointerValue(tree, tokens, value)
+	}
+
+	return nil, fmt.Errorf("Unknown operation %q", op.Op)
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("Invalid array index %q", token)
+	}
+
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+
+	if idx > max {
+		return 0, fmt.Errorf("Array index %d out of bounds", idx)
+	}
+
+	return idx, nil
+}
+
+// Walk down to the parent of the last token and let fn modify it. Returns the
+// (possibly reallocated) container so slices can grow and shrink.
+func modifyPointerParent(tree interface{}, tokens []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(tree, tokens[0])
+	}
+
+	switch container := tree.(type) {
+	case map[string]interface{}:
+		child, ok := container[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("Path segment %q not found", tokens[0])
+		}
+
+		child, err := modifyPointerParent(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		container[tokens[0]] = child
+		return container, nil
+	case []interface{}:
+		idx, err := arrayIndex(tokens[0], len(container), false)
+		if err != nil {
+			return nil, err
+		}
+
+		child, err := modifyPointerParent(container[idx], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		container[idx] = child
+		return container, nil
+	}
+
+	return nil, fmt.Errorf("Path segment %q does not point into an object or array", tokens[0])
+}
+
+func getPointerValue(tree interface{}, tokens []string) (interface{}, error) {
+	current := tree
+	for _, token := range tokens {
+		switch container := current.(type) {
+		case map[string]interface{}:
+			child, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("Path segment %q not found", token)
+			}
+			current = child
+		case []interface{}:
+			idx, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			current = container[idx]
+		default:
+			return nil, fmt.Errorf("Path segment %q does not point into an object or array", token)
+		}
+	}
+
+	return current, nil
+}
+
+func addPointerValue(tree interface{}, tokens []string, value interface{}) (interface{}, error) {
+	return modifyPointerParent(tree, tokens, func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[key] = value
+			return container, nil
+		case []interface{}:
+			idx, err := arrayIndex(key, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+
+			container = append(container, nil)
+			copy(container[idx+1:], container[idx:])
+			container[idx] = value
+			return container, nil
+		}
+
+		return nil, fmt.Errorf("Cannot add %q to a scalar value", key)
+	})
+}
+
+func replacePointerValue(tree interface{}, tokens []string, value interface{}) (interface{}, error) {
+	return modifyPointerParent(tree, tokens, func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := container[key]; !ok {
+				return nil, fmt.Errorf("Path segment %q not found", key)
+			}
+			container[key] = value
+			return container, nil
+		case []interface{}:
+			idx, err := arrayIndex(key, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			container[idx] = value
+			return container, nil
+		}
+
+		return nil, fmt.Errorf("Cannot replace %q in a scalar value", key)
+	})
+}
+
+func removePointerValue(tree interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("Cannot remove the document root")
+	}
+
+	var removed interface{}
+	tree, err := modifyPointerParent(tree, tokens, func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			value, ok := container[key]
+			if !ok {
+				return nil, fmt.Errorf("Path segment %q not found", key)
+			}
+			removed = value
+			delete(container, key)
+			return container, nil
+		case []interface{}:
+			idx, err := arrayIndex(key, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = container[idx]
+			return append(container[:idx], container[idx+1:]...), nil
+		}
+
+		return nil, fmt.Errorf("Cannot remove %q from a scalar value", key)
+	})
+
+	return tree, removed, err
+}
+
+func copyJSONValue(value interface{}) (interface{}, error) {
+	return toJSONValue(value)
+}
+
+// Compare decoded JSON values the way test does, numbers by their value
+func jsonValuesEqual(a interface{}, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		i, xErr := x.Int64()
+		j, yErr := y.Int64()
+		if xErr == nil && yErr == nil {
+			return i == j
+		}
+		return jsonFloat(x) == jsonFloat(y)
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonValuesEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, ok := y[key]
+			if !ok || !jsonValuesEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func jsonFloat(n json.Number) float64 {
+	f, _ := n.Float64()
+	return f
+}
+
+// Encode a document into a bson.M so it can be compared and looked up by path
+func encodeBson(doc interface{}) (bson.M, error) {
+	marshaled, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := bson.M{}
+	err = bson.Unmarshal(marshaled, &encoded)
+	return encoded, err
+}
+
+// Save a document after a JSON Patch has been applied to it. When every
+// operation maps onto a MongoDB update operator the patch is sent as
+// $set/$unset/$push, so concurrent edits elsewhere in the document (including
+// other elements of the same array) survive. Other patches fall back to
+// savePartial. before is the bson encoding of the document prior to patching,
+// condition the one of checkIfMatch.
+func (e *Endpoint) saveJSONPatch(store Store, doc bongo.Document, before bson.M, condition bson.M, operations []PatchOperation) error {
+	after, err := encodeBson(doc)
+	if err != nil {
+		return err
+	}
+
+	update, ok := buildJSONPatchUpdate(before, after, operations)
+	if !ok {
+		return e.savePartial(store, doc, before, condition)
+	}
+
+	err = store.BeforeSave(doc)
+	if err != nil {
+		return err
+	}
+
+	// A BeforeSave hook that changed the document makes the operations an
+	// incomplete description of the write
+	hooked, err := encodeBson(doc)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(hooked, after) {
+		err = writeWithUpdate(store, doc, before, condition)
+	} else if len(update) > 0 {
+		err = store.Update(doc.GetId(), condition, update)
+	}
+	if err != nil {
+		return err
+	}
+
+	return store.AfterSave(doc)
+}
+
+// Translate patch operations into a MongoDB update document. Returns false if
+// any operation cannot be expressed as an update operator. Top level fields
+// that changed without being named in the patch (e.g. a modified timestamp)
+// are added as plain $set/$unset.
+func buildJSONPatchUpdate(before bson.M, after bson.M, operations []PatchOperation) (bson.M, bool) {
+	set := bson.M{}
+	unset := bson.M{}
+	pushCounts := map[string]int{}
+	paths := []string{}
+	covered := map[string]bool{}
+
+	for _, op := range operations {
+		if op.Op == "test" {
+			continue
+		}
+
+		tokens, err := parsePointer(op.Path)
+		if err != nil || len(tokens) == 0 || tokens[0] == "_id" {
+			return nil, false
+		}
+
+		appending := op.Op == "add" && tokens[len(tokens)-1] == "-"
+		if appending {
+			tokens = tokens[:len(tokens)-1]
+			if len(tokens) == 0 {
+				return nil, false
+			}
+		}
+
+		for _, token := range tokens {
+			if _, err := strconv.Atoi(token); err == nil || len(token) == 0 || strings.ContainsAny(token, ".$") {
+				return nil, false
+			}
+		}
+
+		path := strings.Join(tokens, ".")
+
+		switch op.Op {
+		case "add", "replace":
+			value, ok := lookupPath(after, path)
+			if !ok {
+				return nil, false
+			}
+
+			if appending {
+				if _, ok := value.([]interface{}); !ok {
+					return nil, false
+				}
+				pushCounts[path]++
+			} else {
+				set[path] = value
+			}
+		case "remove":
+			if _, ok := lookupPath(before, path); !ok {
+				return nil, false
+			}
+			// The removal was reverted, e.g. by a field policy
+			if _, ok := lookupPath(after, path); ok {
+				return nil, false
+			}
+			unset[path] = ""
+		default:
+			return nil, false
+		}
+
+		if !appending || pushCounts[path] == 1 {
+			paths = append(paths, path)
+		}
+		covered[tokens[0]] = true
+	}
+
+	// MongoDB refuses updates touching the same path twice
+	for i, a := range paths {
+		for j, b := range paths {
+			if i != j && (a == b || strings.HasPrefix(b, a+".")) {
+				return nil, false
+			}
+		}
+	}
+
+	push := bson.M{}
+	for path, count := range pushCounts {
+		value, _ := lookupPath(after, path)
+		arr := value.([]interface{})
+		if count > len(arr) {
+			return nil, false
+		}
+		push[path] = bson.M{"$each": arr[len(arr)-count:]}
+	}
+
+	for key, value := range after {
+		if key != "_id" && !covered[key] && !reflect.DeepEqual(before[key], value) {
+			set[key] = value
+		}
+	}
+
+	for key := range before {
+		if _, ok := after[key]; !ok && !covered[key] {
+			unset[key] = ""
+		}
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(push) > 0 {
+		update["$push"] = push
+	}
+
+	return update, true
+}
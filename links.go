@@ -0,0 +1,109 @@
+package bongoz
+
+import (
+	"fmt"
+	"github.com/maxwellhealth/bongo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A hypermedia link of a response, as in HAL
+type Link struct {
+	Href string `json:"href"`
+}
+
+// Convert links by relation to HAL links
+func halLinks(links map[string]string) map[string]*Link {
+	converted := map[string]*Link{}
+	for rel, uri := range links {
+		converted[rel] = &Link{uri}
+	}
+
+	return converted
+}
+
+// HAL links of a response with a single document
+func (e *Endpoint) documentLinks(doc bongo.Document) map[string]*Link {
+	return map[string]*Link{"self": {e.documentURI(doc.GetId().Hex())}}
+}
+
+// URI of a document of the endpoint
+func (e *Endpoint) documentURI(id string) string {
+	return strings.TrimSuffix(e.Uri, "/") + "/" + id
+}
+
+// Links to the first, previous, next and last page of a list, by relation.
+// Lists with limit and skip are a single page and have none.
+func listLinks(req *http.Request, pagination interface{}) map[string]string {
+	links := map[string]string{}
+	params := req.URL.Query()
+
+	switch info := pagination.(type) {
+	case *bongo.PaginationInfo:
+		for _, param := range []string{"_limit", "_skip", "_export"} {
+			if _, ok := params[param]; ok {
+				return links
+			}
+		}
+
+		if info.TotalPages == 0 {
+			return links
+		}
+
+		page := func(n int) string {
+			return linkURI(req, "_page", strconv.Itoa(n), "")
+		}
+
+		links["first"] = page(1)
+		links["last"] = page(info.TotalPages)
+		if info.Current > 1 {
+			links["prev"] = page(info.Current - 1)
+		}
+		if info.Current < info.TotalPages {
+			links["next"] = page(info.Current + 1)
+		}
+	case *CursorPaginationInfo:
+		// An empty _after starts at the beginning, an empty _before at the end
+		links["first"] = linkURI(req, "_after", "", "_before")
+		links["last"] = linkURI(req, "_before", "", "_after")
+		if len(info.Prev) > 0 {
+			links["prev"] = linkURI(req, "_before", info.Prev, "_after")
+		}
+		if len(info.Next) > 0 {
+			links["next"] = linkURI(req, "_after", info.Next, "_before")
+		}
+	}
+
+	return links
+}
+
+// The request URI with param set to value and the remove parameter removed
+func linkURI(req *http.Request, param string, value string, remove string) string {
+	u := *req.URL
+	params := u.Query()
+
+	params.Set(param, value)
+	if len(remove) > 0 {
+		params.Del(remove)
+	}
+
+	u.RawQuery = params.Encode()
+
+	return u.RequestURI()
+}
+
+// Set the Link header (RFC 8288) of the given links
+func setLinkHeader(w http.ResponseWriter, links map[string]string) {
+	values := []string{}
+
+	for _, rel := range []string{"first", "prev", "next", "last"} {
+		if uri, ok := links[rel]; ok {
+			values = append(values, fmt.Sprintf(`<%s>; rel="%s"`, uri, rel))
+		}
+	}
+
+	if len(values) > 0 {
+		w.Header().Set("Link", strings.Join(values, ", "))
+	}
+}
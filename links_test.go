@@ -0,0 +1,95 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type linksResponse struct {
+	Data  interface{}
+	Links map[string]*Link `json:"_links"`
+}
+
+func TestLinks(t *testing.T) {
+	Convey("HAL links", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+		endpoint.Pagination.PerPage = 1
+
+		pages := []*Page{}
+		for _, content := range []string{"a", "b", "c"} {
+			page := &Page{Content: content}
+			So(store.Save(page), ShouldEqual, nil)
+			pages = append(pages, page)
+		}
+
+		router := endpoint.GetRouter()
+
+		send := func(method string, url string, body string) (*httptest.ResponseRecorder, *linksResponse) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, strings.NewReader(body))
+			router.ServeHTTP(w, req)
+
+			response := &linksResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			return w, response
+		}
+
+		hrefs := func(response *linksResponse) map[string]string {
+			links := map[string]string{}
+			for rel, link := range response.Links {
+				links[rel] = link.Href
+			}
+			return links
+		}
+
+		Convey("of lists", func() {
+			_, response := send("GET", "/api/pages?_sort=content&_page=2", "")
+
+			So(hrefs(response), ShouldResemble, map[string]string{
+				"self":  "/api/pages?_sort=content&_page=2",
+				"first": "/api/pages?_page=1&_sort=content",
+				"prev":  "/api/pages?_page=1&_sort=content",
+				"next":  "/api/pages?_page=3&_sort=content",
+				"last":  "/api/pages?_page=3&_sort=content",
+			})
+		})
+		Convey("of streamed lists", func() {
+			endpoint.StreamLists = true
+
+			_, response := send("GET", "/api/pages?_sort=content", "")
+
+			links := hrefs(response)
+			So(links["self"], ShouldEqual, "/api/pages?_sort=content")
+			So(links["next"], ShouldEqual, "/api/pages?_page=2&_sort=content")
+			So(links, ShouldNotContainKey, "prev")
+		})
+		Convey("of lists with limit and skip", func() {
+			_, response := send("GET", "/api/pages?_limit=2", "")
+
+			So(hrefs(response), ShouldResemble, map[string]string{"self": "/api/pages?_limit=2"})
+		})
+		Convey("of documents", func() {
+			_, response := send("GET", "/api/pages/"+pages[1].Id.Hex(), "")
+
+			So(hrefs(response), ShouldResemble, map[string]string{"self": "/api/pages/" + pages[1].Id.Hex()})
+		})
+		Convey("of created documents", func() {
+			w, response := send("POST", "/api/pages", `{"content":"d"}`)
+
+			So(w.Code, ShouldEqual, 201)
+
+			self := hrefs(response)["self"]
+			So(self, ShouldStartWith, "/api/pages/")
+			So(len(self), ShouldEqual, len("/api/pages/")+24)
+			So(w.Header().Get("Location"), ShouldEqual, self)
+		})
+	})
+}
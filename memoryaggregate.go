@@ -0,0 +1,310 @@
+package bongoz
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"time"
+)
+
+// Layouts for the $dateToString format specifiers
+var dateToStringLayouts = strings.NewReplacer("%Y", "2006", "%m", "01", "%d", "02", "%H", "15", "%M", "04", "%S", "05")
+
+// Run a pipeline of $match, $group, $sort, $skip, $limit, $facet and $count
+// stages. $group supports the $sum, $avg, $min and $max accumulators and
+// field paths, documents and $dateToString as expressions. $text may only be
+// used in a $match as the first stage, like in MongoDB.
+func (s *MemoryStore) Aggregate(pipeline []bson.M) ([]bson.M, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var docs []bson.M
+	var err error
+
+	if len(pipeline) > 0 && pipeline[0]["$match"] != nil {
+		match, ok := toDocument(pipeline[0]["$match"])
+		if !ok {
+			return nil, fmt.Errorf("$match requires a document")
+		}
+
+		docs, _, err = s.matching(match)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = pipeline[1:]
+	} else {
+		docs = make([]bson.M, len(s.ids))
+		for i, id := range s.ids {
+			docs[i] = s.docs[id]
+		}
+	}
+
+	docs, err = runMemoryPipeline(docs, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round trip so results have the same types as decoded ones
+	results := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		results[i], err = encodeBson(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func runMemoryPipeline(docs []bson.M, pipeline []bson.M) ([]bson.M, error) {
+	for _, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("A pipeline stage must have exactly one operator")
+		}
+
+		var err error
+
+		for name, spec := range stage {
+			switch name {
+			case "$match":
+				match, ok := toDocument(spec)
+				if !ok {
+					return nil, fmt.Errorf("$match requires a document")
+				}
+
+				matched := []bson.M{}
+				for _, doc := range docs {
+					ok, err := matchQuery(doc, match)
+					if err != nil {
+						return nil, err
+					}
+					if ok {
+						matched = append(matched, doc)
+					}
+				}
+				docs = matched
+			case "$group":
+				group, ok := toDocument(spec)
+				if !ok {
+					return nil, fmt.Errorf("$group requires a document")
+				}
+				docs, err = groupDocuments(docs, group)
+			case "$sort":
+				sortSpec, ok := spec.(bson.D)
+				if !ok {
+					return nil, fmt.Errorf("$sort requires a bson.D")
+				}
+
+				fields := make([]string, len(sortSpec))
+				for i, elem := range sortSpec {
+					fields[i] = elem.Name
+					if direction, _ := toFloat(elem.Value); direction < 0 {
+						fields[i] = "-" + elem.Name
+					}
+				}
+
+				sorted := make([]bson.M, len(docs))
+				copy(sorted, docs)
+				sortDocuments(sorted, fields)
+				docs = sorted
+			case "$skip", "$limit":
+				n, ok := toFloat(spec)
+				if !ok || n < 0 {
+					return nil, fmt.Errorf("%s requires a positive number", name)
+				}
+
+				count := int(n)
+				if count > len(docs) {
+					count = len(docs)
+				}
+
+				if name == "$skip" {
+					docs = docs[count:]
+				} else {
+					docs = docs[:count]
+				}
+			case "$facet":
+				facets, ok := toDocument(spec)
+				if !ok {
+					return nil, fmt.Errorf("$facet requires a document")
+				}
+
+				result := bson.M{}
+				for facetName, sub := range facets {
+					stages, _ := toSlice(sub)
+					subPipeline := make([]bson.M, len(stages))
+					for i, subStage := range stages {
+						subPipeline[i], _ = toDocument(subStage)
+					}
+
+					result[facetName], err = runMemoryPipeline(docs, subPipeline)
+					if err != nil {
+						return nil, err
+					}
+				}
+				docs = []bson.M{result}
+			case "$count":
+				docs = []bson.M{{fmt.Sprint(spec): len(docs)}}
+			default:
+				return nil, fmt.Errorf("Stage %s is not supported by the memory store", name)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return docs, nil
+}
+
+func groupDocuments(docs []bson.M, spec bson.M) ([]bson.M, error) {
+	ids := []interface{}{}
+	members := [][]bson.M{}
+
+	for _, doc := range docs {
+		id, err := evalExpression(doc, spec["_id"])
+		if err != nil {
+			return nil, err
+		}
+
+		found := -1
+		for i, existing := range ids {
+			if valuesEqual(existing, id) {
+				found = i
+				break
+			}
+		}
+
+		if found < 0 {
+			ids = append(ids, id)
+			members = append(members, []bson.M{})
+			found = len(ids) - 1
+		}
+		members[found] = append(members[found], doc)
+	}
+
+	groups := make([]bson.M, len(ids))
+	for i, id := range ids {
+		groups[i] = bson.M{"_id": id}
+
+		for key, accumulator := range spec {
+			if key == "_id" {
+				continue
+			}
+
+			accumulatorDoc, ok := toDocument(accumulator)
+			if !ok || len(accumulatorDoc) != 1 {
+				return nil, fmt.Errorf("Invalid accumulator for %s", key)
+			}
+
+			for op, operand := range accumulatorDoc {
+				value, err := accumulate(members[i], op, operand)
+				if err != nil {
+					return nil, err
+				}
+				groups[i][key] = value
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+func accumulate(docs []bson.M, op string, operand interface{}) (interface{}, error) {
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		value, err := evalExpression(doc, operand)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	switch op {
+	case "$sum", "$avg":
+		sum := 0.0
+		count := 0
+		for _, value := range values {
+			if number, ok := toFloat(value); ok {
+				sum += number
+				count++
+			}
+		}
+
+		if op == "$sum" {
+			return sum, nil
+		} else if count == 0 {
+			return nil, nil
+		}
+		return sum / float64(count), nil
+	case "$min", "$max":
+		var result interface{}
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+
+			if result == nil {
+				result = value
+				continue
+			}
+
+			c := compareFloats(float64(sortRank(value)), float64(sortRank(result)))
+			if c == 0 {
+				c, _ = compareValues(value, result)
+			}
+
+			if op == "$min" && c < 0 || op == "$max" && c > 0 {
+				result = value
+			}
+		}
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("Accumulator %s is not supported by the memory store", op)
+}
+
+// Evaluate a field path ("$field"), a document of expressions or
+// $dateToString against a document. Anything else is a literal.
+func evalExpression(doc bson.M, expression interface{}) (interface{}, error) {
+	if path, ok := expression.(string); ok && strings.HasPrefix(path, "$") {
+		value, _ := lookupPath(doc, path[1:])
+		return value, nil
+	}
+
+	expressionDoc, ok := toDocument(expression)
+	if !ok {
+		return expression, nil
+	}
+
+	if spec, ok := toDocument(expressionDoc["$dateToString"]); ok && len(expressionDoc) == 1 {
+		date, err := evalExpression(doc, spec["date"])
+		if err != nil {
+			return nil, err
+		}
+
+		t, ok := date.(time.Time)
+		if !ok {
+			return nil, nil
+		}
+
+		format, _ := spec["format"].(string)
+		return t.UTC().Format(dateToStringLayouts.Replace(format)), nil
+	}
+
+	result := bson.M{}
+	for key, sub := range expressionDoc {
+		if strings.HasPrefix(key, "$") {
+			return nil, fmt.Errorf("Expression %s is not supported by the memory store", key)
+		}
+
+		value, err := evalExpression(doc, sub)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+
+	return result, nil
+}
@@ -0,0 +1,1013 @@
+package bongoz
+
+import (
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/bongo"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var ErrNotFound = errors.New("Document not found")
+
+// Store keeping documents in memory, for testing endpoints and middleware
+// without a database. Understands the query operators getQuery and the
+// handlers emit ($eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $regex,
+// $size, $all, $elemMatch, $not, $and, $or, $nor) and the $set, $unset and
+// $push update operators. $text matches whole words of the fields passed to
+// EnsureTextIndex, or of any string field, and scores documents by the number
+// of matching words. $geoWithin supports $centerSphere and polygons, and
+// FindOptions.Near is computed on a sphere. The save, delete and Validate
+// hooks are called with a nil collection.
+type MemoryStore struct {
+	mutex      sync.RWMutex
+	ids        []bson.ObjectId
+	docs       map[bson.ObjectId]bson.M
+	textFields []string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		ids:  []bson.ObjectId{},
+		docs: map[bson.ObjectId]bson.M{},
+	}
+}
+
+type memoryResults struct {
+	docs [][]byte
+	pos  int
+}
+
+func (r *memoryResults) Next(doc interface{}) bool {
+	if r.pos >= len(r.docs) {
+		return false
+	}
+
+	err := bson.Unmarshal(r.docs[r.pos], doc)
+	r.pos++
+
+	return err == nil
+}
+
+func (r *memoryResults) Close() error {
+	return nil
+}
+
+// Find the matching documents in insertion order, along with their text
+// scores if the query has a $text condition. Must be called with the lock
+// held.
+func (s *MemoryStore) matching(query bson.M) ([]bson.M, []float64, error) {
+	search, query := splitTextSearch(query)
+
+	matched := []bson.M{}
+	var scores []float64
+
+	for _, id := range s.ids {
+		doc := s.docs[id]
+
+		ok, err := matchQuery(doc, query)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if ok && len(search) > 0 {
+			score := s.textScore(doc, search)
+			ok = score > 0
+			if ok {
+				scores = append(scores, score)
+			}
+		}
+
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+
+	return matched, scores, nil
+}
+
+func (s *MemoryStore) Find(query bson.M, options *FindOptions) (Results, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	docs, scores, err := s.matching(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if options == nil {
+		options = &FindOptions{}
+	}
+
+	sortFields := options.Sort
+	if scores != nil {
+		docs, sortFields = withTextScores(docs, scores, options)
+	}
+
+	if options.Near != nil {
+		docs = applyGeoNear(docs, options.Near)
+	}
+
+	if len(sortFields) > 0 {
+		sortDocuments(docs, sortFields)
+	}
+
+	if options.Skip > len(docs) {
+		docs = docs[:0]
+	} else if options.Skip > 0 {
+		docs = docs[options.Skip:]
+	}
+
+	if options.Limit > 0 && options.Limit < len(docs) {
+		docs = docs[:options.Limit]
+	}
+
+	results := &memoryResults{docs: make([][]byte, len(docs))}
+
+	for i, doc := range docs {
+		// Marshal right away, so callers never share maps with the store
+		results.docs[i], err = bson.Marshal(applyProjection(doc, options.Projection))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func (s *MemoryStore) Count(query bson.M) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	docs, _, err := s.matching(query)
+	return len(docs), err
+}
+
+func (s *MemoryStore) FindById(id bson.ObjectId, doc interface{}) error {
+	return s.FindOne(bson.M{"_id": id}, nil, doc)
+}
+
+func (s *MemoryStore) FindOne(query bson.M, projection bson.M, doc interface{}) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	docs, _, err := s.matching(query)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+
+	marshaled, err := bson.Marshal(applyProjection(docs[0], projection))
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(marshaled, doc)
+}
+
+func (s *MemoryStore) Save(doc bongo.Document) error {
+	err := s.BeforeSave(doc)
+	if err != nil {
+		return err
+	}
+
+	err = s.save(doc)
+	if err != nil {
+		return err
+	}
+
+	return s.AfterSave(doc)
+}
+
+func (s *MemoryStore) save(doc bongo.Document) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := doc.GetId()
+	if !id.Valid() {
+		id = bson.NewObjectId()
+		doc.SetId(id)
+	}
+
+	_, exists := s.docs[id]
+
+	if tt, ok := doc.(bongo.TimeTracker); ok {
+		now := time.Now()
+		if !exists {
+			tt.SetCreated(now)
+		}
+		tt.SetModified(now)
+	}
+
+	encoded, err := encodeBson(doc)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		s.ids = append(s.ids, id)
+	}
+	s.docs[id] = encoded
+
+	return nil
+}
+
+func (s *MemoryStore) Update(id bson.ObjectId, condition bson.M, update bson.M) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	doc, ok, err := s.matchingId(id, condition)
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrNotFound
+	}
+
+	for op, fields := range update {
+		fieldsDoc, ok := toDocument(fields)
+		if !ok {
+			return fmt.Errorf("Invalid value for %s", op)
+		}
+
+		for path, value := range fieldsDoc {
+			switch op {
+			case "$set":
+				setPath(doc, path, value)
+			case "$unset":
+				unsetPath(doc, path)
+			case "$push":
+				existing, _ := lookupPath(doc, path)
+				arr, _ := toSlice(existing)
+
+				if valueDoc, ok := toDocument(value); ok && valueDoc["$each"] != nil {
+					each, _ := toSlice(valueDoc["$each"])
+					arr = append(arr, each...)
+				} else {
+					arr = append(arr, value)
+				}
+				setPath(doc, path, arr)
+			default:
+				return fmt.Errorf("Update operator %s is not supported by the memory store", op)
+			}
+		}
+	}
+
+	// Round trip so stored values have the same types as decoded ones
+	normalized, err := encodeBson(doc)
+	if err != nil {
+		return err
+	}
+	s.docs[id] = normalized
+
+	return nil
+}
+
+// Runs the delete hooks like BongoStore, with a nil collection
+func (s *MemoryStore) Delete(doc bongo.Document, condition bson.M) error {
+	if hook, ok := doc.(bongo.BeforeDeleteHook); ok {
+		err := hook.BeforeDelete(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.delete(doc, condition)
+	if err != nil {
+		return err
+	}
+
+	if hook, ok := doc.(bongo.AfterDeleteHook); ok {
+		return hook.AfterDelete(nil)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) delete(doc bongo.Document, condition bson.M) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := doc.GetId()
+	_, ok, err := s.matchingId(id, condition)
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.docs, id)
+
+	for i, existing := range s.ids {
+		if existing == id {
+			s.ids = append(s.ids[:i], s.ids[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// The stored document with the id if it matches condition. Must be called
+// with the lock held.
+func (s *MemoryStore) matchingId(id bson.ObjectId, condition bson.M) (bson.M, bool, error) {
+	doc, ok := s.docs[id]
+	if !ok || condition == nil {
+		return doc, ok, nil
+	}
+
+	ok, err := matchQuery(doc, condition)
+	return doc, ok, err
+}
+
+// Restrict $text to the given fields. The language is ignored.
+func (s *MemoryStore) EnsureTextIndex(fields []string, language string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.textFields = fields
+
+	return nil
+}
+
+// The hooks get a nil collection
+func (s *MemoryStore) BeforeSave(doc bongo.Document) error {
+	if hook, ok := doc.(bongo.BeforeSaveHook); ok {
+		err := hook.BeforeSave(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if validator, ok := doc.(bongo.ValidateHook); ok {
+		errs := validator.Validate(nil)
+		if len(errs) > 0 {
+			return &bongo.ValidationError{Errors: errs}
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) AfterSave(doc bongo.Document) error {
+	if hook, ok := doc.(bongo.AfterSaveHook); ok {
+		return hook.AfterSave(nil)
+	}
+
+	return nil
+}
+
+// Convert bson.M and map[string]interface{} (e.g. from a JSON query) alike
+func toDocument(value interface{}) (bson.M, bool) {
+	switch doc := value.(type) {
+	case bson.M:
+		return doc, true
+	case map[string]interface{}:
+		return bson.M(doc), true
+	}
+
+	return nil, false
+}
+
+// Convert any slice (other than []byte) to []interface{}
+func toSlice(value interface{}) ([]interface{}, bool) {
+	if arr, ok := value.([]interface{}); ok {
+		return arr, true
+	}
+
+	val := reflect.ValueOf(value)
+	if !val.IsValid() || val.Kind() != reflect.Slice || val.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+
+	arr := make([]interface{}, val.Len())
+	for i := range arr {
+		arr[i] = val.Index(i).Interface()
+	}
+
+	return arr, true
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	val := reflect.ValueOf(value)
+	if !val.IsValid() {
+		return 0, false
+	}
+
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), true
+	}
+
+	return 0, false
+}
+
+func isTruthy(value interface{}) bool {
+	if b, ok := value.(bool); ok {
+		return b
+	}
+
+	if f, ok := toFloat(value); ok {
+		return f != 0
+	}
+
+	return value != nil
+}
+
+func setPath(doc bson.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := toDocument(current[part])
+		if !ok {
+			sub = bson.M{}
+			current[part] = sub
+		}
+		current = sub
+	}
+
+	current[parts[len(parts)-1]] = value
+}
+
+func unsetPath(doc bson.M, path string) {
+	parts := strings.Split(path, ".")
+
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := toDocument(current[part])
+		if !ok {
+			return
+		}
+		current = sub
+	}
+
+	delete(current, parts[len(parts)-1])
+}
+
+// Apply an inclusion ({"field": 1}) or exclusion ({"field": 0}) projection
+func applyProjection(doc bson.M, projection bson.M) bson.M {
+	if len(projection) == 0 {
+		return doc
+	}
+
+	inclusion := false
+	for key, value := range projection {
+		if _, ok := toDocument(value); !ok && key != "_id" && isTruthy(value) {
+			inclusion = true
+		}
+	}
+
+	projected := bson.M{}
+
+	if inclusion {
+		for key, value := range projection {
+			if meta, ok := toDocument(value); ok && meta["$meta"] == nil || !ok && !isTruthy(value) {
+				continue
+			}
+			if found, ok := lookupPath(doc, key); ok {
+				setPath(projected, key, found)
+			}
+		}
+
+		if idValue, ok := projection["_id"]; !ok || isTruthy(idValue) {
+			projected["_id"] = doc["_id"]
+		}
+
+		return projected
+	}
+
+	for key, value := range doc {
+		projected[key] = value
+	}
+
+	for key, value := range projection {
+		if _, ok := toDocument(value); !ok && !isTruthy(value) {
+			unsetPath(projected, key)
+		}
+	}
+
+	return projected
+}
+
+// Match a document against a query
+func matchQuery(doc bson.M, query bson.M) (bool, error) {
+	for key, condition := range query {
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, ok := toSlice(condition)
+			if !ok {
+				return false, fmt.Errorf("%s requires an array", key)
+			}
+
+			matchedAny := false
+			for _, clause := range clauses {
+				clauseDoc, ok := toDocument(clause)
+				if !ok {
+					return false, fmt.Errorf("%s requires an array of documents", key)
+				}
+
+				matched, err := matchQuery(doc, clauseDoc)
+				if err != nil {
+					return false, err
+				}
+
+				if key == "$and" && !matched {
+					return false, nil
+				}
+				matchedAny = matchedAny || matched
+			}
+
+			if key == "$or" && !matchedAny || key == "$nor" && matchedAny {
+				return false, nil
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("Operator %s is not supported by the memory store", key)
+			}
+
+			value, exists := lookupPath(doc, key)
+
+			matched, err := matchCondition(value, exists, condition)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func isOperatorDocument(doc bson.M) bool {
+	if len(doc) == 0 {
+		return false
+	}
+
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match a field value against either a plain value or an operator document
+func matchCondition(value interface{}, exists bool, condition interface{}) (bool, error) {
+	if cond, ok := toDocument(condition); ok && isOperatorDocument(cond) {
+		for op, operand := range cond {
+			matched, err := matchOperator(value, exists, op, operand, cond)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	if regex, ok := condition.(bson.RegEx); ok {
+		return matchRegex(value, regex.Pattern, regex.Options)
+	}
+
+	return matchesEqual(value, condition), nil
+}
+
+func matchOperator(value interface{}, exists bool, op string, operand interface{}, cond bson.M) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchesEqual(value, operand), nil
+	case "$ne":
+		return !matchesEqual(value, operand), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return anyElement(value, func(v interface{}) bool {
+			c, ok := compareValues(v, operand)
+			if !ok {
+				return false
+			}
+
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		}), nil
+	case "$in", "$nin":
+		candidates, ok := toSlice(operand)
+		if !ok {
+			return false, fmt.Errorf("%s requires an array", op)
+		}
+
+		in := false
+		for _, candidate := range candidates {
+			var matched bool
+			if regex, ok := candidate.(bson.RegEx); ok {
+				matched, _ = matchRegex(value, regex.Pattern, regex.Options)
+			} else {
+				matched = matchesEqual(value, candidate)
+			}
+
+			if matched {
+				in = true
+				break
+			}
+		}
+
+		return in == (op == "$in"), nil
+	case "$exists":
+		return isTruthy(operand) == exists, nil
+	case "$regex":
+		options, _ := cond["$options"].(string)
+		if regex, ok := operand.(bson.RegEx); ok {
+			return matchRegex(value, regex.Pattern, regex.Options+options)
+		} else if pattern, ok := operand.(string); ok {
+			return matchRegex(value, pattern, options)
+		}
+		return false, errors.New("$regex requires a string")
+	case "$options":
+		// Handled by $regex
+		return true, nil
+	case "$size":
+		arr, ok := toSlice(value)
+		size, isNumber := toFloat(operand)
+		if !isNumber {
+			return false, errors.New("$size requires a number")
+		}
+		return ok && float64(len(arr)) == size, nil
+	case "$all":
+		candidates, ok := toSlice(operand)
+		if !ok {
+			return false, errors.New("$all requires an array")
+		}
+
+		for _, candidate := range candidates {
+			if !matchesEqual(value, candidate) {
+				return false, nil
+			}
+		}
+		return len(candidates) > 0, nil
+	case "$elemMatch":
+		arr, ok := toSlice(value)
+		if !ok {
+			return false, nil
+		}
+
+		condDoc, ok := toDocument(operand)
+		if !ok {
+			return false, errors.New("$elemMatch requires a document")
+		}
+
+		for _, element := range arr {
+			var matched bool
+			var err error
+
+			if isOperatorDocument(condDoc) {
+				matched, err = matchCondition(element, true, condDoc)
+			} else if elementDoc, ok := toDocument(element); ok {
+				matched, err = matchQuery(elementDoc, condDoc)
+			}
+
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$not":
+		matched, err := matchCondition(value, exists, operand)
+		return !matched, err
+	case "$geoWithin":
+		return matchGeoWithin(value, operand)
+	}
+
+	return false, fmt.Errorf("Operator %s is not supported by the memory store", op)
+}
+
+// Run fn for each element of an array value, or for the value itself
+func anyElement(value interface{}, fn func(v interface{}) bool) bool {
+	if arr, ok := toSlice(value); ok {
+		for _, element := range arr {
+			if fn(element) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return fn(value)
+}
+
+// Equality the way MongoDB matches it: arrays match if any element (or the
+// whole array) is equal, and null matches missing fields
+func matchesEqual(value interface{}, target interface{}) bool {
+	if target == nil {
+		return value == nil
+	}
+
+	if valuesEqual(value, target) {
+		return true
+	}
+
+	if arr, ok := toSlice(value); ok {
+		for _, element := range arr {
+			if valuesEqual(element, target) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func valuesEqual(a interface{}, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+
+	aArr, aIsArr := toSlice(a)
+	bArr, bIsArr := toSlice(b)
+	if aIsArr && bIsArr {
+		if len(aArr) != len(bArr) {
+			return false
+		}
+		for i := range aArr {
+			if !valuesEqual(aArr[i], bArr[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	aDoc, aIsDoc := toDocument(a)
+	bDoc, bIsDoc := toDocument(b)
+	if aIsDoc && bIsDoc {
+		if len(aDoc) != len(bDoc) {
+			return false
+		}
+		for key, value := range aDoc {
+			other, ok := bDoc[key]
+			if !ok || !valuesEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// Compare two scalar values of the same kind. Returns false if they can not
+// be compared (e.g. a string and a number), like MongoDB's type bracketing.
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(af, bf), true
+	}
+
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case bson.ObjectId:
+		if bv, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(av), string(bv)), true
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			if av.Before(bv) {
+				return -1, true
+			} else if av.After(bv) {
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			if av == bv {
+				return 0, true
+			} else if bv {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	return 0, false
+}
+
+func compareFloats(a float64, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func matchRegex(value interface{}, pattern string, options string) (bool, error) {
+	flags := ""
+	for _, option := range options {
+		if strings.ContainsRune("ims", option) && !strings.ContainsRune(flags, option) {
+			flags += string(option)
+		}
+	}
+
+	if len(flags) > 0 {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	return anyElement(value, func(v interface{}) bool {
+		str, ok := v.(string)
+		return ok && re.MatchString(str)
+	}), nil
+}
+
+// Take the $text search terms out of a query. $and clauses are searched as
+// well, since scope and soft delete filters are combined with $and.
+func splitTextSearch(query bson.M) (string, bson.M) {
+	search := ""
+	rest := bson.M{}
+
+	for key, value := range query {
+		switch key {
+		case "$text":
+			if text, ok := toDocument(value); ok {
+				search, _ = text["$search"].(string)
+			}
+		case "$and":
+			clauses, ok := toSlice(value)
+			if !ok {
+				rest[key] = value
+				continue
+			}
+
+			split := make([]interface{}, len(clauses))
+			for i, clause := range clauses {
+				split[i] = clause
+
+				if clauseDoc, ok := toDocument(clause); ok {
+					found, clauseRest := splitTextSearch(clauseDoc)
+					if len(found) > 0 {
+						search = found
+					}
+					split[i] = clauseRest
+				}
+			}
+			rest[key] = split
+		default:
+			rest[key] = value
+		}
+	}
+
+	return search, rest
+}
+
+// Number of words of the text fields that are search terms. Must be called
+// with the lock held.
+func (s *MemoryStore) textScore(doc bson.M, search string) float64 {
+	terms := strings.Fields(strings.ToLower(search))
+
+	score := 0.0
+	count := func(value interface{}) bool {
+		if str, ok := value.(string); ok {
+			for _, word := range strings.FieldsFunc(strings.ToLower(str), isWordSeparator) {
+				if stringInSlice(word, terms) {
+					score++
+				}
+			}
+		}
+		return false
+	}
+
+	if len(s.textFields) > 0 {
+		for _, field := range s.textFields {
+			value, _ := lookupPath(doc, field)
+			anyElement(value, count)
+		}
+	} else {
+		for _, value := range doc {
+			anyElement(value, count)
+		}
+	}
+
+	return score
+}
+
+func isWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Copy the text score of each document into the keys the projection and the
+// sort ask for with {"$meta": "textScore"} and "$textScore:key", and sort
+// those keys in descending order
+func withTextScores(docs []bson.M, scores []float64, options *FindOptions) ([]bson.M, []string) {
+	keys := []string{}
+	for key, value := range options.Projection {
+		if meta, ok := toDocument(value); ok && meta["$meta"] == "textScore" {
+			keys = append(keys, key)
+		}
+	}
+
+	sortFields := make([]string, len(options.Sort))
+	for i, field := range options.Sort {
+		if strings.HasPrefix(field, "$textScore:") {
+			key := strings.TrimPrefix(field, "$textScore:")
+			keys = append(keys, key)
+			field = "-" + key
+		}
+		sortFields[i] = field
+	}
+
+	scored := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		scored[i] = bson.M{}
+		for key, value := range doc {
+			scored[i][key] = value
+		}
+		for _, key := range keys {
+			scored[i][key] = scores[i]
+		}
+	}
+
+	return scored, sortFields
+}
+
+// Position of a value's type in MongoDB's sort order
+func sortRank(value interface{}) int {
+	if value == nil {
+		return 0
+	}
+
+	if _, ok := toFloat(value); ok {
+		return 1
+	}
+
+	switch value.(type) {
+	case string:
+		return 2
+	case bson.M, map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case bson.ObjectId:
+		return 5
+	case bool:
+		return 6
+	case time.Time:
+		return 7
+	}
+
+	return 8
+}
+
+func sortDocuments(docs []bson.M, fields []string) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, field := range fields {
+			direction := 1
+			if strings.HasPrefix(field, "-") {
+				direction = -1
+				field = field[1:]
+			}
+
+			a, _ := lookupPath(docs[i], field)
+			b, _ := lookupPath(docs[j], field)
+
+			c := compareFloats(float64(sortRank(a)), float64(sortRank(b)))
+			if c == 0 {
+				c, _ = compareValues(a, b)
+			}
+
+			if c != 0 {
+				return c*direction < 0
+			}
+		}
+
+		return false
+	})
+}
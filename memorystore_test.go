@@ -0,0 +1,115 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	Convey("Memory store", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+		endpoint.QueryParams = []string{"$gte_intValue", "content"}
+		router := endpoint.GetRouter()
+
+		obj1 := &Page{
+			Content:  "foo",
+			IntValue: 3,
+		}
+		obj2 := &Page{
+			Content:  "bar",
+			IntValue: 7,
+		}
+
+		So(store.Save(obj1), ShouldEqual, nil)
+		So(store.Save(obj2), ShouldEqual, nil)
+
+		Convey("read list with query", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages?$gte_intValue=5", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			response := &listResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(response.Pagination.TotalRecords, ShouldEqual, 1)
+			So(len(response.Data), ShouldEqual, 1)
+			So(response.Data[0]["content"], ShouldEqual, "bar")
+		})
+		Convey("read one", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages/"+obj1.Id.Hex(), nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			response := &singleResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			So(err, ShouldEqual, nil)
+			So(response.Data["content"], ShouldEqual, "foo")
+		})
+		Convey("create", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/pages", strings.NewReader(`{"content":"baz"}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+
+			count, err := store.Count(bson.M{})
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 3)
+		})
+		Convey("patch", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PATCH", "/api/pages/"+obj1.Id.Hex(), strings.NewReader(`{"content":"changed"}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			found := &Page{}
+			So(store.FindById(obj1.Id, found), ShouldEqual, nil)
+			So(found.Content, ShouldEqual, "changed")
+			So(found.IntValue, ShouldEqual, 3)
+		})
+		Convey("delete", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("DELETE", "/api/pages/"+obj1.Id.Hex(), nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+			So(store.FindById(obj1.Id, &Page{}), ShouldEqual, ErrNotFound)
+		})
+		Convey("find leaves the options alone", func() {
+			options := &FindOptions{Skip: 5}
+			results, err := store.Find(bson.M{}, options)
+			So(err, ShouldEqual, nil)
+			So(results.Next(&Page{}), ShouldEqual, false)
+			So(options.Skip, ShouldEqual, 5)
+		})
+		Convey("operators", func() {
+			matched, err := matchQuery(bson.M{"tags": []interface{}{"a", "b"}, "n": 4}, bson.M{
+				"$or": []interface{}{
+					bson.M{"tags": bson.M{"$in": []interface{}{"b"}}},
+					bson.M{"n": bson.M{"$lt": 2}},
+				},
+				"missing": bson.M{"$exists": false},
+			})
+			So(err, ShouldEqual, nil)
+			So(matched, ShouldEqual, true)
+
+			matched, err = matchQuery(bson.M{"n": 4}, bson.M{"n": bson.M{"$nin": []interface{}{4}}})
+			So(err, ShouldEqual, nil)
+			So(matched, ShouldEqual, false)
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package bongoz
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"github.com/vmihailenco/msgpack"
+	"io"
+	"strconv"
+)
+
+// Write the MessagePack encoding of the JSON encoding of v, see toJSONValue.
+// Map keys are sorted.
+func encodeMessagePack(w io.Writer, v interface{}) error {
+	value, err := toJSONValue(v)
+	if err != nil {
+		return err
+	}
+
+	value, err = fromJSONNumbers(value)
+	if err != nil {
+		return err
+	}
+
+	return msgpack.NewEncoder(w).SortMapKeys(true).UseCompactEncoding(true).Encode(value)
+}
+
+// Replace the json.Numbers of a value from toJSONValue by int64, uint64 or
+// float64
+func fromJSONNumbers(value interface{}) (interface{}, error) {
+	return convertJSONNumbers(value, func(n json.Number) (interface{}, error) {
+		if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+			return u, nil
+		}
+		return strconv.ParseFloat(string(n), 64)
+	})
+}
+
+// Read a MessagePack value into the values decoding JSON produces, except
+// that integers are int64 or uint64 and binary data is []byte
+func readMessagePack(buf []byte) (interface{}, error) {
+	reader := bytes.NewReader(buf)
+
+	value, err := msgpack.NewDecoder(reader).DecodeInterfaceLoose()
+	if err != nil {
+		return nil, err
+	}
+
+	if reader.Len() > 0 {
+		return nil, fmt.Errorf("Unexpected %d bytes after the MessagePack value", reader.Len())
+	}
+
+	return value, nil
+}
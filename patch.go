@@ -0,0 +1,343 @@
+package bongoz
+
+import (
+	"bytes"
+	"github.com/maxwellhealth/bongo"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Apply a JSON Merge Patch (RFC 7396) to a decoded JSON value. Null values in
+// the patch remove the key from the target, objects are merged recursively and
+// anything else replaces the target value.
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = applyMergePatch(targetObj[k], v)
+		}
+	}
+
+	return targetObj
+}
+
+// Rename the keys of a merge patch for a struct type to the JSON keys of its
+// fields. Keys matching a field's Go name or bson key in another case would
+// otherwise be added next to the field's key, leaving it to the decoder
+// which one wins. Unknown keys are kept and ignored like in other bodies.
+func normalizePatchKeys(patch map[string]interface{}, typ reflect.Type) map[string]interface{} {
+	typ = indirectType(typ)
+	if typ.Kind() != reflect.Struct || typ == timeType {
+		return patch
+	}
+
+	fields := listFieldsOfType(typ, []int{})
+	normalized := map[string]interface{}{}
+	renamed := map[string]interface{}{}
+
+	for key, value := range patch {
+		var field *resolvedField
+		for _, f := range fields {
+			if f.JSONKey == key {
+				field = f
+				break
+			} else if strings.EqualFold(f.JSONKey, key) || strings.EqualFold(f.Name, key) || f.BsonKey == key {
+				field = f
+			}
+		}
+
+		if field == nil {
+			normalized[key] = value
+			continue
+		}
+
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = normalizePatchKeys(nested, typ.FieldByIndex(field.Index).Type)
+		}
+
+		if field.JSONKey == key {
+			normalized[key] = value
+		} else {
+			renamed[field.JSONKey] = value
+		}
+	}
+
+	// Keys that already are JSON keys win
+	for key, value := range renamed {
+		if _, ok := normalized[key]; !ok {
+			normalized[key] = value
+		}
+	}
+
+	return normalized
+}
+
+// Apply a merge patch to a document by round tripping it through its JSON
+// representation. Fields hidden from JSON are left untouched.
+func applyMergePatchToDocument(doc bongo.Document, patch interface{}) error {
+	if patchObj, ok := patch.(map[string]interface{}); ok {
+		patch = normalizePatchKeys(patchObj, reflectValue(doc).Type())
+	}
+
+	original, err := toJSONValue(doc)
+	if err != nil {
+		return err
+	}
+
+	return decodeJSONDocument(applyMergePatch(original, patch), doc)
+}
+
+// Decode a patched JSON value from toJSONValue back into the document.
+// Numbers stay exact, and the ones landing in interface{} values become
+// integers again where they have no fraction (see bsonNumber) rather than
+// float64.
+func decodeJSONDocument(value interface{}, doc bongo.Document) error {
+	marshaled, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	// Removed keys need to end up as zero values, which a plain decode
+	// over the existing struct would not do
+	zeroJSONFields(doc)
+
+	decoder := json.NewDecoder(bytes.NewReader(marshaled))
+	decoder.UseNumber()
+
+	err = decoder.Decode(doc)
+	if err != nil {
+		return err
+	}
+
+	return restoreJSONNumbers(reflect.ValueOf(doc))
+}
+
+// The value bson decodes a number to: int for int32s, int64 for larger
+// integers and float64 for anything else
+func bsonNumber(n json.Number) (interface{}, error) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return int(i), nil
+		}
+		return i, nil
+	}
+
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// Replace the json.Numbers in the interface{} values of v by bsonNumber
+func restoreJSONNumbers(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return restoreJSONNumbers(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Field(i); field.CanSet() {
+				if err := restoreJSONNumbers(field); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := restoreJSONNumbers(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// Map values are not addressable
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := restoreJSONNumbers(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Interface:
+		if v.IsNil() || v.NumMethod() > 0 {
+			return nil
+		}
+
+		converted, err := convertJSONNumbers(v.Interface(), bsonNumber)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(converted))
+	}
+
+	return nil
+}
+
+// Save a document that was modified in place. bongo.Trackable documents only
+// get their modified fields written with $set/$unset, everything else falls
+// back to a full Save, or saveWithUpdate with a condition from checkIfMatch
+// or when the deleted stamp must be kept. before is the bson encoding of the
+// document when it was read.
+func (e *Endpoint) savePartial(store Store, doc bongo.Document, before bson.M, condition bson.M) error {
+	trackable, ok := doc.(bongo.Trackable)
+	if !ok {
+		if condition != nil || e.dropsDeletedField(doc) {
+			return saveWithUpdate(store, doc, before, condition)
+		}
+		return store.Save(doc)
+	}
+
+	// We bypass Save, so run its hooks ourselves
+	err := store.BeforeSave(doc)
+	if err != nil {
+		return err
+	}
+
+	modified, fields := trackable.GetDiffTracker().GetModified(true)
+	if !modified {
+		return nil
+	}
+
+	update, err := buildPartialUpdate(doc, fields)
+	if err != nil {
+		return err
+	}
+
+	if len(update) > 0 {
+		err = store.Update(doc.GetId(), condition, update)
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.AfterSave(doc)
+}
+
+// Save a whole document with Store.Update instead of replacing it, so it is
+// only written if it still matches a non-nil condition, and stored fields
+// the model does not have survive. before is the bson encoding of the stored
+// document, whose fields missing from the new one are unset. The document's
+// BeforeSave, Validate and AfterSave hooks run as they do for Save.
+func saveWithUpdate(store Store, doc bongo.Document, before bson.M, condition bson.M) error {
+	err := store.BeforeSave(doc)
+	if err != nil {
+		return err
+	}
+
+	err = writeWithUpdate(store, doc, before, condition)
+	if err != nil {
+		return err
+	}
+
+	return store.AfterSave(doc)
+}
+
+// The write of saveWithUpdate, without the hooks
+func writeWithUpdate(store Store, doc bongo.Document, before bson.M, condition bson.M) error {
+	after, err := encodeBson(doc)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{}
+	for key, value := range after {
+		if key != "_id" {
+			set[key] = value
+		}
+	}
+
+	unset := bson.M{}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			unset[key] = ""
+		}
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	if len(update) == 0 {
+		return nil
+	}
+
+	return store.Update(doc.GetId(), condition, update)
+}
+
+// Build a $set/$unset update for the given bson field paths from the current
+// state of the document. Fields that are no longer present in the encoded
+// document (e.g. omitempty) are unset.
+func buildPartialUpdate(doc interface{}, fields []string) (bson.M, error) {
+	marshaled, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	current := bson.M{}
+	err = bson.Unmarshal(marshaled, &current)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+
+	for _, field := range fields {
+		if field == "_id" {
+			continue
+		}
+
+		if value, ok := lookupPath(current, field); ok {
+			set[field] = value
+		} else {
+			unset[field] = ""
+		}
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	return update, nil
+}
+
+// Look up a dotted path in a decoded bson document
+func lookupPath(doc bson.M, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+
+	var current interface{} = doc
+	for _, part := range parts {
+		sub, ok := current.(bson.M)
+		if !ok {
+			return nil, false
+		}
+
+		current, ok = sub[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
@@ -0,0 +1,308 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	conn := getConnection()
+	collection := conn.Collection("pages")
+	defer conn.Session.Close()
+
+	Convey("PATCH", t, func() {
+		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		Convey("merge patch", func() {
+			endpoint.Factory = Factory
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			obj := &Page{
+				Content:   "Foo",
+				IntValue:  5,
+				RandomMap: map[string]interface{}{"a": "b", "c": "d"},
+			}
+
+			err := collection.Save(obj)
+			So(err, ShouldEqual, nil)
+
+			reader := strings.NewReader(`{"content":"bar","randomMap":{"a":null}}`)
+			req, _ := http.NewRequest("PATCH", strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/"), reader)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			response := &singleResponse{}
+			err = json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data["content"], ShouldEqual, "bar")
+			So(response.Data["intValue"], ShouldEqual, 5.0)
+			So(response.Data["randomMap"], ShouldResemble, map[string]interface{}{"c": "d"})
+		})
+		Convey("partial update of trackable model", func() {
+			endpoint.Factory = HistoricalFactory
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			obj := &HistoricalPage{
+				OtherVal: "foo",
+			}
+			obj.Content = "Foo"
+
+			err := collection.Save(obj)
+			So(err, ShouldEqual, nil)
+
+			// Simulate a concurrent edit to a field the patch does not touch
+			err = collection.Collection().UpdateId(obj.Id, map[string]interface{}{"$set": map[string]interface{}{"content": "Concurrent"}})
+			So(err, ShouldEqual, nil)
+
+			reader := strings.NewReader(`{"otherVal":"bar"}`)
+			req, _ := http.NewRequest("PATCH", strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/"), reader)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			found := &HistoricalPage{}
+			err = collection.FindById(obj.Id, found)
+			So(err, ShouldEqual, nil)
+			So(found.OtherVal, ShouldEqual, "bar")
+			So(found.Content, ShouldEqual, "Concurrent")
+		})
+		Convey("merge patch with keys in another case", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+
+			obj := &Page{
+				Content:  "Foo",
+				IntValue: 5,
+			}
+
+			So(endpoint.Store.Save(obj), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+
+			for i, value := range []string{"a", "b", "c", "d", "e"} {
+				w := httptest.NewRecorder()
+				reader := strings.NewReader(`{"IntValue":` + strconv.Itoa(i) + `,"CONTENT":"` + value + `"}`)
+				req, _ := http.NewRequest("PATCH", "/api/pages/"+obj.Id.Hex(), reader)
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 200)
+
+				found := &Page{}
+				So(endpoint.Store.FindById(obj.Id, found), ShouldEqual, nil)
+				So(found.IntValue, ShouldEqual, i)
+				So(found.Content, ShouldEqual, value)
+			}
+		})
+		Convey("validation errors", func() {
+			endpoint.Factory = ValidFactory
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			obj := &validatedModel{
+				Content: "Biff",
+			}
+
+			err := collection.Save(obj)
+			So(err, ShouldEqual, nil)
+
+			reader := strings.NewReader(`{"content":null}`)
+			req, _ := http.NewRequest("PATCH", strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/"), reader)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 400)
+			So(w.Body.String(), ShouldEqual, "{\"errors\":[{\"code\":\"validation_failed\",\"message\":\"Content is required\"}]}")
+		})
+
+		Convey("json patch", func() {
+			endpoint.Factory = Factory
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			obj := &Page{
+				Content:  "Foo",
+				IntValue: 5,
+				ArrValue: []string{"a"},
+			}
+
+			err := collection.Save(obj)
+			So(err, ShouldEqual, nil)
+
+			reader := strings.NewReader(`[
+				{"op":"test","path":"/intValue","value":5},
+				{"op":"replace","path":"/content","value":"bar"},
+				{"op":"add","path":"/arrValue/-","value":"b"}
+			]`)
+			req, _ := http.NewRequest("PATCH", strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/"), reader)
+			req.Header.Set("Content-Type", "application/json-patch+json")
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			found := &Page{}
+			err = collection.FindById(obj.Id, found)
+			So(err, ShouldEqual, nil)
+			So(found.Content, ShouldEqual, "bar")
+			So(found.ArrValue, ShouldResemble, []string{"a", "b"})
+		})
+		Convey("json patch with failing test", func() {
+			endpoint.Factory = Factory
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			obj := &Page{
+				Content:  "Foo",
+				IntValue: 5,
+			}
+
+			err := collection.Save(obj)
+			So(err, ShouldEqual, nil)
+
+			reader := strings.NewReader(`[
+				{"op":"test","path":"/intValue","value":6},
+				{"op":"replace","path":"/content","value":"bar"}
+			]`)
+			req, _ := http.NewRequest("PATCH", strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/"), reader)
+			req.Header.Set("Content-Type", "application/json-patch+json")
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 409)
+
+			found := &Page{}
+			err = collection.FindById(obj.Id, found)
+			So(err, ShouldEqual, nil)
+			So(found.Content, ShouldEqual, "Foo")
+		})
+		Convey("json patch via PUT", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+
+			obj := &Page{
+				Content: "Foo",
+			}
+
+			So(endpoint.Store.Save(obj), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			reader := strings.NewReader(`[{"op":"replace","path":"/content","value":"bar"}]`)
+			req, _ := http.NewRequest("PUT", "/api/pages/"+obj.Id.Hex(), reader)
+			req.Header.Set("Content-Type", "application/json-patch+json")
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 415)
+
+			found := &Page{}
+			So(endpoint.Store.FindById(obj.Id, found), ShouldEqual, nil)
+			So(found.Content, ShouldEqual, "Foo")
+		})
+		Convey("json patch of hidden fields", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+			endpoint.FieldPolicies = map[string]FieldPolicy{
+				"content": FieldHidden,
+			}
+
+			obj := &Page{
+				Content:  "secret",
+				ArrValue: []string{},
+			}
+
+			So(endpoint.Store.Save(obj), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+
+			for _, body := range []string{
+				`[{"op":"copy","from":"/content","path":"/arrValue/-"}]`,
+				`[{"op":"test","path":"/content","value":"secret"}]`,
+				`[{"op":"test","path":"","value":{}}]`,
+			} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("PATCH", "/api/pages/"+obj.Id.Hex(), strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json-patch+json")
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 400)
+				So(w.Body.String(), ShouldNotContainSubstring, "secret")
+			}
+
+			found := &Page{}
+			So(endpoint.Store.FindById(obj.Id, found), ShouldEqual, nil)
+			So(found.ArrValue, ShouldResemble, []string{})
+		})
+		Convey("number types survive both kinds of patch", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+
+			obj := &Page{
+				Content:   "Foo",
+				RandomMap: map[string]interface{}{"n": 5, "big": int64(1 << 60), "f": 1.5},
+			}
+
+			So(endpoint.Store.Save(obj), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+
+			for _, body := range []string{
+				`{"content":"bar","randomMap":{"m":7}}`,
+				`[{"op":"test","path":"/randomMap/n","value":5.0},{"op":"add","path":"/randomMap/m","value":7}]`,
+			} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("PATCH", "/api/pages/"+obj.Id.Hex(), strings.NewReader(body))
+				if strings.HasPrefix(body, "[") {
+					req.Header.Set("Content-Type", "application/json-patch+json")
+				}
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 200)
+
+				found := &Page{}
+				So(endpoint.Store.FindById(obj.Id, found), ShouldEqual, nil)
+				So(found.RandomMap, ShouldResemble, map[string]interface{}{"n": 5, "m": 7, "big": int64(1 << 60), "f": 1.5})
+			}
+		})
+		Convey("json patch without a value", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+
+			obj := &Page{Content: "Foo"}
+			So(endpoint.Store.Save(obj), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+
+			for _, op := range []string{"add", "replace", "test"} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("PATCH", "/api/pages/"+obj.Id.Hex(), strings.NewReader(`[{"op":"`+op+`","path":"/content"}]`))
+				req.Header.Set("Content-Type", "application/json-patch+json")
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 400)
+				So(w.Body.String(), ShouldContainSubstring, "requires a value")
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PATCH", "/api/pages/"+obj.Id.Hex(), strings.NewReader(`[{"op":"replace","path":"/content","value":null}]`))
+			req.Header.Set("Content-Type", "application/json-patch+json")
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongoz").DropDatabase()
+		})
+	})
+}
@@ -0,0 +1,179 @@
+package bongoz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/maxwellhealth/bongo"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"net/http"
+	"reflect"
+)
+
+// Policies restricting how a field can be read and written through an
+// endpoint. They can be combined, e.g. FieldHidden | FieldReadOnly.
+type FieldPolicy int
+
+const (
+	// Never serialized in responses
+	FieldHidden FieldPolicy = 1 << iota
+	// Output only, can not be changed by create or update requests
+	FieldReadOnly
+	// Can be set on create, but not changed afterwards
+	FieldCreateOnly
+)
+
+// Value of a protected field before the request body was applied
+type protectedField struct {
+	field   *resolvedField
+	encoded []byte
+}
+
+// Check that FieldPolicies only names fields of the model. Misconfigured
+// policies are a programming error, so registering the routes panics.
+func (e *Endpoint) checkFieldPolicies() {
+	if len(e.FieldPolicies) == 0 {
+		return
+	}
+
+	instance := e.Factory()
+
+	for name := range e.FieldPolicies {
+		if _, ok := resolveField(name, instance); !ok {
+			panic(fmt.Errorf("Unknown field %s in FieldPolicies", name))
+		}
+	}
+}
+
+// Resolve the fields the policies are declared on
+func (e *Endpoint) fieldsWithPolicy(doc interface{}, policy FieldPolicy) []*resolvedField {
+	fields := []*resolvedField{}
+
+	for name, p := range e.FieldPolicies {
+		if p&policy == 0 {
+			continue
+		}
+
+		if field, ok := resolveField(name, doc); ok {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+func (e *Endpoint) isHiddenField(doc interface{}, field *resolvedField) bool {
+	for _, hidden := range e.fieldsWithPolicy(doc, FieldHidden) {
+		if hidden.Name == field.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record the fields that a create (or update) request must not change, so
+// they can be checked after the body has been decoded into the document
+func (e *Endpoint) snapshotProtectedFields(doc bongo.Document, create bool) []*protectedField {
+	policy := FieldReadOnly
+	if !create {
+		policy |= FieldCreateOnly
+	}
+
+	fields := e.fieldsWithPolicy(doc, policy)
+
+	// The deleted stamp is only set by deletes and restores
+	if e.SoftDelete {
+		if field, ok := resolveField(e.DeletedField, doc); ok {
+			fields = append(fields, field)
+		}
+	}
+
+	snapshot := make([]*protectedField, len(fields))
+
+	objValue := reflectValue(doc)
+
+	for i, field := range fields {
+		// Encode the value, since decoding may modify maps and slices in place
+		encoded, err := json.Marshal(objValue.FieldByIndex(field.Index).Interface())
+		if err != nil {
+			panic(err)
+		}
+
+		snapshot[i] = &protectedField{field, encoded}
+	}
+
+	return snapshot
+}
+
+// Revert every protected field that was changed by the request. If the
+// endpoint has RejectProtectedFields set, the changes are returned as errors.
+// Sending a protected field with its current value is not an error, so
+// clients can send back documents as they received them.
+func (e *Endpoint) enforceFieldPolicies(doc bongo.Document, snapshot []*protectedField) []*Error {
+	errs := []*Error{}
+
+	objValue := reflectValue(doc)
+
+	for _, protected := range snapshot {
+		field := objValue.FieldByIndex(protected.field.Index)
+
+		encoded, err := json.Marshal(field.Interface())
+		if err != nil {
+			panic(err)
+		}
+
+		if bytes.Equal(encoded, protected.encoded) {
+			continue
+		}
+
+		field.Set(reflect.Zero(field.Type()))
+		err = json.Unmarshal(protected.encoded, field.Addr().Interface())
+		if err != nil {
+			panic(err)
+		}
+
+		if e.RejectProtectedFields {
+			key := protected.field.JSONKey
+			errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeProtectedField, key, fmt.Sprintf("Field %s can not be modified", key)))
+		}
+	}
+
+	return errs
+}
+
+// Prepare a document for the response, applying the field selection and
+// removing hidden fields
+func (e *Endpoint) renderDocument(doc interface{}, selection *fieldSelection) (interface{}, error) {
+	hidden := e.fieldsWithPolicy(doc, FieldHidden)
+
+	if selection == nil && len(hidden) == 0 {
+		return doc, nil
+	}
+
+	value, err := toJSONValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Documents must encode to JSON objects")
+	}
+
+	if selection != nil {
+		trimmed := map[string]interface{}{}
+		for _, key := range selection.JSONKeys {
+			if value, ok := encoded[key]; ok {
+				trimmed[key] = value
+			}
+		}
+		encoded = trimmed
+	}
+
+	for _, field := range hidden {
+		delete(encoded, field.JSONKey)
+	}
+
+	return encoded, nil
+}
@@ -0,0 +1,127 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFieldPolicies(t *testing.T) {
+	conn := getConnection()
+	collection := conn.Collection("pages")
+	defer conn.Session.Close()
+
+	Convey("Field policies", t, func() {
+		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		endpoint.Factory = Factory
+		endpoint.FieldPolicies = map[string]FieldPolicy{
+			"content":  FieldHidden,
+			"intValue": FieldReadOnly,
+			"arrValue": FieldCreateOnly,
+		}
+
+		obj := &Page{
+			Content:  "secret",
+			IntValue: 5,
+			ArrValue: []string{"a"},
+		}
+
+		err := collection.Save(obj)
+		So(err, ShouldEqual, nil)
+
+		uri := strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/")
+
+		Convey("hidden fields are not serialized", func() {
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", uri, nil)
+			router.ServeHTTP(w, req)
+
+			response := &singleResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data["intValue"], ShouldEqual, 5.0)
+			_, ok := response.Data["content"]
+			So(ok, ShouldEqual, false)
+		})
+		Convey("protected fields are reverted", func() {
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PUT", uri, strings.NewReader(`{"intValue":6,"arrValue":["b"]}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			found := &Page{}
+			err := collection.FindById(obj.Id, found)
+			So(err, ShouldEqual, nil)
+			So(found.IntValue, ShouldEqual, 5)
+			So(found.ArrValue, ShouldResemble, []string{"a"})
+		})
+		Convey("protected fields are rejected", func() {
+			endpoint.RejectProtectedFields = true
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PUT", uri, strings.NewReader(`{"intValue":6,"content":"foo"}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 400)
+			So(w.Body.String(), ShouldEqual, "{\"errors\":[{\"code\":\"protected_field\",\"message\":\"Field intValue can not be modified\",\"field\":\"intValue\"}]}")
+		})
+		Convey("create only fields can be set on create", func() {
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/pages", strings.NewReader(`{"intValue":6,"arrValue":["b"]}`))
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 201)
+
+			response := &singleResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data["intValue"], ShouldEqual, 0.0)
+			So(response.Data["arrValue"], ShouldResemble, []interface{}{"b"})
+		})
+		Convey("fields are hidden by their JSON key", func() {
+			endpoint.Factory = HistoricalFactory
+			endpoint.Store = NewMemoryStore()
+			endpoint.FieldPolicies = map[string]FieldPolicy{
+				"OtherVal": FieldHidden,
+			}
+
+			page := &HistoricalPage{OtherVal: "secret"}
+			page.Content = "foo"
+			So(endpoint.Store.Save(page), ShouldEqual, nil)
+
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages/"+page.Id.Hex(), nil)
+			router.ServeHTTP(w, req)
+
+			response := &singleResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data["content"], ShouldEqual, "foo")
+			So(response.Data, ShouldNotContainKey, "otherVal")
+			So(response.Data, ShouldNotContainKey, "otherval")
+		})
+		Convey("unknown fields panic when the routes are registered", func() {
+			endpoint.FieldPolicies = map[string]FieldPolicy{
+				"nope": FieldHidden,
+			}
+
+			So(func() { endpoint.GetRouter() }, ShouldPanic)
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongoz").DropDatabase()
+		})
+	})
+}
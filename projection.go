@@ -0,0 +1,66 @@
+package bongoz
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+)
+
+// Fields selected with _fields (or the endpoint's DefaultFields). Holds the
+// bson projection for the query and the JSON keys to keep in the response
+// (see renderDocument).
+type fieldSelection struct {
+	Projection bson.M
+	JSONKeys   []string
+}
+
+// Get the field selection for a read request. Names may be Go field names or
+// bson keys. Returns nil if the whole document should be returned.
+func (e *Endpoint) getFieldSelection(req *http.Request) (*fieldSelection, error) {
+	var fields []string
+
+	fieldsParam := req.URL.Query().Get("_fields")
+	if len(fieldsParam) > 0 {
+		fields = strings.Split(fieldsParam, ",")
+	} else {
+		fields = e.DefaultFields
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	instance := e.Factory()
+
+	selection := &fieldSelection{
+		Projection: bson.M{"_id": 1},
+		JSONKeys:   []string{"_id"},
+	}
+
+	for _, name := range fields {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+
+		field, ok := resolveField(name, instance)
+		if !ok {
+			return nil, fmt.Errorf("Unknown field %s", name)
+		}
+
+		if e.isHiddenField(instance, field) || len(e.AllowedFields) > 0 && !stringInSlice(field.Name, e.AllowedFields) && !stringInSlice(field.BsonKey, e.AllowedFields) {
+			return nil, fmt.Errorf("Field %s is not allowed", name)
+		}
+
+		selection.Projection[field.BsonKey] = 1
+		selection.JSONKeys = append(selection.JSONKeys, field.JSONKey)
+	}
+
+	// Loaded but not rendered, so the ETag can still come from the version
+	if field, ok := resolveField(e.VersionField, instance); ok {
+		selection.Projection[field.BsonKey] = 1
+	}
+
+	return selection, nil
+}
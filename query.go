@@ -1,103 +1,163 @@
 package bongoz
 
 import (
-	"encoding/json"
+	"fmt"
 	"gopkg.in/mgo.v2/bson"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func addIntToQuery(query bson.M, param string, modifier string, value string) {
+// Problems found in the query string of a list request, one per parameter
+type QueryError struct {
+	Errors []*Error
+}
+
+func (e *QueryError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Message
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+func addIntToQuery(query bson.M, param string, modifier string, value string) error {
 	withoutPrefix := strings.TrimPrefix(param, strings.Join([]string{modifier, "_"}, ""))
 
 	parsed, err := strconv.Atoi(value)
-	if err == nil {
-		sub := bson.M{}
-		sub[modifier] = parsed
-		query[withoutPrefix] = sub
+	if err != nil {
+		return fmt.Errorf("Invalid integer %s", value)
 	}
+
+	sub := bson.M{}
+	sub[modifier] = parsed
+	mergeCondition(query, withoutPrefix, sub)
+
+	return nil
 }
 
-func addDateToQuery(query bson.M, param string, modifier string, value string) {
+func addDateToQuery(query bson.M, param string, modifier string, value string) error {
 
 	withoutPrefix := strings.TrimPrefix(param, strings.Join([]string{modifier, "_"}, ""))
 
 	// Remove date from modifier
 	parsed, err := strconv.Atoi(value)
-	if err == nil {
-		i64 := int64(parsed)
-		t := time.Unix(i64, 0)
-		sub := bson.M{}
-		sub[modifier] = t
-		query[withoutPrefix] = sub
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp %s", value)
 	}
+
+	i64 := int64(parsed)
+	t := time.Unix(i64, 0)
+	sub := bson.M{}
+	sub[modifier] = t
+	mergeCondition(query, withoutPrefix, sub)
+
+	return nil
 }
 
-func addDateOrIntToQuery(instance interface{}, query bson.M, param string, modifier string, value string) {
+func addDateOrIntToQuery(instance interface{}, query bson.M, param string, modifier string, value string) error {
 	withoutPrefix := strings.TrimPrefix(param, strings.Join([]string{modifier, "_"}, ""))
 
-	if propertyIsType(instance, withoutPrefix, "time.Time") {
-		addDateToQuery(query, param, modifier, value)
-	} else {
-		addIntToQuery(query, param, modifier, value)
+	t, err := getFieldTypeByNameOrBsonTag(withoutPrefix, instance)
+	if err != nil {
+		return err
 	}
+
+	if t == "time.Time" {
+		return addDateToQuery(query, param, modifier, value)
+	}
+
+	return addIntToQuery(query, param, modifier, value)
 }
 
-func addValueToQuery(instance interface{}, query bson.M, param string, modifier string, value interface{}) {
-	addValueToQueryReplacingModifier(instance, query, param, modifier, strings.Join([]string{modifier, "_"}, ""), value)
+func addValueToQuery(instance interface{}, query bson.M, param string, modifier string, value interface{}) error {
+	return addValueToQueryReplacingModifier(instance, query, param, modifier, strings.Join([]string{modifier, "_"}, ""), value)
 }
 
-func addValueToQueryReplacingModifier(instance interface{}, query bson.M, param string, modifier string, replace string, value interface{}) {
+func addValueToQueryReplacingModifier(instance interface{}, query bson.M, param string, modifier string, replace string, value interface{}) error {
 	withoutPrefix := strings.TrimPrefix(param, replace)
 
 	sub := bson.M{}
 
-	checkForObjectIdAndAddToQuery(instance, withoutPrefix, modifier, value, sub)
+	err := checkForObjectIdAndAddToQuery(instance, withoutPrefix, modifier, value, sub)
+	if err != nil {
+		return err
+	}
+
+	mergeCondition(query, withoutPrefix, sub)
 
-	query[withoutPrefix] = sub
+	return nil
 }
 
-func checkForObjectIdAndAddToQuery(instance interface{}, property string, key string, value interface{}, query bson.M) {
+func addRegexToQuery(instance interface{}, query bson.M, param string, replace string, pattern string, options string) error {
+	err := checkRegex(pattern, defaultMaxRegexLength)
+	if err != nil {
+		return err
+	}
+
+	return addValueToQueryReplacingModifier(instance, query, param, "$regex", replace, bson.RegEx{Pattern: pattern, Options: options})
+}
+
+func checkForObjectIdAndAddToQuery(instance interface{}, property string, key string, value interface{}, query bson.M) error {
 	t, err := getFieldTypeByNameOrBsonTag(property, instance)
 	if err != nil {
-		log.Fatal(err.Error())
-		return
+		return err
 	}
 
 	if t == "bson.ObjectId" {
 		// Make sure it's valid...
 		if val, ok := value.(string); ok {
 			if bson.IsObjectIdHex(val) {
-				query[key] = bson.ObjectIdHex(val)
+				mergeCondition(query, key, bson.ObjectIdHex(val))
 			} else {
-				log.Fatalf("Invalid object ID %s", val)
-				return
+				return fmt.Errorf("Invalid object ID %s", val)
+			}
+		} else if vals, ok := value.([]string); ok {
+			parsed, err := parseObjectIds(vals)
+			if err != nil {
+				return err
 			}
+			mergeCondition(query, key, parsed)
 		} else {
-			log.Println("Could not convert value to string", value)
-			return
+			return fmt.Errorf("Could not convert %v to an object ID", value)
 		}
 
 	} else if t == "[]bson.ObjectId" {
 		if val, ok := value.([]string); ok {
-			parsed := make([]bson.ObjectId, 0)
-			for _, v := range val {
-				if bson.IsObjectIdHex(v) {
-					parsed = append(parsed, bson.ObjectIdHex(v))
-				}
+			parsed, err := parseObjectIds(val)
+			if err != nil {
+				return err
+			}
+			mergeCondition(query, key, parsed)
+		} else if val, ok := value.(string); ok {
+			parsed, err := parseObjectIds([]string{val})
+			if err != nil {
+				return err
 			}
-			query[key] = parsed
+			mergeCondition(query, key, parsed[0])
 		} else {
-			log.Fatal("Could not parse value as []string", value)
-			return
+			return fmt.Errorf("Could not convert %v to object IDs", value)
 		}
 	} else {
-		query[key] = value
+		mergeCondition(query, key, value)
+	}
+
+	return nil
+}
+
+func parseObjectIds(values []string) ([]bson.ObjectId, error) {
+	parsed := make([]bson.ObjectId, 0, len(values))
+
+	for _, v := range values {
+		if !bson.IsObjectIdHex(v) {
+			return nil, fmt.Errorf("Invalid object ID %s", v)
+		}
+		parsed = append(parsed, bson.ObjectIdHex(v))
 	}
 
+	return parsed, nil
 }
 
 func (e *Endpoint) getQuery(req *http.Request) (bson.M, error) {
@@ -106,44 +166,101 @@ func (e *Endpoint) getQuery(req *http.Request) (bson.M, error) {
 	q := bson.M{}
 
 	if e.AllowFullQuery {
-		// Marshal the query base64 into bson.M
+		// Parse and validate the JSON query, see FullQueryConfig
 		val := query.Get("_query")
 
 		if len(val) > 0 {
-			err := json.Unmarshal([]byte(val), &q)
+			q, err := e.parseFullQuery(val)
+
+			if err != nil {
+				return q, err
+			}
+
+			if searchErr := e.addSearchToQuery(req, q); searchErr != nil {
+				return q, &QueryError{[]*Error{searchErr}}
+			}
 
-			return q, err
+			return e.withBaseFilter(req, q)
 		}
 	}
 
 	// Get an instance so we can inspect it with reflection
 	instance := e.Factory()
 
+	// Collect every problem instead of stopping at the first one
+	errs := []*Error{}
+
 	for _, param := range e.QueryParams {
 		if val, ok := query[param]; ok {
 			if len(val) > 0 {
+				var err error
+
 				if strings.HasPrefix(param, "$lt_") {
-					addDateOrIntToQuery(instance, q, param, "$lt", query.Get(param))
+					err = addDateOrIntToQuery(instance, q, param, "$lt", query.Get(param))
 				} else if strings.HasPrefix(param, "$gt_") {
-					addDateOrIntToQuery(instance, q, param, "$gt", query.Get(param))
+					err = addDateOrIntToQuery(instance, q, param, "$gt", query.Get(param))
 				} else if strings.HasPrefix(param, "$gte_") {
-					addDateOrIntToQuery(instance, q, param, "$gte", query.Get(param))
+					err = addDateOrIntToQuery(instance, q, param, "$gte", query.Get(param))
 				} else if strings.HasPrefix(param, "$lte_") {
-					addDateOrIntToQuery(instance, q, param, "$lte", query.Get(param))
+					err = addDateOrIntToQuery(instance, q, param, "$lte", query.Get(param))
 				} else if strings.HasPrefix(param, "$in_") {
-					addValueToQuery(instance, q, param, "$in", val)
+					err = addValueToQuery(instance, q, param, "$in", val)
 				} else if strings.HasPrefix(param, "$nin_") {
-					addValueToQuery(instance, q, param, "$nin_", val)
+					err = addValueToQuery(instance, q, param, "$nin", val)
 				} else if strings.HasPrefix(param, "$regex_") {
-					addValueToQuery(instance, q, param, "$regex", bson.RegEx{query.Get(param), ""})
+					err = addRegexToQuery(instance, q, param, "$regex_", query.Get(param), "")
 				} else if strings.HasPrefix(param, "$regexi_") {
-					addValueToQueryReplacingModifier(instance, q, param, "$regex", "$regexi_", bson.RegEx{query.Get(param), "i"})
+					err = addRegexToQuery(instance, q, param, "$regexi_", query.Get(param), "i")
 				} else {
-					checkForObjectIdAndAddToQuery(instance, param, param, query.Get(param), q)
+					err = checkForObjectIdAndAddToQuery(instance, param, param, query.Get(param), q)
+				}
+
+				if err != nil {
+					errs = append(errs, NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, param, err.Error()))
 				}
 			}
 		}
 	}
 
-	return q, nil
+	errs = append(errs, e.addFiltersToQuery(instance, query, q)...)
+	errs = append(errs, e.addFilterGroupsToQuery(instance, query, q)...)
+
+	if searchErr := e.addSearchToQuery(req, q); searchErr != nil {
+		errs = append(errs, searchErr)
+	}
+
+	if len(errs) > 0 {
+		return q, &QueryError{errs}
+	}
+
+	return e.withBaseFilter(req, q)
+}
+
+// Constrain a query to the scope and soft delete filters
+func (e *Endpoint) withBaseFilter(req *http.Request, q bson.M) (bson.M, error) {
+	base, err := e.baseFilter(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return andFilters(q, base), nil
+}
+
+// Combine filters with $and, skipping empty ones
+func andFilters(filters ...bson.M) bson.M {
+	nonEmpty := []bson.M{}
+
+	for _, filter := range filters {
+		if len(filter) > 0 {
+			nonEmpty = append(nonEmpty, filter)
+		}
+	}
+
+	if len(nonEmpty) == 0 {
+		return bson.M{}
+	} else if len(nonEmpty) == 1 {
+		return nonEmpty[0]
+	}
+
+	return bson.M{"$and": nonEmpty}
 }
@@ -2,12 +2,13 @@ package bongoz
 
 import (
 	// "encoding/base64"
-	"encoding/json"
 	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
-	// "time"
+	"time"
 )
 
 func TestQuery(t *testing.T) {
@@ -23,11 +24,111 @@ func TestQuery(t *testing.T) {
 		}
 
 		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		endpoint.Factory = Factory
 		endpoint.AllowFullQuery = true
-		query, _ := endpoint.getQuery(request)
+		query, err := endpoint.getQuery(request)
 
-		// log.Println(query)
-		marshaled, _ := json.Marshal(query)
-		So(string(marshaled), ShouldEqual, `{"_id":{"$oid":"5525444a91692844dbfef192"}}`)
+		So(err, ShouldEqual, nil)
+		So(query["_id"], ShouldEqual, bson.ObjectIdHex("5525444a91692844dbfef192"))
+	})
+
+	Convey("Full query validation", t, func() {
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.AllowFullQuery = true
+		endpoint.FieldPolicies = map[string]FieldPolicy{
+			"randomMap": FieldHidden,
+		}
+
+		getQuery := func(fullQuery string) (bson.M, error) {
+			return endpoint.getQuery(&http.Request{
+				URL: &url.URL{RawQuery: url.Values{"_query": []string{fullQuery}}.Encode()},
+			})
+		}
+
+		Convey("resolves fields and decodes extended JSON", func() {
+			query, err := getQuery(`{"IntValue":{"$gte":3},"$or":[{"content":"foo"},{"dateValue":{"$lt":{"$date":"2015-04-08T00:00:00Z"}}}]}`)
+
+			So(err, ShouldEqual, nil)
+			So(query["intValue"], ShouldResemble, bson.M{"$gte": 3.0})
+			So(query["$or"], ShouldResemble, []interface{}{
+				bson.M{"content": "foo"},
+				bson.M{"dateValue": bson.M{"$lt": time.Date(2015, 4, 8, 0, 0, 0, 0, time.UTC)}},
+			})
+		})
+		Convey("rejects server side code and names the path", func() {
+			_, err := getQuery(`{"$or":[{"$where":"sleep(1000)"},{"content":{"$function":{}}}]}`)
+
+			qerr, ok := err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(len(qerr.Errors), ShouldEqual, 2)
+			So(qerr.Errors[0].Field, ShouldEqual, "$or.0.$where")
+			So(qerr.Errors[1].Field, ShouldEqual, "$or.1.content.$function")
+		})
+		Convey("rejects unknown and hidden fields", func() {
+			_, err := getQuery(`{"nothing":1,"randomMap.a":1}`)
+
+			qerr, ok := err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(qerr.Errors[0].Message, ShouldEqual, "Unknown field nothing")
+			So(qerr.Errors[1].Message, ShouldEqual, "Field randomMap can not be queried")
+		})
+		Convey("limits depth and clauses", func() {
+			endpoint.FullQuery.MaxDepth = 2
+			_, err := getQuery(`{"$and":[{"$or":[{"content":"foo"}]}]}`)
+			So(err, ShouldNotEqual, nil)
+
+			endpoint.FullQuery.MaxDepth = 0
+			endpoint.FullQuery.MaxClauses = 2
+			_, err = getQuery(`{"content":"foo","intValue":1,"arrValue":"a"}`)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldEqual, "Query has more than 2 clauses")
+		})
+		Convey("rejects regular expressions that can backtrack", func() {
+			_, err := getQuery(`{"content":{"$regex":"^(a+)+$"},"arrValue":{"$regex":"(a)\\1"}}`)
+
+			qerr, ok := err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(len(qerr.Errors), ShouldEqual, 2)
+			So(qerr.Errors[0].Message, ShouldEqual, "Backreferences are not allowed in regular expressions")
+			So(qerr.Errors[1].Message, ShouldEqual, "Nested quantifiers are not allowed in regular expressions")
+
+			_, err = getQuery(`{"content":{"$regex":"^(ab)+c*$"}}`)
+			So(err, ShouldEqual, nil)
+		})
+	})
+
+	Convey("Malformed query parameters", t, func() {
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = NewMemoryStore()
+		endpoint.QueryParams = []string{"$gte_intValue", "$lt_dateValue", "idValue", "$regex_content", "missing"}
+
+		Convey("are all reported", func() {
+			parsed, _ := url.Parse(`http://localhost:8000?$gte_intValue=abc&$lt_dateValue=yesterday&idValue=garbage&$regex_content=(&missing=1`)
+
+			request := &http.Request{
+				URL: parsed,
+			}
+
+			_, err := endpoint.getQuery(request)
+
+			qerr, ok := err.(*QueryError)
+			So(ok, ShouldEqual, true)
+			So(len(qerr.Errors), ShouldEqual, 5)
+			So(qerr.Errors[0].Field, ShouldEqual, "$gte_intValue")
+			So(qerr.Errors[2].Message, ShouldEqual, "Invalid object ID garbage")
+			So(qerr.Errors[4].Message, ShouldEqual, "No such field: missing")
+		})
+		Convey("answer a 400", func() {
+			router := endpoint.GetRouter()
+			w := httptest.NewRecorder()
+
+			req, _ := http.NewRequest("GET", "/api/pages?idValue=garbage", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 400)
+			So(w.Body.String(), ShouldContainSubstring, ErrorCodeInvalidQuery)
+		})
 	})
 }
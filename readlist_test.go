@@ -1,12 +1,15 @@
 package bongoz
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"github.com/justinas/alice"
 	"github.com/maxwellhealth/bongo"
 	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 )
 
@@ -88,6 +91,189 @@ func TestReadList(t *testing.T) {
 			So(response.Pagination.RecordsOnPage, ShouldEqual, 1)
 			So(len(response.Data), ShouldEqual, 1)
 		})
+		Convey("default sort and sort whitelist", func() {
+			endpoint.Factory = Factory
+			endpoint.Pagination.Sort = []SortConfig{{"intValue", -1}}
+			endpoint.SortableFields = []string{"intValue"}
+			router := endpoint.GetRouter()
+
+			for i := 0; i < 3; i++ {
+				err := collection.Save(&Page{IntValue: i})
+				So(err, ShouldEqual, nil)
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages?_perPage=2", nil)
+			router.ServeHTTP(w, req)
+
+			response := &listResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(response.Data[0]["intValue"], ShouldEqual, 2.0)
+			So(response.Data[1]["intValue"], ShouldEqual, 1.0)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/api/pages?_sort=content", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 400)
+		})
+		Convey("sort by resolved fields only", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+			endpoint.FieldPolicies = map[string]FieldPolicy{"content": FieldHidden}
+			router := endpoint.GetRouter()
+
+			for i := 0; i < 3; i++ {
+				So(endpoint.Store.Save(&Page{Content: strconv.Itoa(i), IntValue: i}), ShouldEqual, nil)
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages?_sort=-IntValue", nil)
+			router.ServeHTTP(w, req)
+
+			response := &listResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			So(response.Data[0]["intValue"], ShouldEqual, 2.0)
+
+			for _, sort := range []string{"content", "nope", "content&_after="} {
+				w = httptest.NewRecorder()
+				req, _ = http.NewRequest("GET", "/api/pages?_sort="+sort, nil)
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 400)
+			}
+
+			endpoint.Pagination.Sort = []SortConfig{{"content", 1}}
+			So(func() { endpoint.GetRouter() }, ShouldPanic)
+		})
+		Convey("sparse fieldsets", func() {
+			endpoint.Factory = Factory
+			router := endpoint.GetRouter()
+
+			err := collection.Save(&Page{Content: "foo", IntValue: 5})
+			So(err, ShouldEqual, nil)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages?_fields=IntValue", nil)
+			router.ServeHTTP(w, req)
+
+			response := &listResponse{}
+			err = json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(len(response.Data), ShouldEqual, 1)
+			So(response.Data[0]["intValue"], ShouldEqual, 5.0)
+			So(response.Data[0]["_id"], ShouldNotEqual, nil)
+			So(len(response.Data[0]), ShouldEqual, 2)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/api/pages?_fields=nope", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 400)
+		})
+		Convey("cursor pagination", func() {
+			endpoint.Factory = Factory
+			endpoint.Pagination.Mode = PaginationModeCursor
+			router := endpoint.GetRouter()
+
+			for i := 0; i < 5; i++ {
+				err := collection.Save(&Page{IntValue: i})
+				So(err, ShouldEqual, nil)
+			}
+
+			type cursorResponse struct {
+				Pagination CursorPaginationInfo
+				Data       []map[string]interface{}
+			}
+
+			get := func(uri string) *cursorResponse {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", uri, nil)
+				router.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 200)
+
+				response := &cursorResponse{}
+				err := json.Unmarshal(w.Body.Bytes(), response)
+				So(err, ShouldEqual, nil)
+				return response
+			}
+
+			first := get("/api/pages?_perPage=2&_sort=-intValue")
+			So(len(first.Data), ShouldEqual, 2)
+			So(first.Data[0]["intValue"], ShouldEqual, 4.0)
+			So(first.Pagination.Prev, ShouldEqual, "")
+			So(first.Pagination.Next, ShouldNotEqual, "")
+
+			second := get("/api/pages?_perPage=2&_sort=-intValue&_after=" + first.Pagination.Next)
+			So(len(second.Data), ShouldEqual, 2)
+			So(second.Data[0]["intValue"], ShouldEqual, 2.0)
+			So(second.Pagination.Prev, ShouldNotEqual, "")
+
+			back := get("/api/pages?_perPage=2&_sort=-intValue&_before=" + second.Pagination.Prev)
+			So(len(back.Data), ShouldEqual, 2)
+			So(back.Data[0]["intValue"], ShouldEqual, 4.0)
+			So(back.Pagination.Prev, ShouldEqual, "")
+		})
+		Convey("cursor pagination over missing values", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+			endpoint.Pagination.Mode = PaginationModeCursor
+			router := endpoint.GetRouter()
+
+			for i := 0; i < 4; i++ {
+				page := &Page{IntValue: i}
+				if i%2 == 1 {
+					page.IdValue = bson.NewObjectId()
+				}
+				So(endpoint.Store.Save(page), ShouldEqual, nil)
+			}
+
+			type cursorResponse struct {
+				Pagination CursorPaginationInfo
+				Data       []map[string]interface{}
+			}
+
+			for _, sort := range []string{"idValue", "-idValue"} {
+				seen := map[float64]bool{}
+				cursor := ""
+				for page := 0; page < 4; page++ {
+					w := httptest.NewRecorder()
+					req, _ := http.NewRequest("GET", "/api/pages?_perPage=1&_sort="+sort+"&_after="+cursor, nil)
+					router.ServeHTTP(w, req)
+					So(w.Code, ShouldEqual, 200)
+
+					response := &cursorResponse{}
+					So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+					So(len(response.Data), ShouldEqual, 1)
+
+					seen[response.Data[0]["intValue"].(float64)] = true
+					cursor = response.Pagination.Next
+				}
+
+				So(len(seen), ShouldEqual, 4)
+				So(cursor, ShouldEqual, "")
+			}
+		})
+		Convey("cursors with operators", func() {
+			endpoint.Factory = Factory
+			endpoint.Store = NewMemoryStore()
+			router := endpoint.GetRouter()
+
+			marshaled, err := bson.Marshal(&cursorToken{
+				Sort:   []string{"intValue", "_id"},
+				Values: []interface{}{bson.M{"$where": "sleep(1000)"}, bson.NewObjectId()},
+			})
+			So(err, ShouldEqual, nil)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages?_sort=intValue&_after="+base64.URLEncoding.EncodeToString(marshaled), nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 400)
+		})
 		Convey("readlist with middleware", func() {
 			endpoint.Factory = Factory
 
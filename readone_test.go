@@ -45,6 +45,22 @@ func TestReadOne(t *testing.T) {
 
 			So(response.Data["content"], ShouldEqual, "foo")
 		})
+		Convey("with selected fields runs AfterFind", func() {
+			endpoint.Factory = HookedFactory
+			router := endpoint.GetRouter()
+
+			obj := &hookedPage{Page: Page{Content: "foo"}}
+			So(collection.Save(obj), ShouldEqual, nil)
+
+			hookCalls = nil
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages/"+obj.Id.Hex()+"?_fields=content", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+			So(hookCalls, ShouldResemble, []string{"AfterFind"})
+		})
 		Reset(func() {
 			conn.Session.DB("dplservertest").DropDatabase()
 
@@ -0,0 +1,87 @@
+package bongoz
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+)
+
+// Returned when the endpoint's Scope hook fails, e.g. because the request
+// lacks the authentication details needed to build the filter
+type ScopeError struct {
+	Err error
+}
+
+func (e *ScopeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Endpoint) getScope(req *http.Request) (bson.M, error) {
+	if e.Scope == nil {
+		return nil, nil
+	}
+
+	scope, err := e.Scope(req)
+	if err != nil {
+		return nil, &ScopeError{err}
+	}
+
+	return scope, nil
+}
+
+// The filter every lookup of the request is constrained to: the endpoint's
+// Scope and the soft delete filter
+func (e *Endpoint) baseFilter(req *http.Request) (bson.M, error) {
+	scope, err := e.getScope(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return andFilters(scope, e.softDeleteFilter(req)), nil
+}
+
+// Check a document about to be written against the request's scope, so
+// documents can not be created outside of it or moved out by an update
+func (e *Endpoint) checkScope(req *http.Request, doc interface{}) error {
+	scope, err := e.getScope(req)
+	if err != nil || len(scope) == 0 {
+		return err
+	}
+
+	encoded, err := encodeBson(doc)
+	if err != nil {
+		return err
+	}
+
+	ok, err := matchQuery(encoded, scope)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return NewError(http.StatusForbidden, ErrorCodeForbidden, "Document is outside of the scope of the request")
+	}
+
+	return nil
+}
+
+// Find a single document by ID, applying the same filters as list requests,
+// so documents outside the scope are not found. projection may be nil to load
+// the whole document.
+func (e *Endpoint) findById(req *http.Request, store Store, id bson.ObjectId, doc interface{}, projection bson.M) error {
+	filter, err := e.baseFilter(req)
+	if err != nil {
+		return err
+	}
+
+	if len(filter) == 0 && projection == nil {
+		return store.FindById(id, doc)
+	}
+
+	return store.FindOne(andFilters(bson.M{"_id": id}, filter), projection, doc)
+}
+
+// Answer a failed lookup: 403 if the scope could not be determined,
+// otherwise 404
+func (e *Endpoint) writeFindError(w http.ResponseWriter, req *http.Request, err error) {
+	e.writeError(w, req, err, http.StatusNotFound, ErrorCodeNotFound)
+}
@@ -0,0 +1,126 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	conn := getConnection()
+	collection := conn.Collection("pages")
+	defer conn.Session.Close()
+
+	Convey("Scope", t, func() {
+		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		endpoint.Factory = Factory
+		endpoint.Scope = func(req *http.Request) (bson.M, error) {
+			tenant, err := strconv.Atoi(req.Header.Get("X-Tenant"))
+			if err != nil {
+				return nil, errors.New("Missing tenant")
+			}
+			return bson.M{"intValue": tenant}, nil
+		}
+
+		mine := &Page{Content: "mine", IntValue: 1}
+		theirs := &Page{Content: "theirs", IntValue: 2}
+		collection.Save(mine)
+		collection.Save(theirs)
+
+		router := endpoint.GetRouter()
+
+		Convey("list only returns documents in scope", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages", nil)
+			req.Header.Set("X-Tenant", "1")
+			router.ServeHTTP(w, req)
+
+			response := &listResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+
+			So(err, ShouldEqual, nil)
+			So(len(response.Data), ShouldEqual, 1)
+			So(response.Data[0]["content"], ShouldEqual, "mine")
+		})
+		Convey("documents outside the scope are not found", func() {
+			uri := strings.Join([]string{"/api/pages", theirs.Id.Hex()}, "/")
+
+			for _, method := range []string{"GET", "PUT", "DELETE"} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, uri, strings.NewReader(`{"content":"hacked"}`))
+				req.Header.Set("X-Tenant", "1")
+				router.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, 404)
+			}
+
+			found := &Page{}
+			err := collection.FindById(theirs.Id, found)
+			So(err, ShouldEqual, nil)
+			So(found.Content, ShouldEqual, "theirs")
+		})
+		Convey("scope errors are forbidden", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/pages", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 403)
+		})
+		Convey("written documents must stay in the scope", func() {
+			store := NewMemoryStore()
+			endpoint.Store = store
+			endpoint.AllowBulk = true
+
+			page := &Page{Content: "mine", IntValue: 1}
+			So(store.Save(page), ShouldEqual, nil)
+
+			uri := "/api/pages/" + page.Id.Hex()
+
+			send := func(method string, uri string, body string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, uri, strings.NewReader(body))
+				req.Header.Set("X-Tenant", "1")
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			Convey("on create", func() {
+				w := send("POST", "/api/pages", `{"content":"theirs","intValue":2}`)
+				So(w.Code, ShouldEqual, 403)
+
+				w = send("POST", "/api/pages", `[{"content":"theirs","intValue":2}]`)
+				So(w.Body.String(), ShouldContainSubstring, ErrorCodeForbidden)
+
+				count, err := store.Count(bson.M{})
+				So(err, ShouldEqual, nil)
+				So(count, ShouldEqual, 1)
+
+				w = send("POST", "/api/pages", `{"content":"mine","intValue":1}`)
+				So(w.Code, ShouldEqual, 201)
+			})
+			Convey("on update", func() {
+				for _, method := range []string{"PUT", "PATCH"} {
+					w := send(method, uri, `{"intValue":2}`)
+					So(w.Code, ShouldEqual, 403)
+				}
+
+				found := &Page{}
+				So(store.FindById(page.Id, found), ShouldEqual, nil)
+				So(found.IntValue, ShouldEqual, 1)
+
+				w := send("PUT", uri, `{"content":"changed"}`)
+				So(w.Code, ShouldEqual, 200)
+			})
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongoz").DropDatabase()
+		})
+	})
+}
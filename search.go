@@ -0,0 +1,126 @@
+package bongoz
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+)
+
+// Stores that can create the text index used by _search
+type TextIndexer interface {
+	EnsureTextIndex(fields []string, language string) error
+}
+
+// Create the text index over SearchableFields if EnsureTextIndex is set
+func (e *Endpoint) ensureTextIndex() {
+	if !e.EnsureTextIndex || len(e.SearchableFields) == 0 {
+		return
+	}
+
+	indexer, ok := e.getStore().(TextIndexer)
+	if !ok {
+		panic(errors.New("EnsureTextIndex is set but the store can not create text indexes"))
+	}
+
+	err := indexer.EnsureTextIndex(e.searchableKeys(), e.SearchLanguage)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// The bson keys of SearchableFields. Panics on unknown fields.
+func (e *Endpoint) searchableKeys() []string {
+	if len(e.SearchableFields) == 0 {
+		return nil
+	}
+
+	instance := e.Factory()
+
+	keys := make([]string, len(e.SearchableFields))
+	for i, name := range e.SearchableFields {
+		field, ok := resolveField(name, instance)
+		if !ok {
+			panic(fmt.Errorf("Unknown field %s in SearchableFields", name))
+		}
+		keys[i] = field.BsonKey
+	}
+
+	return keys
+}
+
+// Check SearchableFields and TextScoreField when the routes are registered
+func (e *Endpoint) checkSearchFields() {
+	e.searchableKeys()
+
+	if len(e.TextScoreField) == 0 {
+		return
+	}
+
+	if _, ok := resolveField(e.TextScoreField, e.Factory()); !ok {
+		panic(fmt.Errorf("Unknown field %s in TextScoreField", e.TextScoreField))
+	}
+}
+
+// Get the search terms of a list request, from _search
+func (e *Endpoint) getSearch(req *http.Request) string {
+	return strings.TrimSpace(req.URL.Query().Get("_search"))
+}
+
+// Add a $text condition for _search to q
+func (e *Endpoint) addSearchToQuery(req *http.Request, q bson.M) *Error {
+	search := e.getSearch(req)
+	if len(search) == 0 {
+		return nil
+	}
+
+	if len(e.SearchableFields) == 0 {
+		return NewFieldError(http.StatusBadRequest, ErrorCodeInvalidQuery, "_search", "Search is not enabled")
+	}
+
+	text := bson.M{"$search": search}
+	if len(e.SearchLanguage) > 0 {
+		text["$language"] = e.SearchLanguage
+	}
+	q["$text"] = text
+
+	return nil
+}
+
+// The bson and JSON keys of TextScoreField, if the request searches and the
+// endpoint projects the relevance score
+func (e *Endpoint) getTextScoreField(req *http.Request) *resolvedField {
+	if len(e.TextScoreField) == 0 || len(e.getSearch(req)) == 0 || len(e.SearchableFields) == 0 {
+		return nil
+	}
+
+	field, ok := resolveField(e.TextScoreField, e.Factory())
+	if !ok {
+		return nil
+	}
+
+	return field
+}
+
+// Project the relevance score of a search into TextScoreField and, unless
+// the request passes _sort, sort by it
+func (e *Endpoint) addTextScoreToOptions(req *http.Request, options *FindOptions, selection *fieldSelection) {
+	field := e.getTextScoreField(req)
+	if field == nil {
+		return
+	}
+
+	if options.Projection == nil {
+		options.Projection = bson.M{}
+	}
+	options.Projection[field.BsonKey] = bson.M{"$meta": "textScore"}
+
+	if selection != nil {
+		selection.JSONKeys = append(selection.JSONKeys, field.JSONKey)
+	}
+
+	if len(req.URL.Query().Get("_sort")) == 0 {
+		options.Sort = append([]string{"$textScore:" + field.BsonKey}, options.Sort...)
+	}
+}
@@ -0,0 +1,97 @@
+package bongoz
+
+import (
+	"encoding/json"
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type searchablePage struct {
+	bongo.DocumentBase `bson:",inline"`
+	Title              string  `json:"title" bson:"title"`
+	Body               string  `json:"body" bson:"body"`
+	Score              float64 `json:"score,omitempty" bson:"score,omitempty"`
+}
+
+func SearchableFactory() bongo.Document {
+	return &searchablePage{}
+}
+
+func TestSearch(t *testing.T) {
+	Convey("Search", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = SearchableFactory
+		endpoint.Store = store
+		endpoint.SearchableFields = []string{"Title", "body"}
+		endpoint.EnsureTextIndex = true
+		endpoint.TextScoreField = "Score"
+		endpoint.Filters = map[string]FilterOp{"title": FilterEq}
+
+		So(store.Save(&searchablePage{Title: "Apples", Body: "Red apples and green apples"}), ShouldEqual, nil)
+		So(store.Save(&searchablePage{Title: "Pears", Body: "Pears, not apples"}), ShouldEqual, nil)
+		So(store.Save(&searchablePage{Title: "Plums", Body: "Nothing to see"}), ShouldEqual, nil)
+
+		router := endpoint.GetRouter()
+
+		list := func(url string) (int, *listResponse) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", url, nil)
+			router.ServeHTTP(w, req)
+
+			response := &listResponse{}
+			json.Unmarshal(w.Body.Bytes(), response)
+			return w.Code, response
+		}
+
+		Convey("creates the text index", func() {
+			So(store.textFields, ShouldResemble, []string{"title", "body"})
+		})
+		Convey("sorts by relevance and projects the score", func() {
+			code, response := list("/api/pages?_search=apples")
+
+			So(code, ShouldEqual, 200)
+			So(len(response.Data), ShouldEqual, 2)
+			So(response.Data[0]["title"], ShouldEqual, "Apples")
+			So(response.Data[0]["score"], ShouldEqual, 3)
+			So(response.Data[1]["title"], ShouldEqual, "Pears")
+		})
+		Convey("keeps the score with _fields", func() {
+			code, response := list("/api/pages?_search=apples&_fields=title")
+
+			So(code, ShouldEqual, 200)
+			So(response.Data[0], ShouldResemble, map[string]interface{}{"_id": response.Data[0]["_id"], "title": "Apples", "score": 3.0})
+		})
+		Convey("combines with filters and _sort", func() {
+			code, response := list("/api/pages?_search=apples&_sort=title")
+
+			So(code, ShouldEqual, 200)
+			So(response.Data[0]["title"], ShouldEqual, "Apples")
+
+			code, response = list("/api/pages?_search=apples&title=Pears")
+
+			So(code, ShouldEqual, 200)
+			So(len(response.Data), ShouldEqual, 1)
+			So(response.Data[0]["title"], ShouldEqual, "Pears")
+		})
+		Convey("is rejected when disabled", func() {
+			endpoint.SearchableFields = nil
+			code, _ := list("/api/pages?_search=apples")
+
+			So(code, ShouldEqual, 400)
+		})
+		Convey("unknown fields panic when the routes are registered", func() {
+			endpoint.TextScoreField = "nope"
+			So(func() { endpoint.GetRouter() }, ShouldPanic)
+
+			endpoint.TextScoreField = ""
+			endpoint.EnsureTextIndex = false
+			endpoint.SearchableFields = []string{"nope"}
+			So(func() { endpoint.GetRouter() }, ShouldPanic)
+		})
+	})
+}
@@ -75,3 +75,39 @@ func (v *validatedModel) Validate(collection *bongo.Collection) []error {
 
 	return ret
 }
+
+// Page recording the bongo hooks run on it in hookCalls
+type hookedPage struct {
+	Page `bson:",inline"`
+}
+
+var hookCalls []string
+
+func HookedFactory() bongo.Document {
+	return &hookedPage{}
+}
+
+func (p *hookedPage) BeforeSave(collection *bongo.Collection) error {
+	hookCalls = append(hookCalls, "BeforeSave")
+	return nil
+}
+
+func (p *hookedPage) AfterSave(collection *bongo.Collection) error {
+	hookCalls = append(hookCalls, "AfterSave")
+	return nil
+}
+
+func (p *hookedPage) AfterFind(collection *bongo.Collection) error {
+	hookCalls = append(hookCalls, "AfterFind")
+	return nil
+}
+
+func (p *hookedPage) BeforeDelete(collection *bongo.Collection) error {
+	hookCalls = append(hookCalls, "BeforeDelete")
+	return nil
+}
+
+func (p *hookedPage) AfterDelete(collection *bongo.Collection) error {
+	hookCalls = append(hookCalls, "AfterDelete")
+	return nil
+}
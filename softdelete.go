@@ -0,0 +1,137 @@
+package bongoz
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/maxwellhealth/bongo"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Whether soft deleted documents should be visible for this request. Only
+// honoured if the endpoint's CanIncludeDeleted allows it for the request.
+func (e *Endpoint) includeDeleted(req *http.Request) bool {
+	if req.URL.Query().Get("_includeDeleted") != "true" {
+		return false
+	}
+
+	return e.CanIncludeDeleted != nil && e.CanIncludeDeleted(req)
+}
+
+// Filter hiding soft deleted documents, or nil if they should be visible
+func (e *Endpoint) softDeleteFilter(req *http.Request) bson.M {
+	if !e.SoftDelete || e.includeDeleted(req) {
+		return nil
+	}
+
+	// Matches both a missing and a null field
+	return bson.M{e.DeletedField: nil}
+}
+
+// Whether saving the whole document would drop its deleted stamp, because
+// the model has no field for it. Updates write those documents with $set.
+func (e *Endpoint) dropsDeletedField(doc interface{}) bool {
+	if !e.SoftDelete {
+		return false
+	}
+
+	_, found := resolveField(e.DeletedField, doc)
+	return !found
+}
+
+// Delete a document, or just stamp the deleted field in soft delete mode.
+// condition is the one of checkIfMatch. Stamping only writes the deleted
+// field, so it runs none of the model's bongo hooks.
+func (e *Endpoint) deleteDocument(store Store, doc bongo.Document, condition bson.M) error {
+	if e.SoftDelete {
+		return store.Update(doc.GetId(), condition, bson.M{"$set": bson.M{e.DeletedField: time.Now()}})
+	}
+
+	return store.Delete(doc, condition)
+}
+
+// Handle a "Restore" request, undoing a soft delete. It is an update of the
+// deleted field, so If-Match and the BeforeUpdate and AfterUpdate hooks
+// apply. BeforeUpdate sees the document with the field cleared already.
+func (e *Endpoint) HandleRestore(w http.ResponseWriter, req *http.Request) {
+	defer e.handleError(w, req)
+	w.Header().Set("Content-Type", "application/json")
+
+	var err error
+
+	vars := mux.Vars(req)
+
+	id := vars["id"]
+
+	if len(id) == 0 || !bson.IsObjectIdHex(id) {
+		e.writeErrors(w, req, []*Error{invalidIdError()})
+		return
+	}
+
+	instance := e.Factory()
+
+	store := e.getStore()
+
+	scope, err := e.getScope(req)
+	if err != nil {
+		e.writeFindError(w, req, err)
+		return
+	}
+
+	// Only documents that are actually deleted can be restored
+	query := andFilters(bson.M{"_id": bson.ObjectIdHex(id), e.DeletedField: bson.M{"$ne": nil}}, scope)
+
+	err = store.FindOne(query, nil, instance)
+	if err != nil {
+		e.writeFindError(w, req, err)
+		return
+	}
+
+	condition, ok := e.checkIfMatch(w, req, instance)
+	if !ok {
+		return
+	}
+
+	original := e.originalForUpdate(instance)
+
+	if field, ok := resolveField(e.DeletedField, instance); ok {
+		value := reflectValue(instance).FieldByIndex(field.Index)
+		value.Set(reflect.Zero(value.Type()))
+	}
+
+	err = e.Hooks.beforeUpdate(req, original, instance)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	err = store.Update(instance.GetId(), condition, bson.M{"$unset": bson.M{e.DeletedField: ""}})
+	if err != nil {
+		e.writeConditionalError(w, req, err, condition)
+		return
+	}
+
+	err = store.FindById(instance.GetId(), instance)
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+		return
+	}
+
+	logAfterHookError(req, "AfterUpdate", e.Hooks.afterUpdate(req, instance))
+
+	e.setETag(w, instance, false)
+
+	data, err := e.renderDocument(instance, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	httpResponse := &HTTPSingleResponse{Data: data}
+
+	err = e.writeOne(w, req, e.defaultEncoder(), http.StatusOK, httpResponse)
+
+	if err != nil {
+		e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+	}
+}
@@ -0,0 +1,207 @@
+package bongoz
+
+import (
+	"github.com/maxwellhealth/bongo"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type deletablePage struct {
+	Page      `bson:",inline"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+}
+
+func DeletableFactory() bongo.Document {
+	return &deletablePage{}
+}
+
+func TestSoftDelete(t *testing.T) {
+	conn := getConnection()
+	collection := conn.Collection("pages")
+	defer conn.Session.Close()
+
+	Convey("Soft delete", t, func() {
+		endpoint := NewEndpoint("/api/pages", conn, "pages")
+		endpoint.Factory = Factory
+		endpoint.SoftDelete = true
+		endpoint.CanIncludeDeleted = func(req *http.Request) bool {
+			return req.Header.Get("X-Admin") == "true"
+		}
+
+		obj := &Page{
+			Content: "foo",
+		}
+
+		err := collection.Save(obj)
+		So(err, ShouldEqual, nil)
+
+		uri := strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/")
+
+		router := endpoint.GetRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", uri, nil)
+		router.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, 200)
+
+		// Still stored, but stamped
+		raw := bson.M{}
+		err = collection.Collection().FindId(obj.Id).One(&raw)
+		So(err, ShouldEqual, nil)
+		So(raw["deletedAt"], ShouldNotEqual, nil)
+
+		Convey("hidden from reads", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", uri, nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 404)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", uri+"?_includeDeleted=true", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 404)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", uri+"?_includeDeleted=true", nil)
+			req.Header.Set("X-Admin", "true")
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+		})
+		Convey("restore", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", uri+"/restore", nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", uri, nil)
+			router.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, 200)
+		})
+		Convey("deleted stamp can not be written", func() {
+			store := NewMemoryStore()
+			endpoint.Store = store
+
+			send := func(method string, url string, body string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, url, strings.NewReader(body))
+				req.Header.Set("X-Admin", "true")
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			Convey("through the model's field", func() {
+				endpoint.Factory = DeletableFactory
+
+				w := send("POST", "/api/pages", `{"content":"foo","deletedAt":"2015-04-08T00:00:00Z"}`)
+				So(w.Code, ShouldEqual, 201)
+
+				count, err := store.Count(bson.M{"deletedAt": nil})
+				So(err, ShouldEqual, nil)
+				So(count, ShouldEqual, 1)
+
+				page := &deletablePage{}
+				So(store.FindOne(bson.M{}, nil, page), ShouldEqual, nil)
+
+				w = send("PUT", "/api/pages/"+page.Id.Hex(), `{"deletedAt":"2015-04-08T00:00:00Z"}`)
+				So(w.Code, ShouldEqual, 200)
+
+				count, err = store.Count(bson.M{"deletedAt": nil})
+				So(err, ShouldEqual, nil)
+				So(count, ShouldEqual, 1)
+			})
+			Convey("by saving deleted documents", func() {
+				page := &Page{Content: "foo"}
+				So(store.Save(page), ShouldEqual, nil)
+
+				uri := "/api/pages/" + page.Id.Hex()
+
+				So(send("DELETE", uri, "").Code, ShouldEqual, 200)
+
+				for _, method := range []string{"PUT", "PATCH"} {
+					w := send(method, uri+"?_includeDeleted=true", `{"content":"bar"}`)
+					So(w.Code, ShouldEqual, 200)
+
+					count, err := store.Count(bson.M{"deletedAt": bson.M{"$ne": nil}})
+					So(err, ShouldEqual, nil)
+					So(count, ShouldEqual, 1)
+				}
+			})
+		})
+		Convey("restore is an update", func() {
+			store := NewMemoryStore()
+			endpoint.Store = store
+			endpoint.Factory = DeletableFactory
+
+			deletedAt := time.Now()
+			page := &deletablePage{DeletedAt: &deletedAt}
+			page.Content = "foo"
+			So(store.Save(page), ShouldEqual, nil)
+
+			uri := "/api/pages/" + page.Id.Hex() + "/restore"
+			etag := endpoint.setETag(httptest.NewRecorder(), page, false)
+
+			restore := func(ifMatch string) int {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", uri, nil)
+				if len(ifMatch) > 0 {
+					req.Header.Set("If-Match", ifMatch)
+				}
+				router.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			deleted := func() int {
+				count, err := store.Count(bson.M{"deletedAt": bson.M{"$ne": nil}})
+				So(err, ShouldEqual, nil)
+				return count
+			}
+
+			Convey("with If-Match", func() {
+				So(restore(`"stale"`), ShouldEqual, 412)
+				So(deleted(), ShouldEqual, 1)
+
+				So(restore(etag), ShouldEqual, 200)
+				So(deleted(), ShouldEqual, 0)
+			})
+			Convey("with the update hooks", func() {
+				calls := []string{}
+				endpoint.Hooks.BeforeUpdate = func(req *http.Request, original bongo.Document, doc bongo.Document) error {
+					So(original.(*deletablePage).DeletedAt, ShouldNotBeNil)
+					So(doc.(*deletablePage).DeletedAt, ShouldBeNil)
+					calls = append(calls, "BeforeUpdate")
+					return nil
+				}
+				endpoint.Hooks.AfterUpdate = func(req *http.Request, doc bongo.Document) error {
+					calls = append(calls, "AfterUpdate")
+					return nil
+				}
+
+				So(restore(""), ShouldEqual, 200)
+				So(calls, ShouldResemble, []string{"BeforeUpdate", "AfterUpdate"})
+			})
+			Convey("refused by BeforeUpdate", func() {
+				endpoint.Hooks.BeforeUpdate = func(req *http.Request, original bongo.Document, doc bongo.Document) error {
+					return NewError(http.StatusForbidden, ErrorCodeForbidden, "No")
+				}
+
+				So(restore(""), ShouldEqual, 403)
+				So(deleted(), ShouldEqual, 1)
+			})
+		})
+
+		Reset(func() {
+			conn.Session.DB("bongoz").DropDatabase()
+		})
+	})
+}
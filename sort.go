@@ -0,0 +1,135 @@
+package bongoz
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Get the sort for a list request. _sort overrides the endpoint's default
+// PaginationConfig.Sort, and _id is always appended as a tiebreaker so pages
+// are stable. Fields are given by Go name or bson key and sorted on by their
+// bson key; unknown and hidden fields are refused. If SortableFields is set,
+// only those fields may be used in _sort.
+func (e *Endpoint) getSort(req *http.Request) ([]SortConfig, error) {
+	sortParam := req.URL.Query().Get("_sort")
+
+	if len(sortParam) == 0 {
+		sort, err := e.resolveSort(e.Pagination.Sort)
+		if err != nil {
+			panic(err)
+		}
+		return withIdTiebreaker(sort), nil
+	}
+
+	sort, err := e.resolveSort(parseSortParam(sortParam))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(e.SortableFields) > 0 {
+		instance := e.Factory()
+		for _, s := range sort {
+			field, _ := resolveField(s.Field, instance)
+			if s.Field != "_id" && !stringInSlice(field.Name, e.SortableFields) && !stringInSlice(field.BsonKey, e.SortableFields) {
+				return nil, fmt.Errorf("Sorting on %s is not allowed", s.Field)
+			}
+		}
+	}
+
+	return withIdTiebreaker(sort), nil
+}
+
+// Replace the fields of a sort by their bson keys
+func (e *Endpoint) resolveSort(sort []SortConfig) ([]SortConfig, error) {
+	if len(sort) == 0 {
+		return sort, nil
+	}
+
+	instance := e.Factory()
+	resolved := make([]SortConfig, len(sort))
+
+	for i, s := range sort {
+		field, ok := resolveField(s.Field, instance)
+		if !ok {
+			return nil, fmt.Errorf("Unknown field %s", s.Field)
+		}
+
+		if e.isHiddenField(instance, field) {
+			return nil, fmt.Errorf("Sorting on %s is not allowed", s.Field)
+		}
+
+		resolved[i] = SortConfig{field.BsonKey, s.Direction}
+	}
+
+	return resolved, nil
+}
+
+// Check the default sort of the endpoint when its routes are registered
+func (e *Endpoint) checkPaginationSort() {
+	_, err := e.resolveSort(e.Pagination.Sort)
+	if err != nil {
+		panic(fmt.Errorf("Invalid Pagination.Sort: %s", err))
+	}
+}
+
+// Parse a comma separated sort parameter, e.g. "-dateValue,content"
+func parseSortParam(param string) []SortConfig {
+	sort := []SortConfig{}
+
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		direction := 1
+		if strings.HasPrefix(field, "-") {
+			direction = -1
+			field = strings.TrimPrefix(field, "-")
+		} else if strings.HasPrefix(field, "+") {
+			field = strings.TrimPrefix(field, "+")
+		}
+
+		sort = append(sort, SortConfig{field, direction})
+	}
+
+	return sort
+}
+
+// Convert a sort to the field list mgo expects
+func sortConfigToStrings(sort []SortConfig) []string {
+	fields := make([]string, len(sort))
+
+	for i, s := range sort {
+		if s.Direction < 0 {
+			fields[i] = "-" + s.Field
+		} else {
+			fields[i] = s.Field
+		}
+	}
+
+	return fields
+}
+
+// Make sure the sort ends with _id so every document has a unique position
+func withIdTiebreaker(sort []SortConfig) []SortConfig {
+	for _, s := range sort {
+		if s.Field == "_id" {
+			return sort
+		}
+	}
+
+	// Never append to the caller's backing array (e.g. PaginationConfig.Sort)
+	return append(sort[:len(sort):len(sort)], SortConfig{"_id", 1})
+}
+
+func reverseSort(sort []SortConfig) []SortConfig {
+	reversed := make([]SortConfig, len(sort))
+
+	for i, s := range sort {
+		reversed[i] = SortConfig{s.Field, -s.Direction}
+	}
+
+	return reversed
+}
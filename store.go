@@ -0,0 +1,297 @@
+package bongoz
+
+import (
+	"github.com/maxwellhealth/bongo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"strings"
+)
+
+// Options for Store.Find. Sort uses mgo's syntax ("-field" for descending),
+// a zero Limit means no limit and a nil Projection returns whole documents.
+// Near turns the find into a $geoNear, where the query must not have a $near
+// condition of its own.
+type FindOptions struct {
+	Sort       []string
+	Skip       int
+	Limit      int
+	Projection bson.M
+	Near       *GeoNear
+}
+
+// Iterator over the documents matched by Store.Find
+type Results interface {
+	Next(doc interface{}) bool
+	Close() error
+}
+
+// Storage backend of an endpoint. Queries and updates are MongoDB style
+// bson.M documents, as built by getQuery and the write handlers.
+type Store interface {
+	Find(query bson.M, options *FindOptions) (Results, error)
+	Count(query bson.M) (int, error)
+	FindById(id bson.ObjectId, doc interface{}) error
+	FindOne(query bson.M, projection bson.M, doc interface{}) error
+	Save(doc bongo.Document) error
+	// Apply an update document ($set, $unset, $push) to a stored document.
+	// A non-nil condition must match the document too, or nothing is
+	// written and ErrNotFound is returned. Saves that go through Update
+	// call BeforeSave and AfterSave around it.
+	Update(id bson.ObjectId, condition bson.M, update bson.M) error
+	// Delete a stored document, only if it matches a non-nil condition
+	// like Update. The document's delete hooks run either way.
+	Delete(doc bongo.Document, condition bson.M) error
+	// Run the document's BeforeSave and Validate hooks the way Save does
+	BeforeSave(doc bongo.Document) error
+	// Run the document's AfterSave hook the way Save does
+	AfterSave(doc bongo.Document) error
+}
+
+// Store backed by a bongo collection. Used by default for endpoints without
+// a Store.
+type BongoStore struct {
+	Collection *bongo.Collection
+}
+
+func NewBongoStore(connection *bongo.Connection, collectionName string) *BongoStore {
+	return &BongoStore{connection.Collection(collectionName)}
+}
+
+type bongoResults struct {
+	resultSet *bongo.ResultSet
+}
+
+func (r *bongoResults) Next(doc interface{}) bool {
+	return r.resultSet.Next(doc)
+}
+
+func (r *bongoResults) Close() error {
+	return r.resultSet.Free()
+}
+
+// Results of an aggregation, decoded like bongo.ResultSet decodes those of
+// a find
+type pipeResults struct {
+	iter       *mgo.Iter
+	collection *bongo.Collection
+	err        error
+}
+
+func (r *pipeResults) Next(doc interface{}) bool {
+	if !r.iter.Next(doc) {
+		return false
+	}
+
+	r.err = afterFind(r.collection, doc)
+	return r.err == nil
+}
+
+// Run the AfterFind hook and reset the trackers of a document read without
+// bongo, the way bongo does for the documents it reads
+func afterFind(collection *bongo.Collection, doc interface{}) error {
+	if hook, ok := doc.(bongo.AfterFindHook); ok {
+		err := hook.AfterFind(collection)
+		if err != nil {
+			return err
+		}
+	}
+
+	if trackable, ok := doc.(bongo.Trackable); ok {
+		trackable.GetDiffTracker().Reset()
+	}
+
+	if tracker, ok := doc.(bongo.NewTracker); ok {
+		tracker.SetIsNew(false)
+	}
+
+	return nil
+}
+
+func (r *pipeResults) Close() error {
+	err := r.iter.Close()
+	if r.err != nil {
+		return r.err
+	}
+
+	return err
+}
+
+func (s *BongoStore) Find(query bson.M, options *FindOptions) (Results, error) {
+	if options != nil && options.Near != nil {
+		return s.findNear(query, options), nil
+	}
+
+	results := s.Collection.Find(query)
+
+	if options != nil {
+		if len(options.Sort) > 0 {
+			results.Query.Sort(options.Sort...)
+		}
+		if options.Skip > 0 {
+			results.Query.Skip(options.Skip)
+		}
+		if options.Limit > 0 {
+			results.Query.Limit(options.Limit)
+		}
+		if options.Projection != nil {
+			results.Query.Select(options.Projection)
+		}
+	}
+
+	return &bongoResults{results}, nil
+}
+
+// Run a find with FindOptions.Near as an aggregation starting with $geoNear
+func (s *BongoStore) findNear(query bson.M, options *FindOptions) Results {
+	// Before MongoDB 4.2 $geoNear returns 100 documents, unless a $limit
+	// directly follows it. Later pages and exports need the rest.
+	pipeline := []bson.M{options.Near.stage(query), {"$limit": math.MaxInt32}}
+
+	if len(options.Sort) > 0 {
+		pipeline = append(pipeline, bson.M{"$sort": sortDocument(options.Sort)})
+	}
+	if options.Skip > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": options.Skip})
+	}
+	if options.Limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": options.Limit})
+	}
+	if options.Projection != nil {
+		pipeline = append(pipeline, bson.M{"$project": options.Projection})
+	}
+
+	return &pipeResults{iter: s.Collection.Collection().Pipe(pipeline).Iter(), collection: s.Collection}
+}
+
+// Convert a sort in mgo's syntax to a $sort document
+func sortDocument(sort []string) bson.D {
+	doc := bson.D{}
+
+	for _, field := range sort {
+		direction := 1
+		if strings.HasPrefix(field, "-") {
+			direction = -1
+			field = field[1:]
+		}
+		doc = append(doc, bson.DocElem{Name: field, Value: direction})
+	}
+
+	return doc
+}
+
+func (s *BongoStore) Aggregate(pipeline []bson.M) ([]bson.M, error) {
+	results := []bson.M{}
+	err := s.Collection.Collection().Pipe(pipeline).All(&results)
+
+	return results, err
+}
+
+func (s *BongoStore) Count(query bson.M) (int, error) {
+	return s.Collection.Collection().Find(query).Count()
+}
+
+func (s *BongoStore) FindById(id bson.ObjectId, doc interface{}) error {
+	return s.Collection.FindById(id, doc)
+}
+
+func (s *BongoStore) FindOne(query bson.M, projection bson.M, doc interface{}) error {
+	if projection != nil {
+		err := s.Collection.Collection().Find(query).Select(projection).One(doc)
+		if err != nil {
+			return err
+		}
+
+		return afterFind(s.Collection, doc)
+	}
+
+	return s.Collection.FindOne(query, doc)
+}
+
+func (s *BongoStore) Save(doc bongo.Document) error {
+	return s.Collection.Save(doc)
+}
+
+func (s *BongoStore) Update(id bson.ObjectId, condition bson.M, update bson.M) error {
+	err := s.Collection.Collection().Update(andFilters(bson.M{"_id": id}, condition), update)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Deletes with a condition go to the collection directly, with the delete
+// hooks run the way DeleteDocument runs them
+func (s *BongoStore) Delete(doc bongo.Document, condition bson.M) error {
+	if condition == nil {
+		return s.Collection.DeleteDocument(doc)
+	}
+
+	if hook, ok := doc.(bongo.BeforeDeleteHook); ok {
+		err := hook.BeforeDelete(s.Collection)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.Collection.Collection().Remove(andFilters(bson.M{"_id": doc.GetId()}, condition))
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if hook, ok := doc.(bongo.AfterDeleteHook); ok {
+		return hook.AfterDelete(s.Collection)
+	}
+
+	return nil
+}
+
+func (s *BongoStore) BeforeSave(doc bongo.Document) error {
+	if hook, ok := doc.(bongo.BeforeSaveHook); ok {
+		err := hook.BeforeSave(s.Collection)
+		if err != nil {
+			return err
+		}
+	}
+
+	if validator, ok := doc.(bongo.ValidateHook); ok {
+		errs := validator.Validate(s.Collection)
+		if len(errs) > 0 {
+			return &bongo.ValidationError{Errors: errs}
+		}
+	}
+
+	return nil
+}
+
+func (s *BongoStore) AfterSave(doc bongo.Document) error {
+	if hook, ok := doc.(bongo.AfterSaveHook); ok {
+		return hook.AfterSave(s.Collection)
+	}
+
+	return nil
+}
+
+func (s *BongoStore) EnsureTextIndex(fields []string, language string) error {
+	keys := make([]string, len(fields))
+	for i, field := range fields {
+		keys[i] = "$text:" + field
+	}
+
+	return s.Collection.Collection().EnsureIndex(mgo.Index{
+		Key:             keys,
+		DefaultLanguage: language,
+	})
+}
+
+// The endpoint's Store, or a BongoStore for its Connection and CollectionName
+func (e *Endpoint) getStore() Store {
+	if e.Store != nil {
+		return e.Store
+	}
+
+	return NewBongoStore(e.Connection, e.CollectionName)
+}
@@ -0,0 +1,258 @@
+package bongoz
+
+import (
+	"encoding/csv"
+	"github.com/maxwellhealth/bongo"
+	"github.com/maxwellhealth/go-enhanced-json"
+	"io"
+	"net/http"
+)
+
+// Encoders that can write a list while its documents are read, see
+// Endpoint.StreamLists
+type StreamEncoder interface {
+	Encoder
+	StreamList(w io.Writer, model interface{}) ListStream
+}
+
+// A list response being written. The pagination block is only known after
+// the last document, so envelopes put it after the data. Close gets the
+// response without its documents.
+type ListStream interface {
+	Write(doc interface{}) error
+	Close(response *HTTPListResponse) error
+}
+
+// Whether the request asks for an export of every matching document with
+// _export=true. Writes an error and returns false if it is not allowed.
+func (e *Endpoint) getExport(w http.ResponseWriter, req *http.Request, encoder Encoder) (bool, bool) {
+	if req.URL.Query().Get("_export") != "true" {
+		return false, true
+	}
+
+	if e.CanExport == nil || !e.CanExport(req) {
+		e.writeErrors(w, req, []*Error{NewFieldError(http.StatusForbidden, ErrorCodeForbidden, "_export", "Exports are not allowed")})
+		return false, false
+	}
+
+	if _, ok := e.streamEncoder(encoder); !ok {
+		e.writeErrors(w, req, []*Error{NewFieldError(http.StatusNotAcceptable, ErrorCodeNotAcceptable, "_export", "Exports can not be written as "+e.contentType(encoder))})
+		return false, false
+	}
+
+	return true, true
+}
+
+// Write the documents of results as they are read. Nothing is written
+// before the first document has passed the afterRead hook, so errors up to
+// there still get a regular error response. Later errors abort the
+// response, since its status has been sent already.
+func (e *Endpoint) streamList(w http.ResponseWriter, req *http.Request, encoder StreamEncoder, results Results, selection *fieldSelection, pageInfo *bongo.PaginationInfo, paginate bool) {
+	var stream ListStream
+	flusher, _ := w.(http.Flusher)
+
+	// The pages are known before the records are read
+	links := listLinks(req, pageInfo)
+	setLinkHeader(w, links)
+	links["self"] = req.URL.RequestURI()
+
+	count := 0
+	for {
+		res := e.Factory()
+		if !results.Next(res) {
+			break
+		}
+
+		err := e.Hooks.afterRead(req, res)
+		if err != nil {
+			if stream == nil {
+				e.writeError(w, req, err, http.StatusInternalServerError, ErrorCodeInternal)
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}
+
+		data, err := e.renderDocument(res, selection)
+		if err != nil {
+			panic(err)
+		}
+
+		if stream == nil {
+			w.Header().Set("Content-Type", encoder.ContentType())
+			stream = encoder.StreamList(w, e.Factory())
+		}
+
+		err = stream.Write(data)
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		count++
+	}
+
+	if stream == nil {
+		w.Header().Set("Content-Type", encoder.ContentType())
+		stream = encoder.StreamList(w, e.Factory())
+	}
+
+	finishPaginationInfo(pageInfo, paginate, count)
+
+	err := stream.Close(&HTTPListResponse{Pagination: pageInfo, Links: halLinks(links)})
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// Writes {"data":[...],"pagination":{...},"_links":{...}}, with each
+// document converted by toValue if set
+type jsonListStream struct {
+	w       io.Writer
+	toValue func(doc interface{}) (interface{}, error)
+	started bool
+}
+
+func (j *jsonListStream) Write(doc interface{}) error {
+	var err error
+	if j.toValue != nil {
+		doc, err = j.toValue(doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	marshaled, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	prefix := ","
+	if !j.started {
+		prefix = `{"data":[`
+		j.started = true
+	}
+
+	_, err = io.WriteString(j.w, prefix+string(marshaled))
+	return err
+}
+
+func (j *jsonListStream) Close(response *HTTPListResponse) error {
+	pagination, err := json.Marshal(response.Pagination)
+	if err != nil {
+		return err
+	}
+
+	links, err := json.Marshal(response.Links)
+	if err != nil {
+		return err
+	}
+
+	prefix := "]"
+	if !j.started {
+		prefix = `{"data":[]`
+	}
+
+	_, err = io.WriteString(j.w, prefix+`,"pagination":`+string(pagination)+`,"_links":`+string(links)+"}\n")
+	return err
+}
+
+func (j *JSONEncoder) StreamList(w io.Writer, model interface{}) ListStream {
+	return &jsonListStream{w: w}
+}
+
+func (x *ExtendedJSONEncoder) StreamList(w io.Writer, model interface{}) ListStream {
+	return &jsonListStream{w: w, toValue: toExtendedJSONDocument}
+}
+
+type ndjsonListStream struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonListStream) Write(doc interface{}) error {
+	return n.encoder.Encode(doc)
+}
+
+func (n *ndjsonListStream) Close(response *HTTPListResponse) error {
+	return nil
+}
+
+func (n *NDJSONEncoder) StreamList(w io.Writer, model interface{}) ListStream {
+	return &ndjsonListStream{json.NewEncoder(w)}
+}
+
+// Columns are picked when the first row is written, so with selected or
+// hidden fields they are the ones present in the first document
+type csvListStream struct {
+	encoder *CSVEncoder
+	model   interface{}
+	writer  *csv.Writer
+	columns []CSVColumn
+}
+
+func (c *csvListStream) Write(doc interface{}) error {
+	row, trimmed, err := csvRow(doc)
+	if err != nil {
+		return err
+	}
+
+	if c.columns == nil {
+		err = c.writeHeader([]map[string]interface{}{row}, trimmed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.writeRow(row)
+}
+
+func (c *csvListStream) writeHeader(rows []map[string]interface{}, trimmed bool) error {
+	c.columns = c.encoder.columns(c.model, rows, trimmed)
+
+	record := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		record[i] = column.Header
+	}
+
+	return c.writer.Write(record)
+}
+
+func (c *csvListStream) writeRow(row map[string]interface{}) error {
+	var err error
+
+	record := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		record[i], err = csvCell(row[column.Key])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.writer.Write(record)
+	if err != nil {
+		return err
+	}
+
+	c.writer.Flush()
+
+	return c.writer.Error()
+}
+
+func (c *csvListStream) Close(response *HTTPListResponse) error {
+	if c.columns == nil {
+		err := c.writeHeader(nil, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.writer.Flush()
+
+	return c.writer.Error()
+}
+
+func (c *CSVEncoder) StreamList(w io.Writer, model interface{}) ListStream {
+	return &csvListStream{encoder: c, model: model, writer: csv.NewWriter(w)}
+}
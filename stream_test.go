@@ -0,0 +1,103 @@
+package bongoz
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamLists(t *testing.T) {
+	Convey("Streamed lists", t, func() {
+		store := NewMemoryStore()
+
+		endpoint := NewEndpoint("/api/pages", nil, "pages")
+		endpoint.Factory = Factory
+		endpoint.Store = store
+		endpoint.StreamLists = true
+		endpoint.Pagination.PerPage = 2
+		endpoint.Filters = map[string]FilterOp{"content": FilterEq}
+
+		for _, content := range []string{"a", "b", "c"} {
+			So(store.Save(&Page{Content: content}), ShouldEqual, nil)
+		}
+
+		router := endpoint.GetRouter()
+
+		get := func(url string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", url, nil)
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("writes the pagination after the data", func() {
+			w := get("/api/pages?_sort=content&_page=2")
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Flushed, ShouldEqual, true)
+			So(w.Body.String(), ShouldStartWith, `{"data":[`)
+
+			response := &listResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			So(len(response.Data), ShouldEqual, 1)
+			So(response.Data[0]["content"], ShouldEqual, "c")
+			So(response.Pagination.Current, ShouldEqual, 2)
+			So(response.Pagination.TotalPages, ShouldEqual, 2)
+			So(response.Pagination.TotalRecords, ShouldEqual, 3)
+			So(response.Pagination.RecordsOnPage, ShouldEqual, 1)
+		})
+		Convey("empty lists", func() {
+			w := get("/api/pages?content[eq]=x")
+
+			response := &listResponse{}
+			So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+			So(len(response.Data), ShouldEqual, 0)
+			So(response.Pagination.TotalRecords, ShouldEqual, 0)
+		})
+		Convey("CSV", func() {
+			w := get("/api/pages?_sort=content&_fields=content&_format=csv")
+
+			So(w.Code, ShouldEqual, 200)
+			lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			So(len(lines), ShouldEqual, 3)
+			So(lines[0], ShouldEqual, "_id,content")
+			So(lines[1], ShouldEndWith, ",a")
+			So(lines[2], ShouldEndWith, ",b")
+		})
+		Convey("exports", func() {
+			Convey("are forbidden without CanExport", func() {
+				w := get("/api/pages?_export=true")
+				So(w.Code, ShouldEqual, 403)
+			})
+
+			endpoint.CanExport = func(req *http.Request) bool {
+				return true
+			}
+
+			Convey("return every document", func() {
+				w := get("/api/pages?_export=true&_limit=1&_format=ndjson")
+
+				So(w.Code, ShouldEqual, 200)
+				So(len(strings.Split(strings.TrimSpace(w.Body.String()), "\n")), ShouldEqual, 3)
+			})
+			Convey("stream even if lists are not streamed", func() {
+				endpoint.StreamLists = false
+
+				w := get("/api/pages?_export=true")
+
+				response := &listResponse{}
+				So(json.Unmarshal(w.Body.Bytes(), response), ShouldEqual, nil)
+				So(len(response.Data), ShouldEqual, 3)
+				So(response.Pagination.TotalRecords, ShouldEqual, 3)
+				So(response.Pagination.TotalPages, ShouldEqual, 1)
+			})
+			Convey("need a streaming format", func() {
+				w := get("/api/pages?_export=true&_format=msgpack")
+				So(w.Code, ShouldEqual, 406)
+			})
+		})
+	})
+}
@@ -79,7 +79,7 @@ func TestUpdate(t *testing.T) {
 			req, _ := http.NewRequest("PUT", strings.Join([]string{"/api/pages", obj.Id.Hex()}, "/"), reader)
 			router.ServeHTTP(w, req)
 			So(w.Code, ShouldEqual, 400)
-			So(w.Body.String(), ShouldEqual, "{\"errors\":[\"Content is required\"]}")
+			So(w.Body.String(), ShouldEqual, "{\"errors\":[{\"code\":\"validation_failed\",\"message\":\"Content is required\"}]}")
 		})
 
 		Reset(func() {
@@ -1,9 +1,7 @@
 package bongoz
 
 import (
-	"errors"
-	"github.com/oleiade/reflections"
-	"log"
+	"fmt"
 	"reflect"
 	"strings"
 )
@@ -19,26 +17,119 @@ func getFieldTypeByNameOrBsonTag(name string, obj interface{}) (string, error) {
 }
 
 func getFieldByNameOrBsonTag(name string, obj interface{}) (reflect.Value, error) {
-	structTags, _ := reflections.Tags(obj, "bson")
-
 	objValue := reflectValue(obj)
-	// field := objValue.FieldByName(prop)
 
+	field, ok := resolveField(name, obj)
+	if !ok {
+		return objValue, fmt.Errorf("No such field: %s", name)
+	}
+
+	return objValue.FieldByIndex(field.Index), nil
+}
+
+// A struct field along with the keys it is stored and serialized under
+type resolvedField struct {
+	Index   []int
+	Name    string
+	BsonKey string
+	// "-" for fields left out of the JSON encoding
+	JSONKey string
+}
+
+// The key go-enhanced-json writes a field under: its json tag name, or the
+// Go name with a lowercased first letter
+func jsonKeyOf(structField reflect.StructField) string {
+	key := strings.Split(structField.Tag.Get("json"), ",")[0]
+	if len(key) == 0 {
+		key = strings.ToLower(structField.Name[:1]) + structField.Name[1:]
+	}
+
+	return key
+}
+
+// Resolve a field by its Go name (case insensitive) or its bson key. Fields of
+// embedded structs tagged `bson:",inline"` (e.g. bongo.DocumentBase) are
+// included.
+func resolveField(name string, obj interface{}) (*resolvedField, bool) {
+	return resolveFieldOfType(name, reflectValue(obj).Type(), []int{})
+}
+
+func resolveFieldOfType(name string, typ reflect.Type, index []int) (*resolvedField, bool) {
 	lname := strings.ToLower(name)
 
-	var lk string
-	for k, v := range structTags {
-		lk = strings.ToLower(k)
+	for i := 0; i < typ.NumField(); i++ {
+		structField := typ.Field(i)
+		fieldIndex := append(index[:len(index):len(index)], i)
+
+		tagParts := strings.Split(structField.Tag.Get("bson"), ",")
+		key := tagParts[0]
+
+		if key == "-" {
+			continue
+		}
+
+		if structField.Anonymous && stringInSlice("inline", tagParts[1:]) && structField.Type.Kind() == reflect.Struct {
+			if field, ok := resolveFieldOfType(name, structField.Type, fieldIndex); ok {
+				return field, true
+			}
+			continue
+		}
+
+		if len(structField.PkgPath) > 0 {
+			// Unexported
+			continue
+		}
+
+		if len(key) == 0 {
+			key = strings.ToLower(structField.Name)
+		}
 
-		if lk == lname || v == name {
-			field := objValue.FieldByName(k)
-			return field, nil
+		if strings.ToLower(structField.Name) == lname || key == name {
+			return &resolvedField{fieldIndex, structField.Name, key, jsonKeyOf(structField)}, true
 		}
 	}
 
-	log.Fatalf("No such field: %s in obj", name)
-	return objValue, errors.New("No such field")
+	return nil, false
+}
+
+// List the fields of a struct type in order, the way resolveFieldOfType
+// finds them
+func listFieldsOfType(typ reflect.Type, index []int) []*resolvedField {
+	fields := []*resolvedField{}
+
+	for i := 0; i < typ.NumField(); i++ {
+		structField := typ.Field(i)
+		fieldIndex := append(index[:len(index):len(index)], i)
+
+		tagParts := strings.Split(structField.Tag.Get("bson"), ",")
+		key := tagParts[0]
+
+		if key == "-" {
+			continue
+		}
+
+		if structField.Anonymous && stringInSlice("inline", tagParts[1:]) && structField.Type.Kind() == reflect.Struct {
+			fields = append(fields, listFieldsOfType(structField.Type, fieldIndex)...)
+			continue
+		}
+
+		if len(structField.PkgPath) > 0 {
+			continue
+		}
+
+		if len(key) == 0 {
+			key = strings.ToLower(structField.Name)
+		}
+
+		jsonKey := jsonKeyOf(structField)
+		if jsonKey == "-" {
+			continue
+		}
+
+		fields = append(fields, &resolvedField{fieldIndex, structField.Name, key, jsonKey})
+	}
 
+	return fields
 }
 
 func propertyIsType(obj interface{}, prop string, t string) bool {
@@ -66,3 +157,60 @@ func reflectValue(obj interface{}) reflect.Value {
 
 	return val
 }
+
+// Set every field that takes part in JSON encoding back to its zero value.
+// Unexported fields (e.g. a diff tracker) and fields tagged `json:"-"` are kept.
+func zeroJSONFields(obj interface{}) {
+	zeroJSONFieldsOfValue(reflectValue(obj))
+}
+
+func zeroJSONFieldsOfValue(val reflect.Value) {
+	typ := val.Type()
+
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)
+		structField := typ.Field(i)
+
+		tag := structField.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		if structField.Anonymous && field.Kind() == reflect.Struct && len(strings.Split(tag, ",")[0]) == 0 {
+			zeroJSONFieldsOfValue(field)
+			continue
+		}
+
+		if field.CanSet() {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+}
+
+// Like getFieldByNameOrBsonTag, but also resolves fields promoted from
+// embedded structs and reports a missing field instead of failing
+func findFieldByNameOrBsonTag(name string, obj interface{}) (reflect.Value, bool) {
+	objValue := reflectValue(obj)
+
+	field := objValue.FieldByName(name)
+	if field.IsValid() {
+		return field, true
+	}
+
+	resolved, ok := resolveField(name, obj)
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	return objValue.FieldByIndex(resolved.Index), true
+}
+
+func stringInSlice(str string, list []string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}